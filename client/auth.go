@@ -63,8 +63,22 @@ func (s *FileAuthStore) tokenDirFile(scheme string, endpoint string) (string, st
 	return schemeDir, endpoint + AuthTokenSuffix
 }
 
+// checkName checks that a scheme or endpoint name cannot refer to a file
+// outside the store.
+func checkName(name string) error {
+	if name == "" || strings.Contains(name, "/") || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid token store name: %q", name)
+	}
+	return nil
+}
+
 // Get retrieves a token for a scheme and endpoint.
 func (s *FileAuthStore) Get(scheme string, endpoint string) (*affinity.TokenInfo, error) {
+	for _, name := range []string{scheme, endpoint} {
+		if err := checkName(name); err != nil {
+			return nil, err
+		}
+	}
 	schemeDir, tokenFileName := s.tokenDirFile(scheme, endpoint)
 	tokenPath := path.Join(schemeDir, tokenFileName)
 	if fi, err := os.Stat(tokenPath); err != nil {
@@ -95,6 +109,11 @@ func (s *FileAuthStore) Get(scheme string, endpoint string) (*affinity.TokenInfo
 
 // Set stores a token.
 func (s *FileAuthStore) Set(token *affinity.TokenInfo, endpoint string) error {
+	for _, name := range []string{token.Scheme, endpoint} {
+		if err := checkName(name); err != nil {
+			return err
+		}
+	}
 	tokenDir, tokenName := s.tokenDirFile(token.Scheme, endpoint)
 	err := os.MkdirAll(tokenDir, 0700)
 	if err != nil {
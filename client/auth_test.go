@@ -80,3 +80,11 @@ func (s *ClientSuite) TestWantsAuth(c *C) {
 	c.Check(foo.Values.Get("secret"), Equals, "squirrel")
 	c.Check(bar.Values.Get("human"), Equals, "cannonball")
 }
+
+func (s *ClientSuite) TestInvalidNames(c *C) {
+	token := &TokenInfo{Scheme: "foo", Values: url.Values{"secret": []string{"squirrel"}}}
+	c.Check(s.Store.Set(token, "../example.com"), ErrorMatches, `invalid token store name: "../example.com"`)
+	c.Check(s.Store.Set(&TokenInfo{Scheme: "../foo"}, "example.com"), ErrorMatches, `invalid token store name: .*`)
+	_, err := s.Store.Get("foo", "../../auth/foo/example.com")
+	c.Check(err, ErrorMatches, `invalid token store name: .*`)
+}
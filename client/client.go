@@ -19,6 +19,7 @@ package client
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/juju/affinity"
 )
@@ -28,6 +29,10 @@ import (
 type AuthClient struct {
 	*http.Client
 	Store AuthStore
+	// Realms maps the realms whose credentials may be shared by several
+	// servers to the hosts of those servers. Credentials stored for a realm
+	// are only sent to the hosts listed for it.
+	Realms map[string][]string
 }
 
 // WantsAuth returns information on the authentication schemes
@@ -49,25 +54,49 @@ func WantsAuth(resp *http.Response) []*affinity.TokenInfo {
 	return tokens
 }
 
-// Authorize adds any stored auth tokens from the requested schemes to an *http.Request.
+// Authorize adds a stored auth token for one of the schemes a server is
+// challenging for to an *http.Request. Challenges are considered in the
+// order given, which is the server's preference. Tokens are looked up by the
+// host of the request, and then by the realm of the challenge if the host is
+// listed for the realm in Realms, so that a token may be shared by the
+// servers of a realm. Challenges with an error are skipped, as the server has
+// already rejected the stored token.
 func (c *AuthClient) Authorize(req *http.Request, schemes []*affinity.TokenInfo) error {
-	var err error
-	// Update request with obtained credentials.
 	req.Header.Del("Authorization")
 	for _, scheme := range schemes {
-		var token *affinity.TokenInfo
-		token, err = c.Store.Get(scheme.Scheme, req.Host)
-		if err == ErrAuthNotFound {
+		if scheme.Values.Get("error") != "" {
 			continue
-		} else if err != nil {
-			return err
 		}
-		req.Header.Add("Authorization", token.Serialize())
+		endpoints := []string{req.Host}
+		if realm := scheme.Realm(); realm != "" && realm != req.Host && c.sharesRealm(req.Host, realm) {
+			endpoints = append(endpoints, realm)
+		}
+		for _, endpoint := range endpoints {
+			token, err := c.Store.Get(scheme.Scheme, endpoint)
+			if err == ErrAuthNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			req.Header.Set("Authorization", token.Serialize())
+			return nil
+		}
+	}
+	return ErrAuthNotFound
+}
+
+// sharesRealm reports whether a host may be sent the credentials stored for a
+// realm.
+func (c *AuthClient) sharesRealm(host, realm string) bool {
+	if strings.Contains(realm, "/") || strings.Contains(realm, "..") {
+		return false
 	}
-	if len(req.Header["Authorization"]) == 0 {
-		return ErrAuthNotFound
+	for _, realmHost := range c.Realms[realm] {
+		if realmHost == host {
+			return true
+		}
 	}
-	return nil
+	return false
 }
 
 // Do performs an *http.Request and returns the *http.Response or
@@ -83,8 +112,11 @@ func (c *AuthClient) Do(req *http.Request) (resp *http.Response, err error) {
 			// No more schemes are supported.
 			return resp, err
 		}
-		// Re-attempt
-		c.Authorize(req, schemes)
+		// Re-attempt, if there are credentials the server may accept.
+		if c.Authorize(req, schemes) != nil {
+			return resp, err
+		}
+		resp.Body.Close()
 		resp, err = c.Client.Do(req)
 	}
 	return resp, err
@@ -0,0 +1,131 @@
+package client_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity"
+	. "github.com/juju/affinity/client"
+	"github.com/juju/affinity/providers/signed"
+	"github.com/juju/affinity/rbac/storage/mem"
+	"github.com/juju/affinity/server"
+)
+
+type NegotiateSuite struct {
+	*httptest.Server
+	scheme *signed.Scheme
+	store  AuthStore
+	host   string
+}
+
+var _ = Suite(&NegotiateSuite{})
+
+func (s *NegotiateSuite) SetUpTest(c *C) {
+	s.scheme = signed.NewScheme(signed.NewHMACKey("k1", []byte("secret")))
+	srv := server.NewAuthServer(mem.NewFactStore())
+	srv.Realm = "planet-express"
+	srv.Schemes.Register(s.scheme)
+	srv.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		user, err := srv.Authenticate(r)
+		if err != nil {
+			srv.Unauthorized(r, err).Send(w)
+			return
+		}
+		(&server.Response{Result: user.String()}).Send(w)
+	})
+	s.Server = httptest.NewServer(srv)
+	u, err := url.Parse(s.URL)
+	c.Assert(err, IsNil)
+	s.host = u.Host
+	s.store, err = NewFileAuthStore(c.MkDir())
+	c.Assert(err, IsNil)
+}
+
+func (s *NegotiateSuite) TearDownTest(c *C) {
+	s.Server.Close()
+}
+
+func (s *NegotiateSuite) whoami(c *C) *http.Response {
+	client := &AuthClient{Client: http.DefaultClient, Store: s.store}
+	req, err := http.NewRequest("GET", s.URL+"/whoami", nil)
+	c.Assert(err, IsNil)
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	return resp
+}
+
+func (s *NegotiateSuite) TestNegotiate(c *C) {
+	// Without credentials, the challenge is returned to the caller.
+	resp := s.whoami(c)
+	c.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	challenges := WantsAuth(resp)
+	c.Assert(challenges, HasLen, 1)
+	c.Check(challenges[0].Scheme, Equals, signed.SchemeName)
+	c.Check(challenges[0].Realm(), Equals, "planet-express")
+
+	tokenInfo, err := s.scheme.Authorize(affinity.MustParsePrincipal("usso:fry"))
+	c.Assert(err, IsNil)
+	c.Assert(s.store.Set(tokenInfo, s.host), IsNil)
+	resp = s.whoami(c)
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+	sent, err := affinity.ParseTokenInfo(resp.Request.Header.Get("Authorization"))
+	c.Assert(err, IsNil)
+	c.Check(sent, DeepEquals, tokenInfo)
+}
+
+func (s *NegotiateSuite) TestRealmCredentials(c *C) {
+	tokenInfo, err := s.scheme.Authorize(affinity.MustParsePrincipal("usso:fry"))
+	c.Assert(err, IsNil)
+	c.Assert(s.store.Set(tokenInfo, "planet-express"), IsNil)
+	// Credentials for a realm are not sent to hosts not listed for it.
+	resp := s.whoami(c)
+	c.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	client := &AuthClient{Client: http.DefaultClient, Store: s.store,
+		Realms: map[string][]string{"planet-express": {s.host}}}
+	req, err := http.NewRequest("GET", s.URL+"/whoami", nil)
+	c.Assert(err, IsNil)
+	resp, err = client.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *NegotiateSuite) TestAuthorize(c *C) {
+	c.Assert(s.store.Set(&affinity.TokenInfo{Scheme: "foo", Values: url.Values{"secret": {"squirrel"}}}, "example.com"), IsNil)
+	c.Assert(s.store.Set(&affinity.TokenInfo{Scheme: "bar", Values: url.Values{"scooby": {"snack"}}}, "example.com"), IsNil)
+	c.Assert(s.store.Set(&affinity.TokenInfo{Scheme: "baz", Values: url.Values{"human": {"cannonball"}}}, "planet-express"), IsNil)
+	client := &AuthClient{Client: http.DefaultClient, Store: s.store}
+
+	for _, test := range []struct {
+		challenges []string
+		auth       string
+	}{
+		{[]string{`foo realm="example.com"`, `bar realm="example.com"`}, "foo secret=squirrel"},
+		{[]string{`baz realm="example.com"`, `bar realm="example.com"`}, "bar scooby=snack"},
+		// Rejected credentials are not sent again.
+		{[]string{`foo error="invalid_token", realm="example.com"`, `bar realm="example.com"`}, "bar scooby=snack"},
+		{[]string{`baz realm="example.com"`}, ""},
+		// Credentials stored for other hosts are not sent, whatever the realm.
+		{[]string{`baz realm="planet-express"`}, ""},
+		{[]string{`baz realm="../baz/planet-express"`}, ""},
+	} {
+		resp := &http.Response{Header: make(http.Header)}
+		for _, challenge := range test.challenges {
+			resp.Header.Add("WWW-Authenticate", challenge)
+		}
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		c.Assert(err, IsNil)
+		err = client.Authorize(req, WantsAuth(resp))
+		if test.auth == "" {
+			c.Check(err, Equals, ErrAuthNotFound)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(req.Header[http.CanonicalHeaderKey("Authorization")], DeepEquals, []string{test.auth})
+	}
+}
@@ -24,10 +24,15 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/juju/affinity"
 	"github.com/juju/affinity/client"
+	affinity_group "github.com/juju/affinity/group"
+	"github.com/juju/affinity/providers/apitoken"
+	"github.com/juju/affinity/rbac"
 )
 
 type GroupClient struct {
@@ -57,33 +62,94 @@ func (c *GroupClient) DeleteGroup(group string) error {
 }
 
 func (c *GroupClient) GetGroup(group string) (g affinity.Principal, err error) {
-	out, err := c.doGroupRequest(group, "GET")
+	list, err := c.ListMembers(group, false, 0, 1)
 	if err != nil {
 		return g, err
 	}
-	err = json.Unmarshal(out, &g)
-	return g, err
+	return list.Group, nil
+}
+
+// ListMembers obtains a page of at most limit members of a group, starting at
+// offset among all the members. If recursive, the members of groups nested
+// within the group are listed in place of the nested groups themselves. A limit
+// of zero uses the server's default page size.
+func (c *GroupClient) ListMembers(group string, recursive bool, offset, limit int) (*affinity_group.MemberList, error) {
+	query := url.Values{"offset": []string{strconv.Itoa(offset)}}
+	if recursive {
+		query.Set("recursive", "true")
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	out, err := c.doRequest(fmt.Sprintf("/%s/", group), query, "GET")
+	if err != nil {
+		return nil, err
+	}
+	var list affinity_group.MemberList
+	err = json.Unmarshal(out, &list)
+	return &list, err
 }
 
 func (c *GroupClient) doGroupRequest(group string, method string) ([]byte, error) {
-	var u url.URL
-	u = c.Url
-	u.Path = fmt.Sprintf("/%s/", group)
-	req, err := http.NewRequest(method, u.String(), nil)
+	return c.doRequest(fmt.Sprintf("/%s/", group), nil, method)
+}
+
+func (c *GroupClient) doRequest(path string, query url.Values, method string) ([]byte, error) {
+	req, err := c.newRequest(path, query, method)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.AuthClient.Do(req)
+	return readResponse(c.AuthClient.Do(req))
+}
+
+func (c *GroupClient) newRequest(path string, query url.Values, method string) (*http.Request, error) {
+	var u url.URL
+	u = c.Url
+	u.Path = path
+	u.RawQuery = query.Encode()
+	return http.NewRequest(method, u.String(), nil)
+}
+
+func readResponse(resp *http.Response, err error) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf(strings.ToLower(resp.Status))
-	}
 	var buf bytes.Buffer
 	_, err = io.Copy(&buf, resp.Body)
-	return buf.Bytes(), err
+	if err != nil {
+		return nil, err
+	}
+	return decodeResponse(resp.StatusCode, resp.Status, buf.Bytes())
+}
+
+// decodeResponse returns the result from a response envelope, or its error as
+// an *affinity.Error. Error responses which are not enveloped, such as those
+// from an intermediate proxy, are classified by their HTTP status.
+func decodeResponse(statusCode int, status string, body []byte) ([]byte, error) {
+	var envelope affinity.Response
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Version == 0 {
+		if statusCode != http.StatusOK {
+			return nil, &affinity.Error{
+				Code:    affinity.StatusErrorCode(statusCode),
+				Message: strings.ToLower(status),
+			}
+		}
+		return nil, fmt.Errorf("malformed response: %q", body)
+	}
+	if envelope.Version > affinity.ResponseVersion {
+		return nil, fmt.Errorf("unsupported response version: %d", envelope.Version)
+	}
+	if envelope.Error != nil {
+		return nil, envelope.Error
+	}
+	if statusCode != http.StatusOK {
+		return nil, &affinity.Error{
+			Code:    affinity.StatusErrorCode(statusCode),
+			Message: strings.ToLower(status),
+		}
+	}
+	return envelope.Result, nil
 }
 
 func (c *GroupClient) AddUser(group string, user affinity.Principal) error {
@@ -96,28 +162,155 @@ func (c *GroupClient) DeleteUser(group string, user affinity.Principal) error {
 	return err
 }
 
-func (c *GroupClient) CheckUser(group string, user affinity.Principal) error {
-	_, err := c.doUserRequest(group, user, "GET")
+// CheckUser tests if a user is a member of a group. If transitive, the user may
+// also be a member through groups nested within the group.
+func (c *GroupClient) CheckUser(group string, user affinity.Principal, transitive bool) error {
+	var query url.Values
+	if transitive {
+		query = url.Values{"transitive": []string{"true"}}
+	}
+	_, err := c.doRequest(fmt.Sprintf("/%s/%s/", group, user.String()), query, "GET")
 	return err
 }
 
+// Explain obtains the derivation of whether a user has a permission on a group.
+func (c *GroupClient) Explain(group string, user affinity.Principal, perm string) (*rbac.Explanation, error) {
+	out, err := c.doRequest(fmt.Sprintf("/%s/%s/why", group, user.String()), url.Values{"perm": []string{perm}}, "GET")
+	if err != nil {
+		return nil, err
+	}
+	var explanation rbac.Explanation
+	err = json.Unmarshal(out, &explanation)
+	return &explanation, err
+}
+
 func (c *GroupClient) doUserRequest(group string, user affinity.Principal, method string) ([]byte, error) {
-	var u url.URL
-	u = c.Url
-	u.Path = fmt.Sprintf("/%s/%s/", group, user.String())
-	req, err := http.NewRequest(method, u.String(), nil)
+	return c.doRequest(fmt.Sprintf("/%s/%s/", group, user.String()), nil, method)
+}
+
+// Whoami obtains the principal the client is authenticated as.
+func (c *GroupClient) Whoami() (p affinity.Principal, err error) {
+	out, err := c.doRequest("/_/whoami", nil, "GET")
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(out, &p)
+	return p, err
+}
+
+// GroupsOf obtains the groups a user is a member of, immediately or through
+// nested groups.
+func (c *GroupClient) GroupsOf(user affinity.Principal) ([]affinity.Principal, error) {
+	return c.doPrincipalsRequest(fmt.Sprintf("/_/groups/%s", user.String()))
+}
+
+// ManagedGroups obtains the groups the client's user owns or administers.
+func (c *GroupClient) ManagedGroups() ([]affinity.Principal, error) {
+	return c.doPrincipalsRequest("/_/managed")
+}
+
+func (c *GroupClient) doPrincipalsRequest(path string) ([]affinity.Principal, error) {
+	out, err := c.doRequest(path, nil, "GET")
 	if err != nil {
 		return nil, err
 	}
-	resp, err := c.AuthClient.Do(req)
+	var principals []affinity.Principal
+	err = json.Unmarshal(out, &principals)
+	return principals, err
+}
+
+// rolesPath returns the path of the roles granted on a group, or on the
+// service if the group is empty.
+func rolesPath(group string) string {
+	if group == "" {
+		return "/_/roles"
+	}
+	return fmt.Sprintf("/%s/_/roles", group)
+}
+
+// ListRoles obtains the roles granted on a group, or on the service if the
+// group is empty.
+func (c *GroupClient) ListRoles(group string) ([]affinity_group.RoleGrant, error) {
+	out, err := c.doRequest(rolesPath(group), nil, "GET")
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf(strings.ToLower(resp.Status))
+	var grants []affinity_group.RoleGrant
+	err = json.Unmarshal(out, &grants)
+	return grants, err
+}
+
+// Grant grants a role to a user on a group, or on the service if the group is
+// empty.
+func (c *GroupClient) Grant(group string, user affinity.Principal, role string) error {
+	_, err := c.doRequest(fmt.Sprintf("%s/%s/%s", rolesPath(group), role, user.String()), nil, "PUT")
+	return err
+}
+
+// Revoke revokes a role from a user on a group, or on the service if the group
+// is empty.
+func (c *GroupClient) Revoke(group string, user affinity.Principal, role string) error {
+	_, err := c.doRequest(fmt.Sprintf("%s/%s/%s", rolesPath(group), role, user.String()), nil, "DELETE")
+	return err
+}
+
+// MintToken mints an API token for the client's user, limited to the named
+// permissions if any are given. If ttl is not zero, the token expires after
+// that duration.
+func (c *GroupClient) MintToken(name string, scope []string, ttl time.Duration) (*apitoken.MintedToken, error) {
+	query := url.Values{"name": []string{name}}
+	if len(scope) > 0 {
+		query.Set("scope", strings.Join(scope, ","))
 	}
-	var buf bytes.Buffer
-	_, err = io.Copy(&buf, resp.Body)
-	return buf.Bytes(), err
+	if ttl != 0 {
+		query.Set("ttl", ttl.String())
+	}
+	out, err := c.doRequest("/_/tokens", query, "POST")
+	if err != nil {
+		return nil, err
+	}
+	var minted apitoken.MintedToken
+	err = json.Unmarshal(out, &minted)
+	return &minted, err
+}
+
+// MintTokenBasic mints an API token for a user who authenticates with a
+// password, sent with HTTP Basic authentication rather than a stored
+// credential. If ttl is not zero, the token expires after that duration.
+func (c *GroupClient) MintTokenBasic(username, password, name string, ttl time.Duration) (*apitoken.MintedToken, error) {
+	query := url.Values{"name": []string{name}}
+	if ttl != 0 {
+		query.Set("ttl", ttl.String())
+	}
+	req, err := c.newRequest("/_/tokens", query, "POST")
+	if err != nil {
+		return nil, err
+	}
+	// The password is the only credential sent; stored credentials are not
+	// negotiated.
+	req.SetBasicAuth(username, password)
+	out, err := readResponse(c.AuthClient.Client.Do(req))
+	if err != nil {
+		return nil, err
+	}
+	var minted apitoken.MintedToken
+	err = json.Unmarshal(out, &minted)
+	return &minted, err
+}
+
+// ListTokens obtains the API tokens minted for the client's user.
+func (c *GroupClient) ListTokens() ([]*apitoken.Token, error) {
+	out, err := c.doRequest("/_/tokens", nil, "GET")
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*apitoken.Token
+	err = json.Unmarshal(out, &tokens)
+	return tokens, err
+}
+
+// RevokeToken revokes one of the API tokens minted for the client's user.
+func (c *GroupClient) RevokeToken(id string) error {
+	_, err := c.doRequest(fmt.Sprintf("/_/tokens/%s", id), nil, "DELETE")
+	return err
 }
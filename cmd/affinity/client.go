@@ -18,40 +18,48 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"time"
 
 	"launchpad.net/gnuflag"
 
 	"github.com/juju/affinity"
 	"github.com/juju/affinity/client"
 	"github.com/juju/affinity/client/group"
+	affinity_group "github.com/juju/affinity/group"
 )
 
-type groupCmd struct {
+type serverCmd struct {
 	subCmd
 	url     string
-	group   string
 	homeDir string
+	tlsCert string
+	tlsKey  string
+	caCert  string
 	client  *group.GroupClient
 }
 
-func groupFlags(h cmdHandler, cmd *groupCmd) {
+func serverFlags(h cmdHandler, cmd *serverCmd) {
 	cmd.flags = gnuflag.NewFlagSet(h.Name(), gnuflag.ExitOnError)
 	cmd.flags.StringVar(&cmd.url, "url", "", "Affinity server URL")
-	cmd.flags.StringVar(&cmd.group, "group", "", "Affinity group")
 	cmd.flags.StringVar(&cmd.homeDir, "homedir", "", "Affinity client home (default: ~/.affinity)")
+	cmd.flags.StringVar(&cmd.tlsCert, "tls-cert", "", "TLS client certificate file, to authenticate by certificate")
+	cmd.flags.StringVar(&cmd.tlsKey, "tls-key", "", "TLS client private key file")
+	cmd.flags.StringVar(&cmd.caCert, "ca-cert", "", "PEM file of CA certificates trusted to verify the server")
 }
 
-func (c *groupCmd) Main(h cmdHandler) {
+func (c *serverCmd) Main(h cmdHandler) {
 	if c.url == "" {
 		Usage(h, "--url is required")
 	}
-	if c.group == "" {
-		Usage(h, "--group is required")
-	}
 	if c.homeDir == "" {
 		c.homeDir = path.Join(os.Getenv("HOME"), ".affinity")
 	}
@@ -66,6 +74,50 @@ func (c *groupCmd) Main(h cmdHandler) {
 		die(err)
 	}
 	c.client = group.NewGroupClient(serverUrl, authStore)
+	if c.tlsCert != "" || c.tlsKey != "" || c.caCert != "" {
+		c.client.Client, err = c.tlsClient()
+		if err != nil {
+			die(err)
+		}
+	}
+}
+
+// tlsClient creates an HTTP client which presents a client certificate, and
+// verifies the server with the given CA certificates.
+func (c *serverCmd) tlsClient() (*http.Client, error) {
+	config := &tls.Config{}
+	if c.tlsCert != "" || c.tlsKey != "" {
+		clientCert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{clientCert}
+	}
+	if c.caCert != "" {
+		pool, err := loadCertPool(c.caCert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}, nil
+}
+
+type groupCmd struct {
+	serverCmd
+	group string
+}
+
+func groupFlags(h cmdHandler, cmd *groupCmd) {
+	serverFlags(h, &cmd.serverCmd)
+	cmd.flags.StringVar(&cmd.group, "group", "", "Affinity group")
+}
+
+func (c *groupCmd) Main(h cmdHandler) {
+	c.serverCmd.Main(h)
+	if c.group == "" {
+		Usage(h, "--group is required")
+	}
 }
 
 type userCmd struct {
@@ -158,6 +210,40 @@ func (c *showGroupCmd) Main() {
 	os.Stdout.Write(out)
 }
 
+type listMembersCmd struct {
+	groupCmd
+	recursive bool
+}
+
+func newListMembersCmd() *listMembersCmd {
+	cmd := &listMembersCmd{}
+	groupFlags(cmd, &cmd.groupCmd)
+	cmd.flags.BoolVar(&cmd.recursive, "recursive", false, "List members of nested groups in their place")
+	return cmd
+}
+
+func (c *listMembersCmd) Name() string { return "list-members" }
+
+func (c *listMembersCmd) Desc() string { return "List members of affinity group" }
+
+func (c *listMembersCmd) Main() {
+	c.groupCmd.Main(c)
+	for offset := 0; ; {
+		list, err := c.client.ListMembers(c.group, c.recursive, offset, 0)
+		if err != nil {
+			die(err)
+		}
+		for _, member := range list.Members {
+			fmt.Println(member.String())
+		}
+		offset += len(list.Members)
+		if len(list.Members) == 0 || offset >= list.Total {
+			break
+		}
+	}
+	die(nil)
+}
+
 type addUserCmd struct {
 	userCmd
 }
@@ -200,11 +286,13 @@ func (c *removeUserCmd) Main() {
 
 type checkUserCmd struct {
 	userCmd
+	transitive bool
 }
 
 func newCheckUserCmd() *checkUserCmd {
 	cmd := &checkUserCmd{}
 	userFlags(cmd, &cmd.userCmd)
+	cmd.flags.BoolVar(&cmd.transitive, "transitive", false, "Include membership through nested groups")
 	return cmd
 }
 
@@ -214,6 +302,263 @@ func (c *checkUserCmd) Desc() string { return "Check user membership in affinity
 
 func (c *checkUserCmd) Main() {
 	c.userCmd.Main(c)
-	err := c.client.CheckUser(c.group, c.User)
+	err := c.client.CheckUser(c.group, c.User, c.transitive)
+	die(err)
+}
+
+type explainCmd struct {
+	userCmd
+	perm string
+}
+
+func newExplainCmd() *explainCmd {
+	cmd := &explainCmd{}
+	userFlags(cmd, &cmd.userCmd)
+	cmd.flags.StringVar(&cmd.perm, "perm", "check-member", "Group permission to explain")
+	return cmd
+}
+
+func (c *explainCmd) Name() string { return "explain" }
+
+func (c *explainCmd) Desc() string { return "Explain whether user has a permission on affinity group" }
+
+func (c *explainCmd) Main() {
+	c.userCmd.Main(c)
+	explanation, err := c.client.Explain(c.group, c.User, c.perm)
+	if err != nil {
+		die(err)
+	}
+	out, err := json.MarshalIndent(explanation, "", "\t")
+	if err != nil {
+		die(err)
+	}
+	os.Stdout.Write(out)
+}
+
+type whoamiCmd struct {
+	serverCmd
+}
+
+func newWhoamiCmd() *whoamiCmd {
+	cmd := &whoamiCmd{}
+	serverFlags(cmd, &cmd.serverCmd)
+	return cmd
+}
+
+func (c *whoamiCmd) Name() string { return "whoami" }
+
+func (c *whoamiCmd) Desc() string { return "Show the user authenticated to affinity server" }
+
+func (c *whoamiCmd) Main() {
+	c.serverCmd.Main(c)
+	user, err := c.client.Whoami()
+	if err != nil {
+		die(err)
+	}
+	fmt.Println(user.String())
+	die(nil)
+}
+
+type myGroupsCmd struct {
+	serverCmd
+	managed bool
+}
+
+func newMyGroupsCmd() *myGroupsCmd {
+	cmd := &myGroupsCmd{}
+	serverFlags(cmd, &cmd.serverCmd)
+	cmd.flags.BoolVar(&cmd.managed, "managed", false, "List groups owned or administered instead")
+	return cmd
+}
+
+func (c *myGroupsCmd) Name() string { return "my-groups" }
+
+func (c *myGroupsCmd) Desc() string { return "List affinity groups the user belongs to" }
+
+func (c *myGroupsCmd) Main() {
+	c.serverCmd.Main(c)
+	var groups []affinity.Principal
+	var err error
+	if c.managed {
+		groups, err = c.client.ManagedGroups()
+	} else {
+		var user affinity.Principal
+		user, err = c.client.Whoami()
+		if err == nil {
+			groups, err = c.client.GroupsOf(user)
+		}
+	}
+	if err != nil {
+		die(err)
+	}
+	for _, g := range groups {
+		fmt.Println(g.String())
+	}
+	die(nil)
+}
+
+type roleCmd struct {
+	serverCmd
+	group string
+	user  string
+	role  string
+	User  affinity.Principal
+}
+
+func roleFlags(h cmdHandler, cmd *roleCmd) {
+	serverFlags(h, &cmd.serverCmd)
+	var roles []string
+	for name := range affinity_group.GroupRoles {
+		roles = append(roles, name)
+	}
+	sort.Strings(roles)
+	cmd.flags.StringVar(&cmd.group, "group", "", "Affinity group (default: the service)")
+	cmd.flags.StringVar(&cmd.user, "user", "", "Affinity user or group")
+	cmd.flags.StringVar(&cmd.role, "role", "", "Role: "+strings.Join(roles, ", "))
+}
+
+func (c *roleCmd) Main(h cmdHandler) {
+	c.serverCmd.Main(h)
+	if c.user == "" {
+		Usage(h, "--user is required")
+	}
+	if c.role == "" {
+		Usage(h, "--role is required")
+	}
+	if _, err := affinity_group.GroupRole(c.role); err != nil {
+		Usage(h, err.Error())
+	}
+	var err error
+	c.User, err = affinity.ParsePrincipal(c.user)
+	if err != nil {
+		die(err)
+	}
+}
+
+type grantCmd struct {
+	roleCmd
+}
+
+func newGrantCmd() *grantCmd {
+	cmd := &grantCmd{}
+	roleFlags(cmd, &cmd.roleCmd)
+	return cmd
+}
+
+func (c *grantCmd) Name() string { return "grant" }
+
+func (c *grantCmd) Desc() string { return "Grant role to user on affinity group or service" }
+
+func (c *grantCmd) Main() {
+	c.roleCmd.Main(c)
+	err := c.client.Grant(c.group, c.User, c.role)
+	die(err)
+}
+
+type revokeCmd struct {
+	roleCmd
+}
+
+func newRevokeCmd() *revokeCmd {
+	cmd := &revokeCmd{}
+	roleFlags(cmd, &cmd.roleCmd)
+	return cmd
+}
+
+func (c *revokeCmd) Name() string { return "revoke" }
+
+func (c *revokeCmd) Desc() string { return "Revoke role from user on affinity group or service" }
+
+func (c *revokeCmd) Main() {
+	c.roleCmd.Main(c)
+	err := c.client.Revoke(c.group, c.User, c.role)
+	die(err)
+}
+
+type mintTokenCmd struct {
+	serverCmd
+	name  string
+	scope string
+	ttl   time.Duration
+}
+
+func newMintTokenCmd() *mintTokenCmd {
+	cmd := &mintTokenCmd{}
+	serverFlags(cmd, &cmd.serverCmd)
+	cmd.flags.StringVar(&cmd.name, "name", "", "Token name")
+	cmd.flags.StringVar(&cmd.scope, "scope", "", "Comma-separated permissions to limit the token to (default: unlimited)")
+	cmd.flags.DurationVar(&cmd.ttl, "ttl", 30*24*time.Hour, "Token lifetime, or 0 to never expire")
+	return cmd
+}
+
+func (c *mintTokenCmd) Name() string { return "mint-token" }
+
+func (c *mintTokenCmd) Desc() string { return "Mint an API token for the user" }
+
+func (c *mintTokenCmd) Main() {
+	c.serverCmd.Main(c)
+	var scope []string
+	if c.scope != "" {
+		scope = strings.Split(c.scope, ",")
+	}
+	minted, err := c.client.MintToken(c.name, scope, c.ttl)
+	if err != nil {
+		die(err)
+	}
+	fmt.Println("id:", minted.Id)
+	fmt.Println("Authorization:", minted.Authorization)
+	die(nil)
+}
+
+type listTokensCmd struct {
+	serverCmd
+}
+
+func newListTokensCmd() *listTokensCmd {
+	cmd := &listTokensCmd{}
+	serverFlags(cmd, &cmd.serverCmd)
+	return cmd
+}
+
+func (c *listTokensCmd) Name() string { return "list-tokens" }
+
+func (c *listTokensCmd) Desc() string { return "List API tokens minted for the user" }
+
+func (c *listTokensCmd) Main() {
+	c.serverCmd.Main(c)
+	tokens, err := c.client.ListTokens()
+	if err != nil {
+		die(err)
+	}
+	out, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		die(err)
+	}
+	os.Stdout.Write(out)
+	die(nil)
+}
+
+type revokeTokenCmd struct {
+	serverCmd
+	id string
+}
+
+func newRevokeTokenCmd() *revokeTokenCmd {
+	cmd := &revokeTokenCmd{}
+	serverFlags(cmd, &cmd.serverCmd)
+	cmd.flags.StringVar(&cmd.id, "id", "", "Token id")
+	return cmd
+}
+
+func (c *revokeTokenCmd) Name() string { return "revoke-token" }
+
+func (c *revokeTokenCmd) Desc() string { return "Revoke an API token minted for the user" }
+
+func (c *revokeTokenCmd) Main() {
+	c.serverCmd.Main(c)
+	if c.id == "" {
+		Usage(c, "--id is required")
+	}
+	err := c.client.RevokeToken(c.id)
 	die(err)
 }
@@ -0,0 +1,201 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+	"launchpad.net/gnuflag"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/providers/local"
+	"github.com/juju/affinity/rbac/storage/file"
+	"github.com/juju/affinity/rbac/storage/mem"
+)
+
+// localUserCmd administers the local users of a server, directly in the
+// server's user store.
+type localUserCmd struct {
+	subCmd
+	store    string
+	htpasswd string
+	user     string
+	save     func() error
+}
+
+func (c *localUserCmd) localFlags(name string) {
+	c.flags = gnuflag.NewFlagSet(name, gnuflag.ExitOnError)
+	c.flags.StringVar(&c.store, "store", "mongodb://localhost:27017/affinity",
+		"Fact store URL holding local users, if --htpasswd is not given. "+
+			"Users in file:// and mem:// stores can only be changed while the server is stopped")
+	c.flags.StringVar(&c.htpasswd, "htpasswd", "", "htpasswd file holding local users")
+	c.flags.StringVar(&c.user, "user", "", "Local user name")
+}
+
+func (c *localUserCmd) scheme(h cmdHandler) *local.Scheme {
+	if c.user == "" {
+		Usage(h, "--user is required")
+	}
+	users, save, err := openUsers(c.htpasswd, c.store)
+	if err != nil {
+		die(err)
+	}
+	c.save = save
+	return local.NewScheme(users)
+}
+
+// exit saves the local users if they were changed without error, and exits.
+func (c *localUserCmd) exit(err error) {
+	if err == nil {
+		err = c.save()
+	}
+	die(err)
+}
+
+// openUsers opens the local user store: the htpasswd file if given,
+// otherwise the fact store. The returned function saves changes made to the
+// users, and must be called before exiting.
+func openUsers(htpasswd, storeURL string) (local.Users, func() error, error) {
+	saved := func() error { return nil }
+	if htpasswd != "" {
+		return local.NewFileUsers(htpasswd), saved, nil
+	}
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Opaque != "" {
+		return nil, nil, fmt.Errorf("invalid fact store %q: path must be absolute, as in %s:///path", storeURL, u.Scheme)
+	}
+	switch u.Scheme {
+	case "mem":
+		// A running server saves its own memory store over any changes made
+		// here.
+		if u.Path == "" {
+			return nil, nil, fmt.Errorf(
+				"local users in %q would be lost on exit: use a mem:///path snapshot or --htpasswd", storeURL)
+		}
+		store := mem.NewStore()
+		err = store.Restore(u.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		return local.NewFactUsers(store), func() error { return store.Snapshot(u.Path) }, nil
+	case "file":
+		if u.Path == "" {
+			return nil, nil, fmt.Errorf("missing file store path in %q", storeURL)
+		}
+		store, err := file.OpenFactStore(u.Path)
+		if err == bolt.ErrTimeout {
+			return nil, nil, fmt.Errorf(
+				"file store %q is in use: stop the server to change its local users, or use --htpasswd", u.Path)
+		} else if err != nil {
+			return nil, nil, err
+		}
+		return local.NewFactUsers(store), saved, nil
+	}
+	store, err := openStore(storeURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return local.NewFactUsers(store), saved, nil
+}
+
+// readNewPassword prompts for a new password twice, to guard against typos.
+func readNewPassword() (string, error) {
+	prompter := &affinity.PasswordPrompter{}
+	password, err := prompter.Password()
+	if err != nil {
+		return "", err
+	}
+	confirm, err := prompter.Password()
+	if err != nil {
+		return "", err
+	}
+	if password != confirm {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return password, nil
+}
+
+type addLocalUserCmd struct {
+	localUserCmd
+}
+
+func newAddLocalUserCmd() *addLocalUserCmd {
+	cmd := &addLocalUserCmd{}
+	cmd.localFlags(cmd.Name())
+	return cmd
+}
+
+func (c *addLocalUserCmd) Name() string { return "add-local-user" }
+
+func (c *addLocalUserCmd) Desc() string { return "Add a local user with a password" }
+
+func (c *addLocalUserCmd) Main() {
+	scheme := c.scheme(c)
+	password, err := readNewPassword()
+	if err != nil {
+		die(err)
+	}
+	c.exit(scheme.AddUser(c.user, password))
+}
+
+type resetPasswordCmd struct {
+	localUserCmd
+}
+
+func newResetPasswordCmd() *resetPasswordCmd {
+	cmd := &resetPasswordCmd{}
+	cmd.localFlags(cmd.Name())
+	return cmd
+}
+
+func (c *resetPasswordCmd) Name() string { return "reset-password" }
+
+func (c *resetPasswordCmd) Desc() string { return "Reset the password of a local user" }
+
+func (c *resetPasswordCmd) Main() {
+	scheme := c.scheme(c)
+	password, err := readNewPassword()
+	if err != nil {
+		die(err)
+	}
+	c.exit(scheme.ResetPassword(c.user, password))
+}
+
+type removeLocalUserCmd struct {
+	localUserCmd
+}
+
+func newRemoveLocalUserCmd() *removeLocalUserCmd {
+	cmd := &removeLocalUserCmd{}
+	cmd.localFlags(cmd.Name())
+	return cmd
+}
+
+func (c *removeLocalUserCmd) Name() string { return "remove-local-user" }
+
+func (c *removeLocalUserCmd) Desc() string { return "Remove a local user" }
+
+func (c *removeLocalUserCmd) Main() {
+	c.exit(c.scheme(c).RemoveUser(c.user))
+}
@@ -27,6 +27,8 @@ import (
 
 	"github.com/juju/affinity"
 	"github.com/juju/affinity/client"
+	"github.com/juju/affinity/client/group"
+	"github.com/juju/affinity/providers/local"
 	"github.com/juju/affinity/providers/usso"
 )
 
@@ -69,6 +71,8 @@ func (c *loginCmd) Main() {
 	}
 	schemes.Register(usso.NewOauthCli(fmt.Sprintf("affinity@%s", serverUrl.Host),
 		&affinity.PasswordPrompter{}))
+	schemes.Register(local.NewCli(&affinity.PasswordPrompter{},
+		&localMinter{group.NewGroupClient(serverUrl, nil)}))
 
 	user, err := affinity.ParsePrincipal(c.user)
 	if err != nil {
@@ -95,3 +99,17 @@ func (c *loginCmd) Main() {
 		die(err)
 	}
 }
+
+// localMinter exchanges a local user's password for an API token minted by
+// the server.
+type localMinter struct {
+	client *group.GroupClient
+}
+
+func (m *localMinter) MintToken(username, password string) (*affinity.TokenInfo, error) {
+	minted, err := m.client.MintTokenBasic(username, password, "login", 0)
+	if err != nil {
+		return nil, err
+	}
+	return affinity.ParseTokenInfo(minted.Authorization)
+}
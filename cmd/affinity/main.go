@@ -62,9 +62,21 @@ var cmds []cmdHandler = []cmdHandler{
 	newAddGroupCmd(),
 	newRemoveGroupCmd(),
 	newShowGroupCmd(),
+	newListMembersCmd(),
 	newAddUserCmd(),
 	newRemoveUserCmd(),
 	newCheckUserCmd(),
+	newExplainCmd(),
+	newGrantCmd(),
+	newRevokeCmd(),
+	newMintTokenCmd(),
+	newListTokensCmd(),
+	newRevokeTokenCmd(),
+	newWhoamiCmd(),
+	newMyGroupsCmd(),
+	newAddLocalUserCmd(),
+	newResetPasswordCmd(),
+	newRemoveLocalUserCmd(),
 }
 
 func main() {
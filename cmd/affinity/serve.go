@@ -18,17 +18,31 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"labix.org/v2/mgo"
 	"launchpad.net/gnuflag"
 
 	"github.com/juju/affinity"
 	"github.com/juju/affinity/group"
+	"github.com/juju/affinity/providers/apitoken"
+	"github.com/juju/affinity/providers/cert"
+	"github.com/juju/affinity/providers/local"
 	"github.com/juju/affinity/providers/usso"
 	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/rbac/storage/file"
+	"github.com/juju/affinity/rbac/storage/mem"
 	"github.com/juju/affinity/rbac/storage/mongo"
 	server_group "github.com/juju/affinity/server/group"
 )
@@ -37,10 +51,18 @@ type serveCmd struct {
 	subCmd
 	addr            string
 	extName         string
-	mongo           string
-	dbname          string
+	store           string
+	htpasswd        string
+	tlsCert         string
+	tlsKey          string
+	clientCA        string
+	certRules       string
 	serviceAdminCsv string
 
+	// Deprecated by store.
+	mongo  string
+	dbname string
+
 	serviceAdmins []string
 }
 
@@ -49,8 +71,18 @@ func newServeCmd() *serveCmd {
 	cmd.flags = gnuflag.NewFlagSet(cmd.Name(), gnuflag.ExitOnError)
 	cmd.flags.StringVar(&cmd.addr, "http", ":8080", "Listen address")
 	cmd.flags.StringVar(&cmd.extName, "name", "", "External server hostname")
-	cmd.flags.StringVar(&cmd.mongo, "mongo", "localhost:27017", "MongoDB URL")
-	cmd.flags.StringVar(&cmd.dbname, "database", "affinity", "Mongo database name")
+	cmd.flags.StringVar(&cmd.store, "store", "mongodb://localhost:27017/affinity",
+		"Fact store URL: mongodb://host[:port]/database, file:///path or mem:[///snapshot-path]")
+	cmd.flags.StringVar(&cmd.mongo, "mongo", "", "Deprecated, use --store mongodb://host[:port]/database")
+	cmd.flags.StringVar(&cmd.dbname, "database", "", "Deprecated, use --store mongodb://host[:port]/database")
+	cmd.flags.StringVar(&cmd.htpasswd, "htpasswd", "",
+		"htpasswd file of local users (default: local users in the fact store)")
+	cmd.flags.StringVar(&cmd.tlsCert, "tls-cert", "", "TLS certificate file, to serve HTTPS")
+	cmd.flags.StringVar(&cmd.tlsKey, "tls-key", "", "TLS private key file, to serve HTTPS")
+	cmd.flags.StringVar(&cmd.clientCA, "client-ca", "",
+		"PEM file of CA certificates trusted to issue client certificates, to authenticate by TLS client certificate")
+	cmd.flags.StringVar(&cmd.certRules, "cert-rules", "x509:CN",
+		"Client certificate mapping rules, as scheme:FIELD (CN, DNS, EMAIL or URI) or a URI prefix such as spiffe://example.org/")
 	cmd.flags.StringVar(&cmd.serviceAdminCsv, "service-admins", "",
 		"Users granted service management role")
 	return cmd
@@ -70,16 +102,27 @@ func (c *serveCmd) Main() {
 		c.serviceAdmins[i] = strings.TrimSpace(c.serviceAdmins[i])
 	}
 
-	session, err := mgo.Dial(c.mongo)
-	if err != nil {
-		die(err)
+	if c.mongo != "" || c.dbname != "" {
+		storeSet := false
+		c.flags.Visit(func(f *gnuflag.Flag) {
+			if f.Name == "store" {
+				storeSet = true
+			}
+		})
+		if storeSet {
+			Usage(c, "--store cannot be combined with the deprecated --mongo and --database")
+		}
+		c.store = mongoStoreURL(c.mongo, c.dbname)
+		log.Printf("Warning: --mongo and --database are deprecated, use --store %s", c.store)
 	}
-	store, err := mongo.NewFactStore(session, session.DB(c.dbname), "rbac")
+
+	store, err := openStore(c.store)
 	if err != nil {
 		die(err)
 	}
 
 	s := server_group.NewGroupServer(store)
+	s.Realm = c.extName
 
 	// Grant service role to configured admins
 	for _, serviceAdmin := range c.serviceAdmins {
@@ -95,6 +138,149 @@ func (c *serveCmd) Main() {
 	}
 
 	s.Schemes.Register(usso.NewOauthCli(c.extName, &affinity.PasswordUnavailable{}))
-	err = http.ListenAndServe(c.addr, s)
+	s.Schemes.Register(apitoken.NewScheme(store))
+	if c.htpasswd != "" {
+		s.Schemes.Register(local.NewScheme(local.NewFileUsers(c.htpasswd)))
+	} else {
+		s.Schemes.Register(local.NewScheme(local.NewFactUsers(store)))
+	}
+	if c.tlsCert == "" && c.tlsKey == "" {
+		if c.clientCA != "" {
+			Usage(c, "--client-ca requires --tls-cert and --tls-key")
+		}
+		err = http.ListenAndServe(c.addr, s)
+		die(err)
+	}
+	if c.tlsCert == "" || c.tlsKey == "" {
+		Usage(c, "--tls-cert and --tls-key are both required to serve HTTPS")
+	}
+
+	httpServer := &http.Server{Addr: c.addr, Handler: s, TLSConfig: &tls.Config{}}
+	if c.clientCA != "" {
+		rules, err := cert.ParseRules(c.certRules)
+		if err != nil {
+			die(err)
+		}
+		pool, err := loadCertPool(c.clientCA)
+		if err != nil {
+			die(err)
+		}
+		httpServer.TLSConfig.ClientCAs = pool
+		httpServer.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		s.Schemes.Register(cert.NewScheme(rules...))
+	}
+	err = httpServer.ListenAndServeTLS(c.tlsCert, c.tlsKey)
 	die(err)
 }
+
+// loadCertPool loads the PEM-encoded certificates in a file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pemCerts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+// mongoStoreURL returns the fact store URL equivalent to the deprecated
+// --mongo and --database flags, which default to "localhost:27017" and
+// "affinity".
+func mongoStoreURL(mongoAddr, dbname string) string {
+	if mongoAddr == "" {
+		mongoAddr = "localhost:27017"
+	}
+	if dbname == "" {
+		dbname = "affinity"
+	}
+	mongoAddr = strings.TrimPrefix(mongoAddr, "mongodb://")
+	if i := strings.Index(mongoAddr, "/"); i != -1 {
+		mongoAddr = mongoAddr[:i]
+	}
+	return fmt.Sprintf("mongodb://%s/%s", mongoAddr, dbname)
+}
+
+// openStore opens the fact store given by a URL. The scheme selects the
+// backend:
+//
+//	mongodb://host[:port]/database  MongoDB, database defaults to "affinity"
+//	file:///path                    Embedded key-value file at path
+//	mem:                            Memory only, lost on exit
+//	mem:///path                     Memory, restored from and snapshot to path
+//
+// Paths must be absolute. A memory store with a path is saved there whenever
+// it has changed, every snapshotInterval, and when the server exits.
+func openStore(storeURL string) (rbac.FactStore, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Opaque != "" {
+		return nil, fmt.Errorf("invalid fact store %q: path must be absolute, as in %s:///path", storeURL, u.Scheme)
+	}
+	switch u.Scheme {
+	case "mongodb":
+		session, err := mgo.Dial(storeURL)
+		if err != nil {
+			return nil, err
+		}
+		dbname := strings.TrimPrefix(u.Path, "/")
+		if dbname == "" {
+			dbname = "affinity"
+		}
+		return mongo.NewFactStore(session, session.DB(dbname), "rbac")
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing file store path in %q", storeURL)
+		}
+		return file.OpenFactStore(u.Path)
+	case "mem":
+		store := mem.NewStore()
+		if u.Path == "" {
+			return store, nil
+		}
+		err = store.Restore(u.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		snapshotPeriodically(store, u.Path)
+		return store, nil
+	}
+	return nil, fmt.Errorf("unsupported fact store %q", storeURL)
+}
+
+// snapshotInterval is how often a memory store is saved, if it has changed.
+const snapshotInterval = 10 * time.Second
+
+// snapshotPeriodically saves the memory store to a file whenever it has
+// changed, every snapshotInterval, so that a crash loses at most the latest
+// changes. The store is also saved when the server is interrupted or
+// terminated.
+func snapshotPeriodically(store *mem.Store, path string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+		saved := store.Changes()
+		for {
+			select {
+			case <-sigs:
+				die(store.Snapshot(path))
+			case <-ticker.C:
+				changes := store.Changes()
+				if changes == saved {
+					continue
+				}
+				if err := store.Snapshot(path); err != nil {
+					log.Println("Warning: failed to snapshot fact store:", err)
+					continue
+				}
+				saved = changes
+			}
+		}
+	}()
+}
@@ -52,6 +52,16 @@ These functions are intended to be adaptable to OAuth, OpenID, SASL and other to
 
 Schemes are registered to unique namespaces. This namespace comprises the "SchemeName" component of a canonical User string representation.
 
+Affinity can also issue its own API tokens, for bots and service accounts which cannot sign in interactively. An authenticated user mints a token which authenticates as that user, optionally limited to a scope of permissions and an expiry. Only a hash of each token's secret is stored, so tokens are validated locally, and can be revoked at any time.
+
+For stateless authentication between services, the signed token scheme issues self-contained tokens carrying the user, an expiry and optional caveats, signed with an HMAC or Ed25519 key. These are validated offline by any service holding a verification key, without a storage lookup. Several verification keys may be active at once, so that signing keys can be rotated.
+
+Deployments which cannot reach an external identity provider can define local users, whose bcrypt password hashes are kept in an htpasswd file or the fact store. Local users log in with a password, or send HTTP Basic credentials with each request.
+
+Services holding TLS client certificates, such as those issued by a service mesh, can authenticate with their certificate instead of logging in. The server maps a verified certificate to a user by configurable rules, such as its subject common name or a SPIFFE ID.
+
+Web applications can sign users in with any OpenID Connect identity provider, such as Google, Keycloak or Dex. The OIDC provider uses the authorization code flow with PKCE, discovers the identity provider's configuration, and validates ID tokens against its published keys. Claims in the ID token, such as a verified email address, map to users by configurable rules.
+
 Group
 
 A group is a collection of Users or sub-Groups with a unique name. Groups should be defined by a common association, rather than by capability you want the members to have with a resource.
@@ -72,13 +82,15 @@ Roles are a higher-level definition of capabilities. Essentially a Role is a bun
 
 For example, someone in a Pilot role should have permissions like 'board', 'enter-cabin', 'move-cockpit-controls' on an "airplane" resource. A Passenger role should be able to 'board', but not 'enter-cabin' or 'move-cockpit-controls'.
 
+Roles can be composed from other roles. A composite role inherits all the permissions of its parent roles, transitively, in addition to its own. For example, a Captain role might inherit from the Pilot role, adding 'address-passengers'. Inheritance cycles are detected when a role map is built.
+
 Resource
 
 A resource is the object to which access is granted. In Affinity, a Resource is declared by a URI, which will have meaning to the application implementating RBAC.
 
 Resources also declare the full set of permissions they support. That way, you can't make absurd role grants that don't make sense for the resource object of the grant.
 
-Resources do not currently support the concept of hierarchy in Affinity -- they are all flat, and in essence just canonical names to be matched in an access control query.
+Resources may be contained by a parent resource. A role granted on a resource also applies to all the resources it contains. NewResource declares a flat resource without a parent. NewPathResource declares a resource contained by each parent path of its URI, so that a role granted on "project:/acme" applies to "project:/acme/web/prod".
 
 Store
 
@@ -88,13 +100,17 @@ Access
 
 Use Access to connect to storage and check access permissions for a given user/group on a resource.
 
+Each access check queries storage for the groups containing the user and for the grants on the resource and its containers. CachedAccess keeps the group closures and decisions of recent checks for a bounded time, so that repeated checks do not go back to storage. Its caches are cleared when grants, denials or memberships are changed through its Store or Admin, and Stats reports how often they are hit.
+
 Admin
 
 Admin extends Access with the capability to grant and revoke user or group roles on resources. Role grants in Affinity are "positive" and additive in nature. Granting a role will cause a permission lookup for the user/group on a resource to match if any granted role contains that permission.
 
 Revoking a role will remove this relationship, so that the lookup no longer matches and access is denied.
 
-It is important to note that when it comes to role grants on groups, there is no way to revoke a role's transitive permissions from a group member. All members of the group will receive the role permission, or none of them will.
+Grants may also be made temporary with GrantUntil. An expired grant no longer matches in a lookup, and can be purged from storage with Sweep.
+
+Revoking a role grant on a group applies to all members of the group. To withhold a role from a single member of a group, Admin can also Deny a principal a role on a resource. Denials are "negative" grants which take precedence over any grant of the role, direct or through a group, on the resource and everything it contains. A permission lookup will not match if any role denied to the user/group on the resource provides that permission.
 
 */
 package affinity
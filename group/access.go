@@ -18,7 +18,7 @@
 package group
 
 import (
-	"fmt"
+	"sort"
 
 	"github.com/juju/affinity"
 	"github.com/juju/affinity/rbac"
@@ -28,59 +28,260 @@ import (
 type GroupService struct {
 	*rbac.Admin
 	AsUser affinity.Principal
-	facts  *rbac.GroupFacts
+	// Scope limits the current user to the permissions named, if not nil.
+	// The user's credentials may be limited to a scope, such as an API token.
+	Scope []string
+	// MaxMemberDepth limits how many levels of nested groups are followed
+	// when checking transitive membership. Zero is unlimited.
+	MaxMemberDepth int
+	store          rbac.FactStore
+	facts          *rbac.GroupFacts
 }
 
 // NewGroupService creates a new group service using the given storage, with access
 // to operations as the given user.
 func NewGroupService(store rbac.FactStore, asUser affinity.Principal) *GroupService {
+	admin := rbac.NewAdmin(store, GroupRoles)
+	admin.ResolveResource = resolveResource
 	return &GroupService{
-		Admin:  rbac.NewAdmin(store, GroupRoles),
+		Admin:  admin,
 		AsUser: asUser,
+		store:  store,
 		facts:  rbac.NewGroupFacts(store),
 	}
 }
 
-// canGroup tests if a user or group has a specific permission on a group.
+// batch calls a function with a group service which defers all changes made to
+// storage, and then applies them all-or-nothing.
+func (s *GroupService) batch(f func(*GroupService) error) error {
+	return rbac.Batch(s.store, func(store rbac.FactStore) error {
+		return f(NewGroupService(store, s.AsUser))
+	})
+}
+
+// checkGroup tests that a group exists.
+func (s *GroupService) checkGroup(group affinity.Principal) error {
+	isGroup, err := s.facts.IsGroup(group.String())
+	if err != nil {
+		return err
+	}
+	if !isGroup {
+		return &NotFoundError{Group: group}
+	}
+	return nil
+}
+
+// inScope tests if a permission may be exercised by the current user.
+func (s *GroupService) inScope(principal affinity.Principal, perm rbac.Permission) bool {
+	if s.Scope == nil || !principal.Equals(s.AsUser) {
+		return true
+	}
+	for _, name := range s.Scope {
+		if name == perm.Perm() {
+			return true
+		}
+	}
+	return false
+}
+
+// canGroup tests if a user or group has a specific permission on an existing group.
 func (s *GroupService) canGroup(principal affinity.Principal, perm rbac.Permission, group affinity.Principal) error {
 	groupRc, err := newGroupResource(group)
 	if err != nil {
 		return err
 	}
-	if ok, err := s.Can(principal, perm, groupRc); !ok {
-		return fmt.Errorf("%q has no permission to %q on group %q", principal.String(),
-			perm.Perm(), group.String())
-	} else {
+	if err = s.checkGroup(group); err != nil {
+		return err
+	}
+	ok, err := s.Can(principal, perm, groupRc)
+	if err != nil {
 		return err
 	}
+	if !ok || !s.inScope(principal, perm) {
+		return &PermissionError{User: principal, Perm: perm.Perm(), Group: &group}
+	}
+	return nil
 }
 
 // canService tests if a user or group has a specific permission on this service.
 func (s *GroupService) canService(principal affinity.Principal, perm rbac.Permission) error {
-	if ok, err := s.Can(principal, perm, serviceResource{}); !ok {
-		return fmt.Errorf("%q has no permission to %q on service", principal.String(), perm.Perm())
-	} else {
+	ok, err := s.Can(principal, perm, serviceResource{})
+	if err != nil {
 		return err
 	}
+	if !ok || !s.inScope(principal, perm) {
+		return &PermissionError{User: principal, Perm: perm.Perm()}
+	}
+	return nil
+}
+
+// CanManageTokens tests if the current user's credentials may be used to
+// list, mint and revoke the user's API tokens.
+func (s *GroupService) CanManageTokens() error {
+	if !s.inScope(s.AsUser, ManageTokensPerm{}) {
+		return &PermissionError{User: s.AsUser, Perm: ManageTokensPerm{}.Perm()}
+	}
+	return nil
 }
 
-// CheckMember tests if a principal is immediately or transitively a member of a group.
-func (s *GroupService) CheckMember(group affinity.Principal, member affinity.Principal) (bool, error) {
+// CheckMember tests if a principal is a member of a group. If transitive, the
+// principal may also be a member through any of the groups nested within the
+// group, to at most MaxMemberDepth levels. Otherwise only immediate membership
+// is considered.
+func (s *GroupService) CheckMember(group affinity.Principal, member affinity.Principal, transitive bool) (bool, error) {
 	var err error
 	if err = s.canGroup(s.AsUser, CheckMemberPerm{}, group); err != nil {
 		return false, err
 	}
-	principal := member.String()
-	groups, err := s.facts.Groups(principal)
+	maxDepth := 1
+	if transitive {
+		maxDepth = s.MaxMemberDepth
+	}
+	return s.facts.IsMember(group.String(), member.String(), maxDepth)
+}
+
+// Members returns the members of a group, ordered by their string form. If
+// recursive, the members of groups nested within the group are listed in place
+// of the nested groups themselves. The current user must be allowed to check
+// membership on the group.
+func (s *GroupService) Members(group affinity.Principal, recursive bool) ([]affinity.Principal, error) {
+	var err error
+	if err = s.canGroup(s.AsUser, CheckMemberPerm{}, group); err != nil {
+		return nil, err
+	}
+	members := make(map[string]bool)
+	visited := map[string]bool{group.String(): true}
+	pending := []string{group.String()}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		subjects, err := s.facts.Members(current)
+		if err != nil {
+			return nil, err
+		}
+		for _, subject := range subjects {
+			if recursive {
+				isGroup, err := s.facts.IsGroup(subject)
+				if err != nil {
+					return nil, err
+				}
+				if isGroup {
+					if !visited[subject] {
+						visited[subject] = true
+						pending = append(pending, subject)
+					}
+					continue
+				}
+			}
+			members[subject] = true
+		}
+	}
+
+	var result []affinity.Principal
+	for member := range members {
+		principal, err := affinity.ParsePrincipal(member)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, principal)
+	}
+	sortPrincipals(result)
+	return result, nil
+}
+
+// GroupsOf returns the groups which a principal is a member of, immediately or
+// through nested groups, ordered by their string form. The current user may
+// list its own groups. The groups of any other principal are only listed where
+// the current user is allowed to check membership.
+func (s *GroupService) GroupsOf(principal affinity.Principal) ([]affinity.Principal, error) {
+	var result []affinity.Principal
+	visited := map[string]bool{principal.String(): true}
+	pending := []string{principal.String()}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		groups, err := s.facts.Groups(current)
+		if err != nil {
+			return nil, err
+		}
+		for _, groupId := range groups {
+			if visited[groupId] {
+				continue
+			}
+			visited[groupId] = true
+			pending = append(pending, groupId)
+
+			group, err := affinity.ParsePrincipal(groupId)
+			if err != nil {
+				return nil, err
+			}
+			if !principal.Equals(s.AsUser) {
+				if ok, err := s.Can(s.AsUser, CheckMemberPerm{}, groupResource(groupId)); err != nil {
+					return nil, err
+				} else if !ok || !s.inScope(s.AsUser, CheckMemberPerm{}) {
+					continue
+				}
+			}
+			result = append(result, group)
+		}
+	}
+	sortPrincipals(result)
+	return result, nil
+}
+
+// ManagedGroups returns the groups on which the current user holds the Owner
+// or Admin role, directly or through the groups containing it, ordered by
+// their string form.
+func (s *GroupService) ManagedGroups() ([]affinity.Principal, error) {
+	grants, err := s.Grants(s.AsUser)
 	if err != nil {
-		return false, nil
+		return nil, err
 	}
-	for _, groupId := range groups {
-		if group.String() == groupId {
-			return true, nil
+	var result []affinity.Principal
+	seen := make(map[string]bool)
+	for _, grant := range grants {
+		if grant.Role.Role() != OwnerRole.Role() && grant.Role.Role() != AdminRole.Role() {
+			continue
 		}
+		group, err := affinity.ParsePrincipal(grant.Resource)
+		if err != nil || group.Scheme != SchemeName || seen[grant.Resource] {
+			continue
+		}
+		seen[grant.Resource] = true
+		result = append(result, group)
+	}
+	sortPrincipals(result)
+	return result, nil
+}
+
+// sortPrincipals orders principals by their string form.
+func sortPrincipals(principals []affinity.Principal) {
+	sort.Sort(principalSlice(principals))
+}
+
+type principalSlice []affinity.Principal
+
+func (p principalSlice) Len() int           { return len(p) }
+func (p principalSlice) Less(i, j int) bool { return p[i].String() < p[j].String() }
+func (p principalSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Explain returns the derivation of whether a principal has a permission on a group.
+// The current user may explain its own permissions, or those of any principal on a
+// group where it is allowed to check membership.
+func (s *GroupService) Explain(principal affinity.Principal, perm rbac.Permission, group affinity.Principal) (*rbac.Explanation, error) {
+	groupRc, err := newGroupResource(group)
+	if err != nil {
+		return nil, err
+	}
+	if !principal.Equals(s.AsUser) {
+		err = s.canGroup(s.AsUser, CheckMemberPerm{}, group)
+	} else {
+		err = s.checkGroup(group)
 	}
-	return false, err
+	if err != nil {
+		return nil, err
+	}
+	return s.Access.Explain(principal, perm, groupRc)
 }
 
 // AddGroup defines a new group. The current user is granted the Owner role over the group.
@@ -90,15 +291,21 @@ func (s *GroupService) AddGroup(group affinity.Principal) error {
 	if err = s.canService(s.AsUser, AddGroupPerm{}); err != nil {
 		return err
 	}
-	err = s.facts.AddGroup(group.String())
+	groupRc, err := newGroupResource(group)
 	if err != nil {
 		return err
 	}
-	groupRc, err := newGroupResource(group)
-	if err != nil {
+	if isGroup, err := s.facts.IsGroup(group.String()); err != nil {
 		return err
+	} else if isGroup {
+		return &ConflictError{Group: group}
 	}
-	return s.Grant(s.AsUser, OwnerRole, groupRc)
+	return s.batch(func(b *GroupService) error {
+		if err := b.facts.AddGroup(group.String()); err != nil {
+			return err
+		}
+		return b.Grant(b.AsUser, OwnerRole, groupRc)
+	})
 }
 
 // RemoveGroup removes an existing group. The current user must own the group.
@@ -110,16 +317,18 @@ func (s *GroupService) RemoveGroup(group affinity.Principal) error {
 	if err = s.canGroup(s.AsUser, RemoveGroupPerm{}, group); err != nil {
 		return err
 	}
-	// Remove all role grants on the group as a resource
-	if err = s.RemoveAll(groupRc); err != nil {
-		return err
-	}
-	// Remove the group
-	err = s.facts.RemoveGroup(group.String())
-	if err != nil {
-		return err
-	}
-	return nil
+	return s.batch(func(b *GroupService) error {
+		// Remove all role grants on the group as a resource
+		if err := b.RemoveAll(groupRc); err != nil {
+			return err
+		}
+		// Remove all role grants to the group
+		if err := b.RevokeAll(group); err != nil {
+			return err
+		}
+		// Remove the group
+		return b.facts.RemoveGroup(group.String())
+	})
 }
 
 // AddMember adds a new member to an existing group.
@@ -128,7 +337,12 @@ func (s *GroupService) AddMember(group, member affinity.Principal) error {
 	if err = s.canGroup(s.AsUser, AddMemberPerm{}, group); err != nil {
 		return err
 	}
-	// Add the group membership. Should error if duplicate.
+	if isMember, err := s.facts.IsMember(group.String(), member.String(), 1); err != nil {
+		return err
+	} else if isMember {
+		return &ConflictError{Group: group, Member: &member}
+	}
+	// Add the group membership.
 	err = s.facts.AddMember(group.String(), member.String())
 	if err != nil {
 		return err
@@ -142,7 +356,12 @@ func (s *GroupService) RemoveMember(group, member affinity.Principal) error {
 	if err = s.canGroup(s.AsUser, RemoveMemberPerm{}, group); err != nil {
 		return err
 	}
-	// Remove the group membership if exists.
+	if isMember, err := s.facts.IsMember(group.String(), member.String(), 1); err != nil {
+		return err
+	} else if !isMember {
+		return &NotFoundError{Group: group, Member: &member}
+	}
+	// Remove the group membership.
 	err = s.facts.RemoveMember(group.String(), member.String())
 	if err != nil {
 		return err
@@ -176,6 +395,50 @@ func (s *GroupService) RevokeOnGroup(principal affinity.Principal, role rbac.Rol
 	return s.Revoke(principal, role, groupRc)
 }
 
+// RolesOnGroup returns the roles granted on a group, ordered by role and
+// principal. The current user must be allowed to check membership on the group.
+func (s *GroupService) RolesOnGroup(group affinity.Principal) ([]RoleGrant, error) {
+	groupRc, err := newGroupResource(group)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.canGroup(s.AsUser, CheckMemberPerm{}, group); err != nil {
+		return nil, err
+	}
+	return s.rolesOn(groupRc)
+}
+
+// RolesOnService returns the roles granted on this service, ordered by role
+// and principal. The current user must be allowed to grant roles on this
+// service.
+func (s *GroupService) RolesOnService() ([]RoleGrant, error) {
+	var err error
+	if err = s.canService(s.AsUser, GrantOnServicePerm{}); err != nil {
+		return nil, err
+	}
+	return s.rolesOn(serviceResource{})
+}
+
+func (s *GroupService) rolesOn(r rbac.Resource) ([]RoleGrant, error) {
+	grants, err := s.GrantsOn(r)
+	if err != nil {
+		return nil, err
+	}
+	var result []RoleGrant
+	for _, grant := range grants {
+		principal, err := affinity.ParsePrincipal(grant.Subject)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, RoleGrant{
+			Principal: principal,
+			Role:      grant.Role.Role(),
+			Expires:   grant.Expires,
+		})
+	}
+	return result, nil
+}
+
 func (s *GroupService) GrantOnService(principal affinity.Principal, role rbac.Role) error {
 	var err error
 	if err = s.canService(s.AsUser, GrantOnServicePerm{}); err != nil {
@@ -0,0 +1,92 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package group
+
+import (
+	"fmt"
+
+	"github.com/juju/affinity"
+)
+
+// PermissionError is returned when a user lacks permission for an operation
+// on a group or the service.
+type PermissionError struct {
+	User affinity.Principal
+	Perm string
+	// Group is the group operated on, or nil for an operation on the service.
+	Group *affinity.Principal
+}
+
+func (e *PermissionError) Error() string {
+	if e.Group == nil {
+		return fmt.Sprintf("%q has no permission to %q on service", e.User.String(), e.Perm)
+	}
+	return fmt.Sprintf("%q has no permission to %q on group %q", e.User.String(),
+		e.Perm, e.Group.String())
+}
+
+func (e *PermissionError) ErrorCode() affinity.ErrorCode { return affinity.CodeForbidden }
+
+// NotFoundError is returned when a group, or a member of a group, does not
+// exist.
+type NotFoundError struct {
+	Group affinity.Principal
+	// Member is the missing member of the group, or nil if the group itself
+	// does not exist.
+	Member *affinity.Principal
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Member == nil {
+		return fmt.Sprintf("group %q not found", e.Group.String())
+	}
+	return fmt.Sprintf("%q is not a member of group %q", e.Member.String(), e.Group.String())
+}
+
+func (e *NotFoundError) ErrorCode() affinity.ErrorCode { return affinity.CodeNotFound }
+
+// ConflictError is returned when a group, or a member of a group, already
+// exists.
+type ConflictError struct {
+	Group affinity.Principal
+	// Member is the existing member of the group, or nil if the group itself
+	// already exists.
+	Member *affinity.Principal
+}
+
+func (e *ConflictError) Error() string {
+	if e.Member == nil {
+		return fmt.Sprintf("group %q already exists", e.Group.String())
+	}
+	return fmt.Sprintf("%q is already a member of group %q", e.Member.String(), e.Group.String())
+}
+
+func (e *ConflictError) ErrorCode() affinity.ErrorCode { return affinity.CodeConflict }
+
+// InvalidPrincipalError is returned when a principal cannot be used where it
+// was given, such as a group of an unsupported scheme.
+type InvalidPrincipalError struct {
+	Principal string
+	Reason    string
+}
+
+func (e *InvalidPrincipalError) Error() string {
+	return fmt.Sprintf("invalid principal %q: %s", e.Principal, e.Reason)
+}
+
+func (e *InvalidPrincipalError) ErrorCode() affinity.ErrorCode { return affinity.CodeInvalidPrincipal }
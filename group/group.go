@@ -19,6 +19,7 @@ package group
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/juju/affinity"
 	"github.com/juju/affinity/rbac"
@@ -78,66 +79,71 @@ type RevokeOnServicePerm struct{}
 
 func (p RevokeOnServicePerm) Perm() string { return "revoke-on-service" }
 
-var creatorCapabilities rbac.PermissionMap = rbac.NewPermissionMap(
-	AddGroupPerm{},
-)
-
-var ownerCapabilities rbac.PermissionMap = rbac.NewPermissionMap(
+var groupCapabilities rbac.PermissionMap = rbac.NewPermissionMap(
 	GrantOnGroupPerm{}, RevokeOnGroupPerm{},
 	RemoveGroupPerm{},
 	AddMemberPerm{}, RemoveMemberPerm{},
 	CheckMemberPerm{},
 )
 
-var adminCapabilities rbac.PermissionMap = rbac.NewPermissionMap(
-	AddMemberPerm{}, RemoveMemberPerm{},
-	CheckMemberPerm{},
-)
+// ManageTokensPerm allows credentials to list, mint and revoke the API tokens
+// of their user. Users may always manage their own tokens, but credentials
+// limited to a scope must include this permission.
+type ManageTokensPerm struct{}
 
-var observerCapabilities rbac.PermissionMap = rbac.NewPermissionMap(
-	CheckMemberPerm{},
-)
+func (p ManageTokensPerm) Perm() string { return "manage-tokens" }
+
+// GroupPermission returns the permission on groups with the given name.
+func GroupPermission(name string) (rbac.Permission, error) {
+	perm, ok := groupCapabilities[name]
+	if !ok {
+		return nil, &affinity.Error{Code: affinity.CodeBadRequest,
+			Message: fmt.Sprintf("unknown group permission: %q", name)}
+	}
+	return perm, nil
+}
 
 var serviceCapabilities rbac.PermissionMap = rbac.NewPermissionMap(
 	GrantOnServicePerm{}, RevokeOnServicePerm{}, AddGroupPerm{},
 )
 
-type groupRole struct {
-	name         string
-	capabilities rbac.PermissionMap
-}
-
-func (gr *groupRole) Capabilities() rbac.PermissionMap {
-	return gr.capabilities
-}
-
-func (gr *groupRole) Role() string {
-	return gr.name
-}
-
-func (gr *groupRole) Can(do rbac.Permission) bool {
-	_, has := gr.capabilities[do.Perm()]
-	return has
+// Permission returns the permission on groups or on this service, or the
+// permission to manage API tokens, with the given name.
+func Permission(name string) (rbac.Permission, error) {
+	if perm, ok := groupCapabilities[name]; ok {
+		return perm, nil
+	}
+	if perm, ok := serviceCapabilities[name]; ok {
+		return perm, nil
+	}
+	if name == (ManageTokensPerm{}).Perm() {
+		return ManageTokensPerm{}, nil
+	}
+	return nil, &affinity.Error{Code: affinity.CodeBadRequest,
+		Message: fmt.Sprintf("unknown permission: %q", name)}
 }
 
 // ServiceRole is allowed to manage the service
-var ServiceRole *groupRole = &groupRole{"service", serviceCapabilities}
+var ServiceRole rbac.Role = rbac.NewRole("service",
+	GrantOnServicePerm{}, RevokeOnServicePerm{}, AddGroupPerm{})
 
 // CreatorRole is allowed to create groups
-var CreatorRole *groupRole = &groupRole{"creator", creatorCapabilities}
+var CreatorRole rbac.Role = rbac.NewRole("creator", AddGroupPerm{})
 
 // OwnerRole is allowed all group-level operations on a group
-var OwnerRole *groupRole = &groupRole{"owner", ownerCapabilities}
+var OwnerRole rbac.Role = rbac.NewCompositeRole("owner", []rbac.Role{AdminRole},
+	GrantOnGroupPerm{}, RevokeOnGroupPerm{}, RemoveGroupPerm{})
 
 // AdminRole is allowed to add, remove and check membership.
-var AdminRole *groupRole = &groupRole{"admin", adminCapabilities}
+var AdminRole rbac.Role = rbac.NewCompositeRole("admin", []rbac.Role{ObserverRole},
+	AddMemberPerm{}, RemoveMemberPerm{})
 
 // ObserverRole is allow to check membership of a group.
-var ObserverRole *groupRole = &groupRole{"observer", observerCapabilities}
+var ObserverRole rbac.Role = rbac.NewRole("observer", CheckMemberPerm{})
 
 type groupResource string
 
-func (_ groupResource) Capabilities() rbac.PermissionMap { return ownerCapabilities }
+func (_ groupResource) Capabilities() rbac.PermissionMap { return groupCapabilities }
 
 func (gr groupResource) URI() string { return string(gr) }
 
@@ -145,11 +151,24 @@ func (gr groupResource) Parent() rbac.Resource { return ServiceResource }
 
 func newGroupResource(group affinity.Principal) (groupResource, error) {
 	if group.Scheme != SchemeName {
-		return "", fmt.Errorf("group scheme not supported: %q", group.Scheme)
+		return "", &InvalidPrincipalError{Principal: group.String(),
+			Reason: fmt.Sprintf("group scheme not supported: %q", group.Scheme)}
 	}
 	return groupResource(group.String()), nil
 }
 
+// resolveResource returns the service or group resource identified by a URI,
+// or nil if the URI identifies neither.
+func resolveResource(uri string) rbac.Resource {
+	if uri == AffinityGroupsUri {
+		return ServiceResource
+	}
+	if group, err := affinity.ParsePrincipal(uri); err == nil && group.Scheme == SchemeName {
+		return groupResource(uri)
+	}
+	return nil
+}
+
 type serviceResource struct{}
 
 func (_ serviceResource) Capabilities() rbac.PermissionMap {
@@ -163,3 +182,33 @@ func (_ serviceResource) Parent() rbac.Resource { return nil }
 var ServiceResource rbac.Resource = serviceResource{}
 
 var GroupRoles rbac.RoleMap = rbac.NewRoleMap(ServiceRole, CreatorRole, OwnerRole, AdminRole, ObserverRole)
+
+// GroupRole returns the role in GroupRoles with the given name.
+func GroupRole(name string) (rbac.Role, error) {
+	role, ok := GroupRoles[name]
+	if !ok {
+		return nil, &affinity.Error{Code: affinity.CodeBadRequest,
+			Message: fmt.Sprintf("unknown role: %q", name)}
+	}
+	return role, nil
+}
+
+// RoleGrant is a role granted to a principal on a group or the service.
+type RoleGrant struct {
+	Principal affinity.Principal
+	Role      string
+	// Expires is the time at which the grant expires, or the zero value if
+	// the grant is permanent.
+	Expires time.Time
+}
+
+// MemberList is a page of the members of a group.
+type MemberList struct {
+	Group   affinity.Principal
+	Members []affinity.Principal
+	// Offset is the position of the first member on this page among all
+	// the members of the group.
+	Offset int
+	// Total is the number of members on all pages.
+	Total int
+}
@@ -0,0 +1,229 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package middleware authorizes the requests to HTTP handlers with
+// role-based access controls. Handlers wrapped by an Authorizer only see
+// requests from principals which have been authenticated, and which have
+// been granted the permission the handler requires on the resource the
+// request is for.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/server"
+)
+
+// Checker checks the permissions of principals on resources, such as
+// *rbac.Access or *rbac.CachedAccess.
+type Checker interface {
+	Can(pr affinity.Principal, pm rbac.Permission, r rbac.Resource) (bool, error)
+}
+
+// Authorizer wraps HTTP handlers to authenticate and authorize their
+// requests.
+type Authorizer struct {
+	// Schemes authenticate requests.
+	Schemes *affinity.SchemeMap
+	// Access checks the permissions of authenticated principals.
+	Access Checker
+	// Realm is the protection space given in authentication challenges. If
+	// empty, the host of the request is used.
+	Realm string
+	// Policy determines how requests must be authenticated. Requests
+	// which require a permission are never allowed to be anonymous.
+	Policy server.Policy
+	// Authenticators are tried in order to authenticate a request, until
+	// one succeeds.
+	Authenticators []server.Authenticator
+}
+
+// NewAuthorizer creates a new Authorizer, which authenticates requests by
+// any of the given schemes and checks permissions with access.
+func NewAuthorizer(schemes *affinity.SchemeMap, access Checker) *Authorizer {
+	return &Authorizer{
+		Schemes:        schemes,
+		Access:         access,
+		Policy:         server.Required,
+		Authenticators: server.DefaultAuthenticators(),
+	}
+}
+
+func (a *Authorizer) authServer() *server.AuthServer {
+	return &server.AuthServer{
+		Schemes:        a.Schemes,
+		Realm:          a.Realm,
+		Authenticators: a.Authenticators,
+	}
+}
+
+// Authenticate wraps a handler so that its requests are authenticated
+// according to the authorizer's policy. Requests which fail to authenticate
+// are challenged to do so. The handler obtains the principal with
+// PrincipalOf.
+func (a *Authorizer) Authenticate(h http.Handler) http.Handler {
+	return a.authServer().Protect(a.Policy, h.ServeHTTP)
+}
+
+// Require wraps a handler so that its requests must be made by a principal
+// with a permission on the resource they are for. Requests which are not
+// authenticated are challenged to do so, and requests which lack the
+// permission are forbidden. The permission must also be within the scope of
+// the request's credentials, if they are limited.
+func (a *Authorizer) Require(perm rbac.Permission, resource ResourceFunc, h http.Handler) http.Handler {
+	auth := a.authServer()
+	policy := a.Policy
+	policy.Optional = false
+	return auth.Protect(policy, func(w http.ResponseWriter, r *http.Request) {
+		result, _ := server.AuthResultOf(r)
+		if result.Anonymous() {
+			// Authenticated as anonymous by an earlier, optional policy.
+			auth.Unauthorized(r, affinity.ErrUnauthorized).Send(w)
+			return
+		}
+		rc, err := resource(r)
+		if err != nil {
+			(&server.Response{Error: err}).Send(w)
+			return
+		}
+		ok, err := a.Access.Can(result.Principal, perm, rc)
+		if err != nil {
+			(&server.Response{Error: err, StatusCode: http.StatusInternalServerError}).Send(w)
+			return
+		}
+		if !ok || !inScope(result.Scope, perm) {
+			(&server.Response{Error: &affinity.Error{
+				Code: affinity.CodeForbidden,
+				Message: fmt.Sprintf("%s does not have permission %q on %q",
+					result.Principal.String(), perm.Perm(), rc.URI()),
+			}}).Send(w)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// inScope tests if a permission is among those to which credentials are
+// limited, if they are limited.
+func inScope(scope []string, perm rbac.Permission) bool {
+	if scope == nil {
+		return true
+	}
+	for _, name := range scope {
+		if name == perm.Perm() {
+			return true
+		}
+	}
+	return false
+}
+
+// PrincipalOf returns the principal who made a request, if the request has
+// been authenticated and was not anonymous.
+func PrincipalOf(r *http.Request) (affinity.Principal, bool) {
+	return PrincipalFromContext(r.Context())
+}
+
+// PrincipalFromContext returns the principal carried by a request context,
+// if the request has been authenticated and was not anonymous.
+func PrincipalFromContext(ctx context.Context) (affinity.Principal, bool) {
+	result, ok := server.AuthResultFromContext(ctx)
+	if !ok || result.Anonymous() {
+		return affinity.Principal{}, false
+	}
+	return result.Principal, true
+}
+
+// WithPrincipal returns a copy of a context which carries a principal, as
+// if it had authenticated the request. It is useful for calling wrapped
+// handlers directly, such as in tests.
+func WithPrincipal(ctx context.Context, principal affinity.Principal) context.Context {
+	return server.WithAuthResult(ctx, &server.AuthResult{Principal: principal})
+}
+
+// ResourceFunc determines the resource a request is for. An error classified
+// by an affinity.ErrorCode is responded to accordingly.
+type ResourceFunc func(r *http.Request) (rbac.Resource, error)
+
+// Static is the same resource for every request.
+func Static(resource rbac.Resource) ResourceFunc {
+	return func(r *http.Request) (rbac.Resource, error) {
+		return resource, nil
+	}
+}
+
+// Route is a resource whose URI is a template, expanded with the variables
+// of the request's matched route. For example, "project:{name}" is the
+// resource "project:acme" for a route "/projects/{name}" matching
+// "/projects/acme".
+func Route(template string, capabilities ...rbac.Permission) ResourceFunc {
+	return func(r *http.Request) (rbac.Resource, error) {
+		uri, err := expand(template, mux.Vars(r))
+		if err != nil {
+			return nil, err
+		}
+		return rbac.NewResource(uri, capabilities...), nil
+	}
+}
+
+// RoutePath is a resource whose URI is a template expanded like Route, and
+// which is contained by the resources identified by each parent path of its
+// URI, as with rbac.NewPathResource.
+func RoutePath(template string, capabilities ...rbac.Permission) ResourceFunc {
+	return func(r *http.Request) (rbac.Resource, error) {
+		uri, err := expand(template, mux.Vars(r))
+		if err != nil {
+			return nil, err
+		}
+		return rbac.NewPathResource(uri, capabilities...), nil
+	}
+}
+
+// expand replaces each "{name}" in a template with the variable of that name.
+func expand(template string, vars map[string]string) (string, error) {
+	var result []string
+	for {
+		start := strings.Index(template, "{")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(template[start:], "}")
+		if end == -1 {
+			return "", &affinity.Error{
+				Code:    affinity.CodeInternal,
+				Message: fmt.Sprintf("unterminated variable in resource template %q", template),
+			}
+		}
+		name := template[start+1 : start+end]
+		value, ok := vars[name]
+		if !ok {
+			return "", &affinity.Error{
+				Code:    affinity.CodeInternal,
+				Message: fmt.Sprintf("route variable %q not found", name),
+			}
+		}
+		result = append(result, template[:start], value)
+		template = template[start+end+1:]
+	}
+	return strings.Join(append(result, template), ""), nil
+}
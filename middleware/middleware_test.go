@@ -0,0 +1,230 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package middleware_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	. "launchpad.net/gocheck"
+
+	. "github.com/juju/affinity"
+	"github.com/juju/affinity/middleware"
+	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/rbac/storage/mem"
+	"github.com/juju/affinity/server"
+)
+
+func TestMiddlewareSuite(t *testing.T) { TestingT(t) }
+
+type MiddlewareSuite struct {
+	*httptest.Server
+	admin *rbac.Admin
+}
+
+var _ = Suite(&MiddlewareSuite{})
+
+// MockScheme authenticates tokens which carry the hex-encoded principal.
+type MockScheme struct{}
+
+func (s *MockScheme) Name() string { return "mock" }
+
+func (s *MockScheme) Authenticate(r *http.Request) (user Principal, err error) {
+	return AuthRequestToken(s, r)
+}
+
+func (s *MockScheme) Authorize(user Principal) (token *TokenInfo, err error) {
+	token = NewTokenInfo(s.Name())
+	token.Values.Set("data", hex.EncodeToString([]byte(user.String())))
+	return token, nil
+}
+
+func (s *MockScheme) Validate(token *TokenInfo) (user Principal, err error) {
+	data, err := hex.DecodeString(token.Values.Get("data"))
+	if err != nil {
+		return user, err
+	}
+	return ParsePrincipal(string(data))
+}
+
+var (
+	readPerm  = rbac.NewPermission("read")
+	writePerm = rbac.NewPermission("write")
+
+	readerRole = rbac.NewRole("reader", readPerm)
+	writerRole = rbac.NewRole("writer", readPerm, writePerm)
+
+	projectRoles = rbac.NewRoleMap(readerRole, writerRole)
+)
+
+func (s *MiddlewareSuite) SetUpTest(c *C) {
+	store := mem.NewFactStore()
+	s.admin = rbac.NewAdmin(store, projectRoles)
+	schemes := NewSchemeMap()
+	schemes.Register(&MockScheme{})
+	authz := middleware.NewAuthorizer(schemes, s.admin.Access)
+
+	whoami := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := middleware.PrincipalOf(r)
+		if !ok {
+			fmt.Fprint(w, "anonymous")
+			return
+		}
+		fmt.Fprint(w, user.String())
+	})
+	optional := middleware.NewAuthorizer(schemes, s.admin.Access)
+	optional.Policy = server.Optional
+
+	r := mux.NewRouter()
+	r.Handle("/whoami", optional.Authenticate(whoami))
+	r.Handle("/projects/{name}", authz.Require(readPerm,
+		middleware.Route("project:{name}", readPerm, writePerm), whoami)).Methods("GET")
+	r.Handle("/projects/{name}", authz.Require(writePerm,
+		middleware.Route("project:{name}", readPerm, writePerm), whoami)).Methods("PUT")
+	r.Handle("/files/{path:.*}", authz.Require(readPerm,
+		middleware.RoutePath("file:/{path}", readPerm), whoami))
+	r.Handle("/service", authz.Require(readPerm,
+		middleware.Static(rbac.NewResource("service:", readPerm)), whoami))
+	r.Handle("/anonymous", optional.Authenticate(authz.Require(readPerm,
+		middleware.Static(rbac.NewResource("service:", readPerm)), whoami)))
+	r.Handle("/broken", authz.Require(readPerm,
+		middleware.Route("project:{missing}", readPerm), whoami))
+	s.Server = httptest.NewServer(r)
+}
+
+func (s *MiddlewareSuite) TearDownTest(c *C) {
+	s.Server.Close()
+}
+
+func (s *MiddlewareSuite) do(c *C, method, path, user string) (int, string, http.Header) {
+	req, err := http.NewRequest(method, s.Server.URL+path, nil)
+	c.Assert(err, IsNil)
+	if user != "" {
+		token, err := (&MockScheme{}).Authorize(MustParsePrincipal(user))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", token.Serialize())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp.StatusCode, string(body), resp.Header
+}
+
+func (s *MiddlewareSuite) TestAuthenticate(c *C) {
+	status, body, _ := s.do(c, "GET", "/whoami", "")
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(body, Equals, "anonymous")
+
+	status, body, _ = s.do(c, "GET", "/whoami", "test:alice")
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(body, Equals, "test:alice")
+}
+
+func (s *MiddlewareSuite) TestRequire(c *C) {
+	alice := MustParsePrincipal("test:alice")
+	err := s.admin.Grant(alice, readerRole, rbac.NewResource("project:web", readPerm, writePerm))
+	c.Assert(err, IsNil)
+
+	status, _, header := s.do(c, "GET", "/projects/web", "")
+	c.Check(status, Equals, http.StatusUnauthorized)
+	c.Check(header.Get("WWW-Authenticate"), Matches, `mock realm=".*"`)
+
+	status, body, _ := s.do(c, "GET", "/projects/web", "test:alice")
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(body, Equals, "test:alice")
+
+	for _, t := range []struct {
+		method, path, user string
+	}{
+		{"PUT", "/projects/web", "test:alice"},
+		{"GET", "/projects/db", "test:alice"},
+		{"GET", "/projects/web", "test:bob"},
+	} {
+		status, body, _ = s.do(c, t.method, t.path, t.user)
+		c.Check(status, Equals, http.StatusForbidden, Commentf("%s %s as %s", t.method, t.path, t.user))
+		c.Check(body, Matches, `.*"forbidden".*`)
+	}
+
+	err = s.admin.Grant(alice, writerRole, rbac.NewResource("project:web", readPerm, writePerm))
+	c.Assert(err, IsNil)
+	status, _, _ = s.do(c, "PUT", "/projects/web", "test:alice")
+	c.Check(status, Equals, http.StatusOK)
+}
+
+func (s *MiddlewareSuite) TestRequirePath(c *C) {
+	bob := MustParsePrincipal("test:bob")
+	err := s.admin.Grant(bob, readerRole, rbac.NewPathResource("file:/home/bob", readPerm))
+	c.Assert(err, IsNil)
+
+	status, _, _ := s.do(c, "GET", "/files/home/bob/notes", "test:bob")
+	c.Check(status, Equals, http.StatusOK)
+	status, _, _ = s.do(c, "GET", "/files/home/alice/notes", "test:bob")
+	c.Check(status, Equals, http.StatusForbidden)
+}
+
+func (s *MiddlewareSuite) TestRequireStatic(c *C) {
+	carol := MustParsePrincipal("test:carol")
+	err := s.admin.Grant(carol, readerRole, rbac.NewResource("service:", readPerm))
+	c.Assert(err, IsNil)
+
+	status, _, _ := s.do(c, "GET", "/service", "test:carol")
+	c.Check(status, Equals, http.StatusOK)
+	status, _, _ = s.do(c, "GET", "/service", "test:dave")
+	c.Check(status, Equals, http.StatusForbidden)
+}
+
+func (s *MiddlewareSuite) TestRequireAfterOptional(c *C) {
+	carol := MustParsePrincipal("test:carol")
+	err := s.admin.Grant(carol, readerRole, rbac.NewResource("service:", readPerm))
+	c.Assert(err, IsNil)
+
+	status, _, header := s.do(c, "GET", "/anonymous", "")
+	c.Check(status, Equals, http.StatusUnauthorized)
+	c.Check(header.Get("WWW-Authenticate"), Not(Equals), "")
+	status, _, _ = s.do(c, "GET", "/anonymous", "test:carol")
+	c.Check(status, Equals, http.StatusOK)
+}
+
+func (s *MiddlewareSuite) TestRouteMissingVariable(c *C) {
+	status, body, _ := s.do(c, "GET", "/broken", "test:alice")
+	c.Check(status, Equals, http.StatusInternalServerError)
+	c.Check(body, Matches, `.*route variable \\"missing\\" not found.*`)
+}
+
+func (s *MiddlewareSuite) TestWithPrincipal(c *C) {
+	alice := MustParsePrincipal("test:alice")
+	req, err := http.NewRequest("GET", "/", nil)
+	c.Assert(err, IsNil)
+	_, ok := middleware.PrincipalOf(req)
+	c.Check(ok, Equals, false)
+
+	req = req.WithContext(middleware.WithPrincipal(req.Context(), alice))
+	user, ok := middleware.PrincipalOf(req)
+	c.Check(ok, Equals, true)
+	c.Check(user, Equals, alice)
+	user, ok = middleware.PrincipalFromContext(req.Context())
+	c.Check(ok, Equals, true)
+	c.Check(user, Equals, alice)
+}
@@ -0,0 +1,365 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package apitoken provides API tokens issued by affinity itself. An
+// authenticated user can mint tokens which authenticate as that user, limited
+// to a scope of permissions and optionally expiring. Only a hash of each token
+// secret is stored, so tokens are validated locally without recovering the
+// secret.
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/rbac"
+)
+
+const (
+	// SchemeName is the name of the API token scheme.
+	SchemeName = "apitoken"
+
+	tokenTopic = "affinity:apitoken"
+
+	ownerPredicate = "owner"
+	hashPredicate  = "hash"
+	namePredicate  = "name"
+	scopePredicate = "scope"
+
+	// sweepInterval is how often expired tokens are removed from the store.
+	sweepInterval = time.Hour
+)
+
+// Token describes an API token. It does not include the token's secret.
+type Token struct {
+	Id    string
+	Name  string
+	Owner affinity.Principal
+	// Scope is the names of the permissions to which the token is limited.
+	// The token is not limited if Scope is empty.
+	Scope []string
+	// Expires is the time at which the token expires, or the zero value if
+	// the token does not expire.
+	Expires time.Time
+}
+
+// MintedToken is a newly minted token, along with the only copy of the
+// credential which authenticates with it.
+type MintedToken struct {
+	Token
+	// Authorization is the value of the HTTP Authorization header which
+	// authenticates with the token.
+	Authorization string
+}
+
+// Scheme authenticates requests bearing API tokens, and mints and revokes
+// them. Tokens are kept in a FactStore, from which expired tokens are removed
+// as new ones are minted.
+type Scheme struct {
+	facts *rbac.GroupFacts
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// NewScheme creates an API token scheme which keeps its tokens in the given
+// store.
+func NewScheme(store rbac.FactStore) *Scheme {
+	return &Scheme{facts: rbac.NewGroupFacts(store)}
+}
+
+func (s *Scheme) Name() string { return SchemeName }
+
+// randomHex returns n random bytes, hex-encoded.
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashSecret returns the hash stored for a token secret.
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// notFound returns the error for a token which does not exist, or is not
+// visible to the user.
+func notFound(id string) error {
+	return &affinity.Error{Code: affinity.CodeNotFound, Message: fmt.Sprintf("token %q not found", id)}
+}
+
+// subject returns the subject of the facts describing a token.
+func subject(id string) string {
+	return SchemeName + ":" + id
+}
+
+// Mint creates a new token for its owner, limited to the given scope of
+// permission names. If ttl is not zero, the token expires after that
+// duration. The returned TokenInfo is the only copy of the token's secret.
+func (s *Scheme) Mint(owner affinity.Principal, name string, scope []string, ttl time.Duration) (*Token, *affinity.TokenInfo, error) {
+	if ttl < 0 {
+		return nil, nil, &affinity.Error{Code: affinity.CodeBadRequest,
+			Message: fmt.Sprintf("invalid token lifetime: %v", ttl)}
+	}
+	var expires time.Time
+	if ttl != 0 {
+		expires = time.Now().Add(ttl)
+	}
+	return s.MintUntil(owner, name, scope, expires)
+}
+
+// MintUntil creates a new token for its owner, limited to the given scope of
+// permission names. If expires is not zero, the token expires at that time.
+// The returned TokenInfo is the only copy of the token's secret.
+func (s *Scheme) MintUntil(owner affinity.Principal, name string, scope []string, expires time.Time) (*Token, *affinity.TokenInfo, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = s.sweep(); err != nil {
+		return nil, nil, err
+	}
+	token := &Token{Id: id, Name: name, Owner: owner, Scope: scope, Expires: expires}
+
+	fact := func(predicate, object string) rbac.Change {
+		return rbac.Change{Fact: rbac.Fact{
+			Topic:     tokenTopic,
+			Subject:   subject(id),
+			Predicate: predicate,
+			Object:    object,
+			Expires:   token.Expires,
+		}}
+	}
+	changes := []rbac.Change{
+		fact(ownerPredicate, owner.String()),
+		fact(hashPredicate, hashSecret(secret)),
+	}
+	if name != "" {
+		changes = append(changes, fact(namePredicate, name))
+	}
+	for _, perm := range scope {
+		changes = append(changes, fact(scopePredicate, perm))
+	}
+	err = s.facts.Apply(changes...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, &affinity.TokenInfo{
+		Scheme: SchemeName,
+		Values: url.Values{
+			"id":     []string{id},
+			"secret": []string{secret},
+		},
+	}, nil
+}
+
+// sweep removes expired tokens from the store, if it has not done so for
+// sweepInterval.
+func (s *Scheme) sweep() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.swept) < sweepInterval {
+		return nil
+	}
+	if err := s.facts.Sweep(tokenTopic); err != nil {
+		return err
+	}
+	s.swept = now
+	return nil
+}
+
+// token reads an unexpired token, and the hash of its secret. A token missing
+// its owner or hash, such as one partly revoked, is not found.
+func (s *Scheme) token(id string) (*Token, string, error) {
+	facts, err := s.facts.Match(rbac.Fact{Topic: tokenTopic, Subject: subject(id)})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(facts) == 0 {
+		return nil, "", notFound(id)
+	}
+	token := &Token{Id: id}
+	var hash string
+	for _, fact := range facts {
+		switch fact.Predicate {
+		case ownerPredicate:
+			token.Owner, err = affinity.ParsePrincipal(fact.Object)
+			if err != nil {
+				return nil, "", err
+			}
+			token.Expires = fact.Expires
+		case hashPredicate:
+			hash = fact.Object
+		case namePredicate:
+			token.Name = fact.Object
+		case scopePredicate:
+			token.Scope = append(token.Scope, fact.Object)
+		}
+	}
+	if hash == "" || token.Owner.Scheme == "" {
+		return nil, "", notFound(id)
+	}
+	sort.Strings(token.Scope)
+	return token, hash, nil
+}
+
+// Tokens returns the unexpired tokens minted for an owner, ordered by id.
+func (s *Scheme) Tokens(owner affinity.Principal) ([]*Token, error) {
+	owned, err := s.facts.Match(rbac.Fact{
+		Topic:     tokenTopic,
+		Predicate: ownerPredicate,
+		Object:    owner.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, fact := range owned {
+		ids = append(ids, fact.Subject[len(SchemeName)+1:])
+	}
+	sort.Strings(ids)
+	var result []*Token
+	for _, id := range ids {
+		token, _, err := s.token(id)
+		if affinity.ErrorCodeOf(err) == affinity.CodeNotFound {
+			// Expired or revoked since it was listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result = append(result, token)
+	}
+	return result, nil
+}
+
+// Revoke removes a token minted for an owner, so that it no longer
+// authenticates.
+func (s *Scheme) Revoke(owner affinity.Principal, id string) error {
+	token, _, err := s.token(id)
+	if err != nil {
+		return err
+	}
+	if !token.Owner.Equals(owner) {
+		return notFound(id)
+	}
+	facts, err := s.facts.Match(rbac.Fact{Topic: tokenTopic, Subject: subject(id)})
+	if err != nil {
+		return err
+	}
+	return s.facts.Deny(facts...)
+}
+
+// validate checks the secret of a token, and returns the token if valid.
+func (s *Scheme) validate(tokenInfo *affinity.TokenInfo) (*Token, error) {
+	if tokenInfo.Scheme != s.Name() {
+		return nil, fmt.Errorf("not an API token: %q", tokenInfo.Scheme)
+	}
+	id, secret := tokenInfo.Values.Get("id"), tokenInfo.Values.Get("secret")
+	if id == "" || secret == "" {
+		return nil, fmt.Errorf("malformed API token")
+	}
+	token, hash, err := s.token(id)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(secret))) != 1 {
+		return nil, fmt.Errorf("invalid API token secret")
+	}
+	return token, nil
+}
+
+func (s *Scheme) Authenticate(r *http.Request) (affinity.Principal, error) {
+	return affinity.AuthRequestToken(s, r)
+}
+
+// Authorize cannot create tokens, because minting requires a name, scope and
+// lifetime. Use Mint instead.
+func (s *Scheme) Authorize(user affinity.Principal) (*affinity.TokenInfo, error) {
+	return nil, fmt.Errorf("API tokens must be minted")
+}
+
+// Validate checks an API token, and returns the owner it authenticates as.
+func (s *Scheme) Validate(tokenInfo *affinity.TokenInfo) (affinity.Principal, error) {
+	token, err := s.validate(tokenInfo)
+	if err != nil {
+		return affinity.Principal{}, err
+	}
+	return token.Owner, nil
+}
+
+// Describe checks an API token, and returns its owner, scope and expiration
+// from a single lookup.
+func (s *Scheme) Describe(tokenInfo *affinity.TokenInfo) (*affinity.Credentials, error) {
+	token, err := s.validate(tokenInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &affinity.Credentials{Principal: token.Owner, Scope: token.Scope, Expires: token.Expires}, nil
+}
+
+// Expires returns the expiration of the API token authenticating a request.
+func (s *Scheme) Expires(r *http.Request) (time.Time, error) {
+	for _, auth := range r.Header[http.CanonicalHeaderKey("Authorization")] {
+		tokenInfo, err := affinity.ParseTokenInfo(auth)
+		if err != nil || tokenInfo.Scheme != s.Name() {
+			continue
+		}
+		token, err := s.validate(tokenInfo)
+		if err != nil {
+			continue
+		}
+		return token.Expires, nil
+	}
+	return time.Time{}, affinity.ErrUnauthorized
+}
+
+// Scope returns the scope of the API token authenticating a request.
+func (s *Scheme) Scope(r *http.Request) ([]string, error) {
+	for _, auth := range r.Header[http.CanonicalHeaderKey("Authorization")] {
+		tokenInfo, err := affinity.ParseTokenInfo(auth)
+		if err != nil || tokenInfo.Scheme != s.Name() {
+			continue
+		}
+		token, err := s.validate(tokenInfo)
+		if err != nil {
+			continue
+		}
+		if len(token.Scope) == 0 {
+			return nil, nil
+		}
+		return token.Scope, nil
+	}
+	return nil, affinity.ErrUnauthorized
+}
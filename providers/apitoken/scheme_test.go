@@ -0,0 +1,162 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package apitoken_test
+
+import (
+	"net/http"
+	stdtesting "testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/providers/apitoken"
+	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/rbac/storage/mem"
+)
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+type TokenSuite struct {
+	store  rbac.FactStore
+	scheme *apitoken.Scheme
+	fry    affinity.Principal
+}
+
+var _ = Suite(&TokenSuite{})
+
+func (s *TokenSuite) SetUpTest(c *C) {
+	s.store = mem.NewFactStore()
+	s.scheme = apitoken.NewScheme(s.store)
+	s.fry = affinity.MustParsePrincipal("usso:fry@planetexpress.com")
+}
+
+func authRequest(c *C, tokenInfo *affinity.TokenInfo) *http.Request {
+	r, err := http.NewRequest("GET", "http://example.com/", nil)
+	c.Assert(err, IsNil)
+	r.Header.Set("Authorization", tokenInfo.Serialize())
+	return r
+}
+
+func (s *TokenSuite) TestMintAuthenticate(c *C) {
+	token, tokenInfo, err := s.scheme.Mint(s.fry, "ci", []string{"check-member", "add-member"}, time.Hour)
+	c.Assert(err, IsNil)
+	c.Check(token.Owner, Equals, s.fry)
+	c.Check(token.Expires.After(time.Now()), Equals, true)
+
+	r := authRequest(c, tokenInfo)
+	user, err := s.scheme.Authenticate(r)
+	c.Assert(err, IsNil)
+	c.Check(user, Equals, s.fry)
+	scope, err := s.scheme.Scope(r)
+	c.Assert(err, IsNil)
+	c.Check(scope, DeepEquals, []string{"add-member", "check-member"})
+
+	tokens, err := s.scheme.Tokens(s.fry)
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 1)
+	c.Check(tokens[0].Id, Equals, token.Id)
+	c.Check(tokens[0].Name, Equals, "ci")
+}
+
+func (s *TokenSuite) TestUnscoped(c *C) {
+	_, tokenInfo, err := s.scheme.Mint(s.fry, "", nil, 0)
+	c.Assert(err, IsNil)
+	scope, err := s.scheme.Scope(authRequest(c, tokenInfo))
+	c.Assert(err, IsNil)
+	c.Check(scope, IsNil)
+}
+
+func (s *TokenSuite) TestWrongSecret(c *C) {
+	_, tokenInfo, err := s.scheme.Mint(s.fry, "ci", nil, time.Hour)
+	c.Assert(err, IsNil)
+	tokenInfo.Values.Set("secret", "bender")
+	_, err = s.scheme.Authenticate(authRequest(c, tokenInfo))
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+	_, err = s.scheme.Validate(tokenInfo)
+	c.Check(err, ErrorMatches, "invalid API token secret")
+}
+
+func (s *TokenSuite) TestRevoke(c *C) {
+	token, tokenInfo, err := s.scheme.Mint(s.fry, "ci", nil, time.Hour)
+	c.Assert(err, IsNil)
+	err = s.scheme.Revoke(affinity.MustParsePrincipal("usso:bender@planetexpress.com"), token.Id)
+	c.Check(affinity.ErrorCodeOf(err), Equals, affinity.CodeNotFound)
+	c.Assert(s.scheme.Revoke(s.fry, token.Id), IsNil)
+	_, err = s.scheme.Authenticate(authRequest(c, tokenInfo))
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+	tokens, err := s.scheme.Tokens(s.fry)
+	c.Assert(err, IsNil)
+	c.Check(tokens, HasLen, 0)
+}
+
+func (s *TokenSuite) TestExpired(c *C) {
+	_, tokenInfo, err := s.scheme.Mint(s.fry, "ci", nil, time.Nanosecond)
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond)
+	_, err = s.scheme.Authenticate(authRequest(c, tokenInfo))
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+}
+
+func (s *TokenSuite) TestDescribe(c *C) {
+	token, tokenInfo, err := s.scheme.Mint(s.fry, "ci", []string{"check-member"}, time.Hour)
+	c.Assert(err, IsNil)
+	creds, err := s.scheme.Describe(tokenInfo)
+	c.Assert(err, IsNil)
+	c.Check(creds.Principal, Equals, s.fry)
+	c.Check(creds.Scope, DeepEquals, []string{"check-member"})
+	c.Check(creds.Expires.Equal(token.Expires), Equals, true)
+
+	tokenInfo.Values.Set("secret", "bender")
+	_, err = s.scheme.Describe(tokenInfo)
+	c.Check(err, ErrorMatches, "invalid API token secret")
+}
+
+func (s *TokenSuite) TestIncomplete(c *C) {
+	broken, tokenInfo, err := s.scheme.Mint(s.fry, "broken", nil, 0)
+	c.Assert(err, IsNil)
+	token, _, err := s.scheme.Mint(s.fry, "ci", nil, 0)
+	c.Assert(err, IsNil)
+	hashes, err := s.store.Match(rbac.Fact{Topic: "affinity:apitoken", Subject: "apitoken:" + broken.Id, Predicate: "hash"})
+	c.Assert(err, IsNil)
+	c.Assert(hashes, HasLen, 1)
+	c.Assert(s.store.Deny(hashes...), IsNil)
+
+	// A token missing some of its facts is not found, and does not prevent
+	// the others from being listed.
+	_, err = s.scheme.Validate(tokenInfo)
+	c.Check(affinity.ErrorCodeOf(err), Equals, affinity.CodeNotFound)
+	tokens, err := s.scheme.Tokens(s.fry)
+	c.Assert(err, IsNil)
+	c.Assert(tokens, HasLen, 1)
+	c.Check(tokens[0].Id, Equals, token.Id)
+}
+
+func (s *TokenSuite) TestSweep(c *C) {
+	expired, _, err := s.scheme.Mint(s.fry, "ci", []string{"check-member"}, time.Nanosecond)
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond)
+
+	// Expired tokens are removed from the store when the next is minted.
+	scheme := apitoken.NewScheme(s.store)
+	_, _, err = scheme.Mint(s.fry, "ci", nil, time.Hour)
+	c.Assert(err, IsNil)
+	facts, err := s.store.Match(rbac.Fact{Topic: "affinity:apitoken", Subject: "apitoken:" + expired.Id})
+	c.Assert(err, IsNil)
+	c.Check(facts, HasLen, 0)
+}
@@ -0,0 +1,185 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package cert provides an authentication scheme for TLS client certificates,
+// so that services holding certificates, such as those issued by a service
+// mesh, can authenticate without a user login.
+package cert
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/juju/affinity"
+)
+
+// SchemeName is the name of the client certificate scheme.
+const SchemeName = "x509"
+
+// Certificate fields which can identify a principal.
+const (
+	FieldCN    = "CN"
+	FieldDNS   = "DNS"
+	FieldEmail = "EMAIL"
+	FieldURI   = "URI"
+)
+
+// Rule maps a field of a client certificate to a principal.
+type Rule struct {
+	// Scheme is the scheme of the principal. If empty, the principal is
+	// parsed from the field value, as for URIs such as SPIFFE IDs.
+	Scheme string
+	// Field is the certificate field identifying the principal: the subject
+	// common name, or a DNS, email or URI subject alternative name.
+	Field string
+	// Prefix, if not empty, limits the rule to field values beginning with
+	// it, such as the SPIFFE IDs of a trust domain. Unless the prefix ends in
+	// "/", it must be followed by "/" or nothing, so that a prefix such as
+	// "spiffe://example.org" does not match "spiffe://example.org.evil/".
+	Prefix string
+}
+
+// ParseRule parses a certificate mapping rule. A rule is either of the
+// form "scheme:FIELD", mapping the CN, DNS, EMAIL or URI field of a
+// certificate to a principal of the given scheme, or a URI prefix such as
+// "spiffe://example.org/", mapping URI subject alternative names beginning
+// with the prefix to a principal named by the URI itself. For example,
+// "x509:CN" maps a certificate for CommonName "build-bot" to x509:build-bot,
+// and "spiffe://example.org/" maps a certificate for the SPIFFE ID
+// spiffe://example.org/ns/ci/sa/builder to that ID.
+func ParseRule(spec string) (Rule, error) {
+	if strings.Contains(spec, "://") {
+		return Rule{Field: FieldURI, Prefix: spec}, nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return Rule{}, fmt.Errorf("invalid certificate rule: %q", spec)
+	}
+	field := strings.ToUpper(parts[1])
+	switch field {
+	case FieldCN, FieldDNS, FieldEmail, FieldURI:
+	default:
+		return Rule{}, fmt.Errorf("invalid certificate rule %q: unknown field %q", spec, parts[1])
+	}
+	return Rule{Scheme: parts[0], Field: field}, nil
+}
+
+// ParseRules parses a comma-separated list of certificate mapping rules.
+func ParseRules(specs string) ([]Rule, error) {
+	var rules []Rule
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		rule, err := ParseRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// values returns the values of the rule's field in a certificate.
+func (r Rule) values(cert *x509.Certificate) []string {
+	switch r.Field {
+	case FieldCN:
+		if cert.Subject.CommonName != "" {
+			return []string{cert.Subject.CommonName}
+		}
+	case FieldDNS:
+		return cert.DNSNames
+	case FieldEmail:
+		return cert.EmailAddresses
+	case FieldURI:
+		var result []string
+		for _, u := range cert.URIs {
+			result = append(result, u.String())
+		}
+		return result
+	}
+	return nil
+}
+
+// hasPrefix tests if a field value begins with the rule's prefix, at a path
+// boundary.
+func (r Rule) hasPrefix(value string) bool {
+	if !strings.HasPrefix(value, r.Prefix) {
+		return false
+	}
+	if r.Prefix == "" || strings.HasSuffix(r.Prefix, "/") || len(value) == len(r.Prefix) {
+		return true
+	}
+	return value[len(r.Prefix)] == '/'
+}
+
+// Principal maps a certificate to a principal by the rule. It returns false
+// if the certificate has no matching field.
+func (r Rule) Principal(cert *x509.Certificate) (affinity.Principal, bool) {
+	for _, value := range r.values(cert) {
+		if !r.hasPrefix(value) {
+			continue
+		}
+		if r.Scheme != "" {
+			return affinity.Principal{Scheme: r.Scheme, Id: value}, true
+		}
+		principal, err := affinity.ParsePrincipal(value)
+		if err == nil {
+			return principal, true
+		}
+	}
+	return affinity.Principal{}, false
+}
+
+// Scheme authenticates requests by their verified TLS client certificate.
+// Certificates are verified by the TLS server, which must be configured to
+// request them and trust their issuers.
+type Scheme struct {
+	rules []Rule
+}
+
+// NewScheme creates a client certificate scheme which maps certificates to
+// principals by the first of the given rules to match. With no rules,
+// certificates are mapped by their subject common name, as x509:CN.
+func NewScheme(rules ...Rule) *Scheme {
+	if len(rules) == 0 {
+		rules = []Rule{{Scheme: SchemeName, Field: FieldCN}}
+	}
+	return &Scheme{rules: rules}
+}
+
+func (s *Scheme) Name() string { return SchemeName }
+
+func (s *Scheme) Authenticate(r *http.Request) (affinity.Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return affinity.Principal{}, affinity.ErrUnauthorized
+	}
+	return s.AuthenticateCertificate(r.TLS.VerifiedChains[0][0])
+}
+
+// AuthenticateCertificate maps a verified client certificate to a principal.
+func (s *Scheme) AuthenticateCertificate(cert *x509.Certificate) (affinity.Principal, error) {
+	for _, rule := range s.rules {
+		if principal, ok := rule.Principal(cert); ok {
+			return principal, nil
+		}
+	}
+	return affinity.Principal{}, affinity.ErrUnauthorized
+}
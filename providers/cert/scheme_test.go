@@ -0,0 +1,209 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	stdtesting "testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/providers/cert"
+	"github.com/juju/affinity/rbac/storage/mem"
+	"github.com/juju/affinity/server"
+)
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+type CertSuite struct {
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+}
+
+var _ = Suite(&CertSuite{})
+
+func (s *CertSuite) SetUpSuite(c *C) {
+	var err error
+	s.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "planet-express-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &s.caKey.PublicKey, s.caKey)
+	c.Assert(err, IsNil)
+	s.caCert, err = x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+}
+
+// issue creates a client certificate signed by the test CA.
+func (s *CertSuite) issue(c *C, template *x509.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.caCert, &key.PublicKey, s.caKey)
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func mustParseURL(c *C, s string) *url.URL {
+	u, err := url.Parse(s)
+	c.Assert(err, IsNil)
+	return u
+}
+
+func (s *CertSuite) TestParseRule(c *C) {
+	for _, test := range []struct {
+		spec string
+		rule cert.Rule
+		err  string
+	}{
+		{"x509:CN", cert.Rule{Scheme: "x509", Field: cert.FieldCN}, ""},
+		{"mesh:dns", cert.Rule{Scheme: "mesh", Field: cert.FieldDNS}, ""},
+		{"spiffe://example.org/", cert.Rule{Field: cert.FieldURI, Prefix: "spiffe://example.org/"}, ""},
+		{"x509:OU", cert.Rule{}, `invalid certificate rule "x509:OU": unknown field "OU"`},
+		{"CN", cert.Rule{}, `invalid certificate rule: "CN"`},
+	} {
+		rule, err := cert.ParseRule(test.spec)
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(rule, DeepEquals, test.rule)
+	}
+
+	rules, err := cert.ParseRules("spiffe://example.org/, x509:CN")
+	c.Assert(err, IsNil)
+	c.Check(rules, HasLen, 2)
+}
+
+func (s *CertSuite) TestAuthenticateCertificate(c *C) {
+	spiffeRule, err := cert.ParseRule("spiffe://planetexpress.com/")
+	c.Assert(err, IsNil)
+	scheme := cert.NewScheme(spiffeRule, cert.Rule{Scheme: "x509", Field: cert.FieldCN})
+
+	for _, test := range []struct {
+		template  *x509.Certificate
+		principal string
+	}{
+		{&x509.Certificate{
+			Subject: pkix.Name{CommonName: "delivery-bot"},
+			URIs:    []*url.URL{mustParseURL(c, "spiffe://planetexpress.com/ns/ship/sa/autopilot")},
+		}, "spiffe://planetexpress.com/ns/ship/sa/autopilot"},
+		// SPIFFE IDs of other trust domains are not mapped by the URI rule.
+		{&x509.Certificate{
+			Subject: pkix.Name{CommonName: "delivery-bot"},
+			URIs:    []*url.URL{mustParseURL(c, "spiffe://momcorp.com/ns/robots/sa/bender")},
+		}, "x509:delivery-bot"},
+		{&x509.Certificate{URIs: []*url.URL{mustParseURL(c, "spiffe://momcorp.com/ns/robots/sa/bender")}}, ""},
+		{&x509.Certificate{URIs: []*url.URL{mustParseURL(c, "spiffe://planetexpress.com.evil/ns/ship/sa/autopilot")}}, ""},
+	} {
+		clientCert := s.issue(c, test.template)
+		principal, err := scheme.AuthenticateCertificate(clientCert.Leaf)
+		if test.principal == "" {
+			c.Check(err, Equals, affinity.ErrUnauthorized)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(principal.String(), Equals, test.principal)
+	}
+
+	// A prefix not ending in "/" matches at a path boundary, and not the IDs
+	// of lookalike trust domains.
+	rule := cert.Rule{Field: cert.FieldURI, Prefix: "spiffe://planetexpress.com"}
+	for _, test := range []struct {
+		uri string
+		ok  bool
+	}{
+		{"spiffe://planetexpress.com/ns/ship/sa/autopilot", true},
+		{"spiffe://planetexpress.com", true},
+		{"spiffe://planetexpress.com.evil/ns/ship/sa/autopilot", false},
+		{"spiffe://planetexpress.community/ns/ship/sa/autopilot", false},
+	} {
+		_, ok := rule.Principal(&x509.Certificate{URIs: []*url.URL{mustParseURL(c, test.uri)}})
+		c.Check(ok, Equals, test.ok, Commentf("%s", test.uri))
+	}
+
+	// The default rule maps the common name.
+	principal, err := cert.NewScheme().AuthenticateCertificate(
+		s.issue(c, &x509.Certificate{Subject: pkix.Name{CommonName: "build-bot"}}).Leaf)
+	c.Assert(err, IsNil)
+	c.Check(principal, Equals, affinity.Principal{Scheme: cert.SchemeName, Id: "build-bot"})
+}
+
+func (s *CertSuite) TestServer(c *C) {
+	srv := server.NewAuthServer(mem.NewFactStore())
+	srv.Schemes.Register(cert.NewScheme())
+	srv.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		user, err := srv.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(user.String()))
+	})
+	ts := httptest.NewUnstartedServer(srv)
+	pool := x509.NewCertPool()
+	pool.AddCert(s.caCert)
+	ts.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(clientCerts ...tls.Certificate) (int, string) {
+		client := ts.Client()
+		transport := client.Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = clientCerts
+		client.Transport = transport
+		resp, err := client.Get(ts.URL + "/whoami")
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get(s.issue(c, &x509.Certificate{Subject: pkix.Name{CommonName: "build-bot"}}))
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(body, Equals, "x509:build-bot")
+
+	status, _ = get()
+	c.Check(status, Equals, http.StatusUnauthorized)
+}
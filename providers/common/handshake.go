@@ -0,0 +1,403 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common
+
+// This file contains the stores of handshake state, kept between redirecting
+// a user to an identity provider and handling the callback.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/kushaldas/openid.go/src/openid"
+
+	"github.com/juju/affinity/rbac"
+)
+
+const (
+	// HandshakeTTL is how long a user has to complete a handshake with an
+	// identity provider.
+	HandshakeTTL = 10 * time.Minute
+
+	// NonceMaxAge is the oldest OpenID response nonce accepted.
+	NonceMaxAge = time.Minute
+
+	// DiscoveryTTL is how long discovered OpenID endpoints are cached.
+	DiscoveryTTL = time.Hour
+
+	// DefaultMaxHandshakes is the default limit on the number of handshake
+	// states stored at once.
+	DefaultMaxHandshakes = 10000
+
+	// DefaultMaxDiscoveries is the default limit on the number of OpenID
+	// discoveries cached at once.
+	DefaultMaxDiscoveries = 1000
+
+	// SweepInterval is how often a handshake store removes expired state.
+	SweepInterval = time.Minute
+)
+
+// ErrHandshakeNotFound is returned when handshake state does not exist, or
+// has expired.
+var ErrHandshakeNotFound error = fmt.Errorf("handshake state not found")
+
+// ErrHandshakeStoreFull is returned when handshake state cannot be stored,
+// because the store holds as many handshakes as it allows.
+var ErrHandshakeStoreFull error = fmt.Errorf("too many handshakes in progress")
+
+// HandshakeStore stores the state of handshakes in progress, which expires
+// if the handshake is not completed in time. A store shared by several
+// servers allows any of them to complete a handshake started by another.
+type HandshakeStore interface {
+	// Put stores a value under a key, replacing any prior value, until it
+	// expires after ttl.
+	Put(key, value string, ttl time.Duration) error
+	// Get returns the value stored under a key, or ErrHandshakeNotFound if
+	// there is none, or it has expired.
+	Get(key string) (string, error)
+	// Delete removes the value stored under a key. Deleting a key which does
+	// not exist is not an error.
+	Delete(key string) error
+	// AddNonce records a nonce until it expires after ttl, and reports
+	// whether it was recorded: false if it is already recorded and has not
+	// expired. The check and the record are made atomically. Nonces are kept
+	// apart from handshake state, and are neither limited by the store's size
+	// nor evicted before they expire.
+	AddNonce(nonce string, ttl time.Duration) (bool, error)
+}
+
+// TakeHandshake removes and returns the value stored under a key, so that
+// each handshake can only be completed once.
+func TakeHandshake(store HandshakeStore, key string) (string, error) {
+	value, err := store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	return value, store.Delete(key)
+}
+
+type memEntry struct {
+	value   string
+	expires time.Time
+}
+
+// MemHandshakeStore stores handshake state in memory, for a single server.
+type MemHandshakeStore struct {
+	mu      sync.Mutex
+	maxSize int
+	entries map[string]memEntry
+	nonces  map[string]time.Time
+	swept   time.Time
+}
+
+// NewMemHandshakeStore creates a memory handshake store holding at most
+// maxSize handshakes. When full, expired handshakes are evicted first, and
+// then those closest to expiring. A maxSize of zero or less is unlimited.
+func NewMemHandshakeStore(maxSize int) *MemHandshakeStore {
+	return &MemHandshakeStore{
+		maxSize: maxSize,
+		entries: make(map[string]memEntry),
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+func (s *MemHandshakeStore) Put(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if _, ok := s.entries[key]; !ok && s.maxSize > 0 && len(s.entries) >= s.maxSize {
+		var oldestKey string
+		var oldest time.Time
+		for k, entry := range s.entries {
+			if !now.Before(entry.expires) {
+				delete(s.entries, k)
+			} else if oldestKey == "" || entry.expires.Before(oldest) {
+				oldestKey, oldest = k, entry.expires
+			}
+		}
+		if len(s.entries) >= s.maxSize {
+			delete(s.entries, oldestKey)
+		}
+	}
+	s.entries[key] = memEntry{value: value, expires: now.Add(ttl)}
+	return nil
+}
+
+func (s *MemHandshakeStore) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return "", ErrHandshakeNotFound
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(s.entries, key)
+		return "", ErrHandshakeNotFound
+	}
+	return entry.value, nil
+}
+
+func (s *MemHandshakeStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemHandshakeStore) AddNonce(nonce string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.swept) >= SweepInterval {
+		for k, expires := range s.nonces {
+			if !now.Before(expires) {
+				delete(s.nonces, k)
+			}
+		}
+		s.swept = now
+	}
+	if expires, ok := s.nonces[nonce]; ok && now.Before(expires) {
+		return false, nil
+	}
+	s.nonces[nonce] = now.Add(ttl)
+	return true, nil
+}
+
+const (
+	handshakeTopic = "affinity:handshake"
+	handshakeState = "state"
+	handshakeNonce = "nonce"
+)
+
+// FactHandshakeStore stores handshake state in a FactStore, so that it can be
+// shared by the servers using the store. Completing a handshake is not atomic
+// across servers, so a callback replayed to two servers at once may be
+// accepted by both; OpenID nonces still prevent the identity assertion itself
+// from being replayed later.
+type FactHandshakeStore struct {
+	facts   *rbac.GroupFacts
+	maxSize int
+
+	mu       sync.Mutex
+	size     int
+	earliest time.Time
+	swept    time.Time
+}
+
+// NewFactHandshakeStore creates a handshake store over a FactStore, holding
+// about maxSize unexpired handshakes at most. Each server removes expired
+// state and counts the handshakes in the store every SweepInterval, or sooner
+// if the store is full and a handshake has expired since, and counts those it
+// stores in between, so servers sharing a store may exceed the limit
+// slightly. A maxSize of zero or less is unlimited.
+func NewFactHandshakeStore(store rbac.FactStore, maxSize int) *FactHandshakeStore {
+	return &FactHandshakeStore{facts: rbac.NewGroupFacts(store), maxSize: maxSize}
+}
+
+// full reports whether the store holds as many handshakes as it allows.
+func (s *FactHandshakeStore) full() bool {
+	return s.maxSize > 0 && s.size >= s.maxSize
+}
+
+// sweep removes expired handshakes and nonces from the store, and counts the
+// handshakes remaining, if it has not done so for SweepInterval, or if the
+// store is full and the earliest of the handshakes counted has expired.
+func (s *FactHandshakeStore) sweep(now time.Time) error {
+	if now.Sub(s.swept) < SweepInterval && !(s.full() && !now.Before(s.earliest)) {
+		return nil
+	}
+	err := s.facts.Sweep(handshakeTopic)
+	if err != nil {
+		return err
+	}
+	handshakes, err := s.facts.Match(rbac.Fact{Topic: handshakeTopic, Predicate: handshakeState})
+	if err != nil {
+		return err
+	}
+	s.size, s.earliest, s.swept = len(handshakes), time.Time{}, now
+	for _, fact := range handshakes {
+		s.noteExpires(fact.Expires)
+	}
+	return nil
+}
+
+// noteExpires keeps track of the earliest expiration of the handshakes
+// counted.
+func (s *FactHandshakeStore) noteExpires(expires time.Time) {
+	if s.earliest.IsZero() || expires.Before(s.earliest) {
+		s.earliest = expires
+	}
+}
+
+func (s *FactHandshakeStore) Put(key, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if err := s.sweep(now); err != nil {
+		return err
+	}
+	prior, err := s.facts.Match(rbac.Fact{Topic: handshakeTopic, Subject: key, Predicate: handshakeState})
+	if err != nil {
+		return err
+	}
+	if len(prior) == 0 && s.full() {
+		return ErrHandshakeStoreFull
+	}
+	var changes []rbac.Change
+	for _, fact := range prior {
+		changes = append(changes, rbac.Change{Fact: fact, Deny: true})
+	}
+	changes = append(changes, rbac.Change{Fact: rbac.Fact{
+		Topic:     handshakeTopic,
+		Subject:   key,
+		Predicate: handshakeState,
+		Object:    value,
+		Expires:   now.Add(ttl),
+	}})
+	if err = s.facts.Apply(changes...); err != nil {
+		return err
+	}
+	if len(prior) == 0 {
+		s.size++
+	}
+	s.noteExpires(now.Add(ttl))
+	return nil
+}
+
+func (s *FactHandshakeStore) Get(key string) (string, error) {
+	facts, err := s.facts.Match(rbac.Fact{Topic: handshakeTopic, Subject: key, Predicate: handshakeState})
+	if err != nil {
+		return "", err
+	}
+	if len(facts) == 0 {
+		return "", ErrHandshakeNotFound
+	}
+	return facts[0].Object, nil
+}
+
+func (s *FactHandshakeStore) Delete(key string) error {
+	facts, err := s.facts.Match(rbac.Fact{Topic: handshakeTopic, Subject: key, Predicate: handshakeState})
+	if err != nil || len(facts) == 0 {
+		return err
+	}
+	if err = s.facts.Deny(facts...); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.size > 0 {
+		s.size--
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *FactHandshakeStore) AddNonce(nonce string, ttl time.Duration) (bool, error) {
+	return s.facts.Insert(rbac.Fact{
+		Topic:     handshakeTopic,
+		Subject:   nonce,
+		Predicate: handshakeNonce,
+		Expires:   time.Now().Add(ttl),
+	})
+}
+
+// nonceStore rejects replayed OpenID response nonces, recording the nonces
+// seen in a handshake store.
+type nonceStore struct {
+	store HandshakeStore
+}
+
+// NewNonceStore creates an OpenID nonce store over a handshake store.
+func NewNonceStore(store HandshakeStore) openid.NonceStore {
+	return &nonceStore{store: store}
+}
+
+func (s *nonceStore) Accept(endpoint, nonce string) error {
+	// Nonces begin with their UTC timestamp, such as 2014-03-01T12:00:00Z.
+	if len(nonce) < 20 || len(nonce) > 256 {
+		return fmt.Errorf("invalid nonce: %q", nonce)
+	}
+	ts, err := time.Parse(time.RFC3339, nonce[0:20])
+	if err != nil {
+		return fmt.Errorf("invalid nonce timestamp: %q", nonce)
+	}
+	if age := time.Since(ts); age > NonceMaxAge || age < -NonceMaxAge {
+		return fmt.Errorf("nonce too old: %q", nonce)
+	}
+	// Nonces are kept long enough to be rejected on replay, until they are
+	// too old to be accepted anyway.
+	added, err := s.store.AddNonce(endpoint+"#"+nonce, 2*NonceMaxAge)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("nonce already used: %q", nonce)
+	}
+	return nil
+}
+
+// discoveredInfo is OpenID discovery information which can be stored.
+type discoveredInfo struct {
+	Endpoint string `json:"endpoint"`
+	LocalId  string `json:"local-id"`
+	Claimed  string `json:"claimed-id"`
+}
+
+func (d *discoveredInfo) OpEndpoint() string { return d.Endpoint }
+func (d *discoveredInfo) OpLocalId() string  { return d.LocalId }
+func (d *discoveredInfo) ClaimedId() string  { return d.Claimed }
+
+// discoveryCache caches OpenID discovery information in a handshake store.
+type discoveryCache struct {
+	store HandshakeStore
+}
+
+// NewDiscoveryCache creates an OpenID discovery cache over a handshake
+// store. Entries expire after DiscoveryTTL. The store should not be one
+// holding handshakes, as cached entries count against its size.
+func NewDiscoveryCache(store HandshakeStore) openid.DiscoveryCache {
+	return &discoveryCache{store: store}
+}
+
+func (c *discoveryCache) Put(id string, info openid.DiscoveredInfo) {
+	value, err := json.Marshal(&discoveredInfo{
+		Endpoint: info.OpEndpoint(),
+		LocalId:  info.OpLocalId(),
+		Claimed:  info.ClaimedId(),
+	})
+	if err == nil {
+		err = c.store.Put("discovery:"+id, string(value), DiscoveryTTL)
+	}
+	if err != nil {
+		log.Println("Warning: failed to cache OpenID discovery:", err)
+	}
+}
+
+func (c *discoveryCache) Get(id string) openid.DiscoveredInfo {
+	value, err := c.store.Get("discovery:" + id)
+	if err != nil {
+		return nil
+	}
+	var info discoveredInfo
+	if err = json.Unmarshal([]byte(value), &info); err != nil {
+		return nil
+	}
+	return &info
+}
@@ -0,0 +1,171 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package common_test
+
+import (
+	stdtesting "testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity/providers/common"
+	"github.com/juju/affinity/rbac/storage/mem"
+)
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+type HandshakeSuite struct {
+	// newStores creates stores of at most maxSize handshakes, which share
+	// their state.
+	newStores func(maxSize int) (common.HandshakeStore, common.HandshakeStore)
+	// evicts is true if a full store evicts the handshake closest to
+	// expiring, rather than refusing new ones.
+	evicts bool
+}
+
+var _ = Suite(&HandshakeSuite{newStores: func(maxSize int) (common.HandshakeStore, common.HandshakeStore) {
+	store := common.NewMemHandshakeStore(maxSize)
+	return store, store
+}, evicts: true})
+
+var _ = Suite(&HandshakeSuite{newStores: func(maxSize int) (common.HandshakeStore, common.HandshakeStore) {
+	facts := mem.NewFactStore()
+	return common.NewFactHandshakeStore(facts, maxSize), common.NewFactHandshakeStore(facts, maxSize)
+}})
+
+func (s *HandshakeSuite) TestTake(c *C) {
+	store, other := s.newStores(0)
+	c.Assert(store.Put("cb1", "https://example.com/fry", time.Minute), IsNil)
+	c.Assert(store.Put("cb2", "https://example.com/leela", time.Minute), IsNil)
+
+	// Handshakes started by one server can be completed by another.
+	value, err := common.TakeHandshake(other, "cb1")
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, "https://example.com/fry")
+	_, err = common.TakeHandshake(store, "cb1")
+	c.Check(err, Equals, common.ErrHandshakeNotFound)
+
+	value, err = store.Get("cb2")
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, "https://example.com/leela")
+	c.Assert(store.Put("cb2", "https://example.com/amy", time.Minute), IsNil)
+	value, err = other.Get("cb2")
+	c.Assert(err, IsNil)
+	c.Check(value, Equals, "https://example.com/amy")
+	c.Assert(store.Delete("cb2"), IsNil)
+	c.Assert(store.Delete("cb2"), IsNil)
+	_, err = other.Get("cb2")
+	c.Check(err, Equals, common.ErrHandshakeNotFound)
+}
+
+func (s *HandshakeSuite) TestExpires(c *C) {
+	store, _ := s.newStores(0)
+	c.Assert(store.Put("cb1", "https://example.com/fry", time.Millisecond), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	_, err := store.Get("cb1")
+	c.Check(err, Equals, common.ErrHandshakeNotFound)
+}
+
+func (s *HandshakeSuite) TestMaxSize(c *C) {
+	store, _ := s.newStores(2)
+	c.Assert(store.Put("cb1", "1", time.Millisecond), IsNil)
+	c.Assert(store.Put("cb2", "2", time.Minute), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	// Expired handshakes make room for new ones.
+	c.Assert(store.Put("cb3", "3", time.Minute), IsNil)
+	// Replacing a handshake does not need more room.
+	c.Assert(store.Put("cb3", "3", time.Minute), IsNil)
+
+	err := store.Put("cb4", "4", 2*time.Minute)
+	if !s.evicts {
+		c.Check(err, Equals, common.ErrHandshakeStoreFull)
+		return
+	}
+	c.Assert(err, IsNil)
+	_, err = store.Get("cb2")
+	c.Check(err, Equals, common.ErrHandshakeNotFound)
+	for _, key := range []string{"cb3", "cb4"} {
+		_, err = store.Get(key)
+		c.Check(err, IsNil)
+	}
+}
+
+func (s *HandshakeSuite) TestNonceStore(c *C) {
+	store, other := s.newStores(0)
+	nonce := time.Now().UTC().Format(time.RFC3339) + "abc123"
+	c.Check(common.NewNonceStore(store).Accept("https://login.example.com/", nonce), IsNil)
+	c.Check(common.NewNonceStore(other).Accept("https://login.example.com/", nonce), ErrorMatches, "nonce already used.*")
+	c.Check(common.NewNonceStore(store).Accept("https://login.example.com/", "bogus"), ErrorMatches, "invalid nonce.*")
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339) + "abc123"
+	c.Check(common.NewNonceStore(store).Accept("https://login.example.com/", old), ErrorMatches, "nonce too old.*")
+}
+
+func (s *HandshakeSuite) TestNonceStoreFull(c *C) {
+	store, other := s.newStores(1)
+	nonce := time.Now().UTC().Format(time.RFC3339) + "abc123"
+	c.Assert(store.Put("cb1", "1", time.Minute), IsNil)
+	// Nonces are accepted when the store is full of handshakes.
+	c.Check(common.NewNonceStore(store).Accept("https://login.example.com/", nonce), IsNil)
+	// Handshakes do not evict nonces.
+	for _, key := range []string{"cb2", "cb3"} {
+		err := store.Put(key, key, time.Minute)
+		if !s.evicts {
+			c.Check(err, Equals, common.ErrHandshakeStoreFull)
+		}
+	}
+	c.Check(common.NewNonceStore(other).Accept("https://login.example.com/", nonce), ErrorMatches, "nonce already used.*")
+}
+
+func (s *HandshakeSuite) TestNonceStoreConcurrent(c *C) {
+	store, other := s.newStores(0)
+	nonce := time.Now().UTC().Format(time.RFC3339) + "abc123"
+	results := make(chan error)
+	for i := 0; i < 8; i++ {
+		nonces := common.NewNonceStore(store)
+		if i%2 == 1 {
+			nonces = common.NewNonceStore(other)
+		}
+		go func() {
+			results <- nonces.Accept("https://login.example.com/", nonce)
+		}()
+	}
+	accepted := 0
+	for i := 0; i < 8; i++ {
+		if <-results == nil {
+			accepted++
+		}
+	}
+	c.Check(accepted, Equals, 1)
+}
+
+type testDiscoveredInfo struct{}
+
+func (testDiscoveredInfo) OpEndpoint() string { return "https://login.example.com/+openid" }
+func (testDiscoveredInfo) OpLocalId() string  { return "https://login.example.com/+id/fry" }
+func (testDiscoveredInfo) ClaimedId() string  { return "https://login.example.com/+id/fry" }
+
+func (s *HandshakeSuite) TestDiscoveryCache(c *C) {
+	store, other := s.newStores(0)
+	c.Check(common.NewDiscoveryCache(other).Get("https://login.example.com/"), IsNil)
+	common.NewDiscoveryCache(store).Put("https://login.example.com/", testDiscoveredInfo{})
+	info := common.NewDiscoveryCache(other).Get("https://login.example.com/")
+	c.Assert(info, NotNil)
+	c.Check(info.OpEndpoint(), Equals, "https://login.example.com/+openid")
+	c.Check(info.OpLocalId(), Equals, "https://login.example.com/+id/fry")
+	c.Check(info.ClaimedId(), Equals, "https://login.example.com/+id/fry")
+}
@@ -34,9 +34,9 @@ import (
 )
 
 type OpenID struct {
-	nonceStore     *openid.SimpleNonceStore
-	discoveryCache *openid.SimpleDiscoveryCache
-	urlStore       map[string]string
+	nonceStore     openid.NonceStore
+	discoveryCache openid.DiscoveryCache
+	handshakes     HandshakeStore
 	realm          string
 	sessionStore   sessions.Store
 	redirectHost   string
@@ -45,12 +45,21 @@ type OpenID struct {
 // NewSimpleOpenID creates a new OpenID authentication helper which facilitates
 // establishing an identity and associating it with a secure session
 // cookie. When redirectHost is "", OpenID redirects will use the same hostname
-// as the request.
+// as the request. Handshake state is kept in memory.
 func NewSimpleOpenID(realm string, redirectHost string, sessionStore sessions.Store) *OpenID {
+	return NewOpenID(realm, redirectHost, sessionStore, NewMemHandshakeStore(DefaultMaxHandshakes))
+}
+
+// NewOpenID creates a new OpenID authentication helper, which keeps the state
+// of handshakes in progress and response nonces in the given store. Servers
+// sharing a store can complete each other's handshakes. Discovered endpoints
+// are cached in memory apart from the store, so that they cannot displace
+// handshakes.
+func NewOpenID(realm string, redirectHost string, sessionStore sessions.Store, handshakes HandshakeStore) *OpenID {
 	return &OpenID{
-		nonceStore:     &openid.SimpleNonceStore{Store: make(map[string][]*openid.Nonce)},
-		discoveryCache: &openid.SimpleDiscoveryCache{},
-		urlStore:       make(map[string]string), // TODO: needs to expire handshakes
+		nonceStore:     NewNonceStore(handshakes),
+		discoveryCache: NewDiscoveryCache(NewMemHandshakeStore(DefaultMaxDiscoveries)),
+		handshakes:     handshakes,
 		realm:          realm,
 		sessionStore:   sessionStore,
 		redirectHost:   redirectHost,
@@ -103,18 +112,19 @@ func (oid *OpenID) Callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	originalUrl, ok := oid.urlStore[cbuuid]
-	if !ok {
+	// We're done with the callback, remove it.
+	originalUrl, err := TakeHandshake(oid.handshakes, cbuuid)
+	if err == ErrHandshakeNotFound {
+		oid.respError(w, "Unauthorized", http.StatusUnauthorized,
+			fmt.Errorf("cbuuid not found in handshake store: %q", cbuuid))
+		return
+	} else if err != nil {
 		oid.respError(w, "Server error", http.StatusInternalServerError,
-			fmt.Errorf("cbuuid not found in local store: %q", cbuuid))
+			fmt.Errorf("failed to get handshake: %q", err))
 		return
 	}
 
-	// We're done with the callback, remove it.
-	// TODO: we should use an expiring kv store for these to prevent DoS.
-	delete(oid.urlStore, cbuuid)
-
-	_, ok = values["openid.sreg.email"]
+	_, ok := values["openid.sreg.email"]
 	if !ok {
 		oid.respError(w, "Server error", http.StatusInternalServerError,
 			fmt.Errorf("openid.sreq.email missing from OpenID response"))
@@ -179,7 +189,10 @@ func (oid *OpenID) OpRedirect(authorityURL string, w http.ResponseWriter, r *htt
 
 	// store the original user requested url
 	originalUrl := fmt.Sprintf("https://%s%s", oid.responseHost(r), r.URL.String())
-	oid.urlStore[cbuuid.String()] = originalUrl
+	err := oid.handshakes.Put(cbuuid.String(), originalUrl, HandshakeTTL)
+	if err != nil {
+		return err
+	}
 
 	// now redirect to the authority
 	fullURL := fmt.Sprintf("https://%s%s?cbuuid=%s", oid.responseHost(r), "/openidcallback", cbuuid)
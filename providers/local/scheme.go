@@ -0,0 +1,192 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package local provides an authentication scheme for users defined locally,
+// with bcrypt password hashes kept in a file or the FactStore, for deployments
+// which cannot reach an external identity provider.
+package local
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/juju/affinity"
+)
+
+// SchemeName is the name of the local user scheme.
+const SchemeName = "local"
+
+// Minter exchanges a local user's password for a token issued by the server,
+// such as an API token, so that clients need not keep the password.
+type Minter interface {
+	MintToken(username, password string) (*affinity.TokenInfo, error)
+}
+
+// Scheme authenticates local users by their passwords, sent with HTTP Basic
+// authentication. Clients log in by exchanging the password for a token issued
+// by the server.
+type Scheme struct {
+	users    Users
+	passProv affinity.PasswordProvider
+	minter   Minter
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyHash spends the time taken to check a password, so that unknown
+// users cannot be told apart from known users by the time taken to reject
+// them.
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// NewScheme creates a local user scheme which authenticates the users
+// in the given store.
+func NewScheme(users Users) *Scheme {
+	return &Scheme{users: users}
+}
+
+// NewCli creates a local user scheme for clients, which obtains passwords
+// from the given provider and exchanges them for tokens with the given minter.
+func NewCli(passProv affinity.PasswordProvider, minter Minter) *Scheme {
+	return &Scheme{passProv: passProv, minter: minter}
+}
+
+func (s *Scheme) Name() string { return SchemeName }
+
+func (s *Scheme) Authenticate(r *http.Request) (affinity.Principal, error) {
+	if username, password, ok := r.BasicAuth(); ok {
+		return s.AuthenticateBasic(username, password)
+	}
+	return affinity.Principal{}, affinity.ErrUnauthorized
+}
+
+// AuthenticateBasic checks a local user's password.
+func (s *Scheme) AuthenticateBasic(username, password string) (affinity.Principal, error) {
+	if s.users == nil {
+		return affinity.Principal{}, fmt.Errorf("local users are unavailable")
+	}
+	hash, err := s.users.Hash(username)
+	if err == ErrUnknownUser {
+		compareDummyHash(password)
+		return affinity.Principal{}, affinity.ErrUnauthorized
+	} else if err != nil {
+		return affinity.Principal{}, err
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil {
+		return affinity.Principal{}, affinity.ErrUnauthorized
+	}
+	return affinity.Principal{Scheme: SchemeName, Id: username}, nil
+}
+
+// Authorize obtains a token for a local user from the scheme's minter, in
+// exchange for the password obtained from the scheme's password provider. The
+// token is issued by the server, and does not contain the password.
+func (s *Scheme) Authorize(user affinity.Principal) (*affinity.TokenInfo, error) {
+	if user.Scheme != SchemeName {
+		return nil, fmt.Errorf("cannot authorize scheme: %q", user.Scheme)
+	}
+	if s.passProv == nil {
+		return nil, fmt.Errorf("password is unavailable")
+	}
+	if s.minter == nil {
+		return nil, fmt.Errorf("tokens cannot be obtained for local users")
+	}
+	password, err := s.passProv.Password()
+	if err != nil {
+		return nil, err
+	}
+	return s.minter.MintToken(user.Id, password)
+}
+
+// Validate rejects all tokens. Tokens obtained by Authorize belong to the
+// scheme which issued them.
+func (s *Scheme) Validate(token *affinity.TokenInfo) (affinity.Principal, error) {
+	if token.Scheme != SchemeName {
+		return affinity.Principal{}, fmt.Errorf("not a local user token: %q", token.Scheme)
+	}
+	return affinity.Principal{}, affinity.ErrUnauthorized
+}
+
+// AddUser adds a local user with the given password.
+func (s *Scheme) AddUser(username, password string) error {
+	if err := checkUsername(username); err != nil {
+		return err
+	}
+	_, err := s.users.Hash(username)
+	if err == nil {
+		return fmt.Errorf("user %q already exists", username)
+	} else if err != ErrUnknownUser {
+		return err
+	}
+	return s.setPassword(username, password)
+}
+
+// ResetPassword replaces the password of an existing local user.
+func (s *Scheme) ResetPassword(username, password string) error {
+	_, err := s.users.Hash(username)
+	if err == ErrUnknownUser {
+		return fmt.Errorf("user %q does not exist", username)
+	} else if err != nil {
+		return err
+	}
+	return s.setPassword(username, password)
+}
+
+// RemoveUser removes a local user.
+func (s *Scheme) RemoveUser(username string) error {
+	return s.users.Remove(username)
+}
+
+// Users returns the names of all local users.
+func (s *Scheme) Users() ([]string, error) {
+	return s.users.List()
+}
+
+func (s *Scheme) setPassword(username, password string) error {
+	if password == "" {
+		return fmt.Errorf("password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.users.SetHash(username, hash)
+}
+
+// checkUsername checks that a user name can be stored, and sent with HTTP
+// Basic authentication.
+func checkUsername(username string) error {
+	if username == "" {
+		return fmt.Errorf("user name must not be empty")
+	}
+	if strings.ContainsAny(username, ": \t\r\n") {
+		return fmt.Errorf("invalid user name %q: must not contain colons or whitespace", username)
+	}
+	return nil
+}
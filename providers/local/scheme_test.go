@@ -0,0 +1,207 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package local_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	stdtesting "testing"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity"
+	groupclient "github.com/juju/affinity/client/group"
+	"github.com/juju/affinity/providers/apitoken"
+	"github.com/juju/affinity/providers/local"
+	"github.com/juju/affinity/rbac/storage/mem"
+	"github.com/juju/affinity/server"
+	groupserver "github.com/juju/affinity/server/group"
+)
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+type password string
+
+func (p password) Password() (string, error) { return string(p), nil }
+
+type LocalSuite struct {
+	newUsers func(c *C) local.Users
+	scheme   *local.Scheme
+	fry      affinity.Principal
+}
+
+var _ = Suite(&LocalSuite{newUsers: func(c *C) local.Users {
+	return local.NewFactUsers(mem.NewFactStore())
+}})
+
+var _ = Suite(&LocalSuite{newUsers: func(c *C) local.Users {
+	return local.NewFileUsers(filepath.Join(c.MkDir(), "htpasswd"))
+}})
+
+func (s *LocalSuite) SetUpTest(c *C) {
+	s.scheme = local.NewScheme(s.newUsers(c))
+	c.Assert(s.scheme.AddUser("fry", "slurm"), IsNil)
+	s.fry = affinity.Principal{Scheme: local.SchemeName, Id: "fry"}
+}
+
+func (s *LocalSuite) TestAuthenticateBasic(c *C) {
+	user, err := s.scheme.AuthenticateBasic("fry", "slurm")
+	c.Assert(err, IsNil)
+	c.Check(user, Equals, s.fry)
+
+	_, err = s.scheme.AuthenticateBasic("fry", "popplers")
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+	_, err = s.scheme.AuthenticateBasic("bender", "slurm")
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+}
+
+// minter mints API tokens for local users from a group server.
+type minter struct {
+	client *groupclient.GroupClient
+}
+
+func (m *minter) MintToken(username, password string) (*affinity.TokenInfo, error) {
+	minted, err := m.client.MintTokenBasic(username, password, "login", 0)
+	if err != nil {
+		return nil, err
+	}
+	return affinity.ParseTokenInfo(minted.Authorization)
+}
+
+func (s *LocalSuite) TestToken(c *C) {
+	store := mem.NewFactStore()
+	tokens := apitoken.NewScheme(store)
+	srv := groupserver.NewGroupServer(store)
+	srv.Schemes.Register(s.scheme)
+	srv.Schemes.Register(tokens)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	c.Assert(err, IsNil)
+	m := &minter{groupclient.NewGroupClient(u, nil)}
+
+	// Passwords may contain characters with meaning in the header.
+	c.Assert(s.scheme.ResetPassword("fry", `s=l, "u" rm`), IsNil)
+	tokenInfo, err := local.NewCli(password(`s=l, "u" rm`), m).Authorize(s.fry)
+	c.Assert(err, IsNil)
+	c.Check(tokenInfo.Scheme, Equals, apitoken.SchemeName)
+	c.Check(tokenInfo.Serialize(), Not(Matches), `.*s=l.*`)
+	user, err := tokens.Validate(tokenInfo)
+	c.Assert(err, IsNil)
+	c.Check(user, Equals, s.fry)
+
+	// Tokens holding local credentials are not accepted.
+	_, err = s.scheme.Validate(&affinity.TokenInfo{Scheme: local.SchemeName,
+		Values: url.Values{"credentials": []string{"ZnJ5OnNsdXJt"}}})
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+
+	_, err = local.NewCli(password("slurm"), m).Authorize(s.fry)
+	c.Check(affinity.ErrorCodeOf(err), Equals, affinity.CodeUnauthorized)
+
+	_, err = local.NewCli(password("slurm"), m).Authorize(affinity.MustParsePrincipal("usso:fry"))
+	c.Check(err, ErrorMatches, `cannot authorize scheme: "usso"`)
+}
+
+func (s *LocalSuite) TestAdmin(c *C) {
+	c.Check(s.scheme.AddUser("fry", "popplers"), ErrorMatches, `user "fry" already exists`)
+	c.Check(s.scheme.AddUser("fry:leela", "popplers"), ErrorMatches, `invalid user name.*`)
+	c.Check(s.scheme.AddUser("leela", ""), ErrorMatches, `password must not be empty`)
+	c.Check(s.scheme.ResetPassword("leela", "nibbler"), ErrorMatches, `user "leela" does not exist`)
+	c.Assert(s.scheme.AddUser("leela", "nibbler"), IsNil)
+
+	users, err := s.scheme.Users()
+	c.Assert(err, IsNil)
+	c.Check(users, DeepEquals, []string{"fry", "leela"})
+
+	c.Assert(s.scheme.ResetPassword("fry", "popplers"), IsNil)
+	_, err = s.scheme.AuthenticateBasic("fry", "slurm")
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+	_, err = s.scheme.AuthenticateBasic("fry", "popplers")
+	c.Check(err, IsNil)
+
+	c.Assert(s.scheme.RemoveUser("fry"), IsNil)
+	c.Assert(s.scheme.RemoveUser("fry"), IsNil)
+	_, err = s.scheme.AuthenticateBasic("fry", "popplers")
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+	users, err = s.scheme.Users()
+	c.Assert(err, IsNil)
+	c.Check(users, DeepEquals, []string{"leela"})
+}
+
+func (s *LocalSuite) TestServerBasicAuth(c *C) {
+	srv := server.NewAuthServer(mem.NewFactStore())
+	srv.Schemes.Register(s.scheme)
+	srv.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		user, err := srv.Authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(user.String()))
+	})
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		username, password string
+		status             int
+	}{
+		{"fry", "slurm", http.StatusOK},
+		{"fry", "popplers", http.StatusUnauthorized},
+	} {
+		req, err := http.NewRequest("GET", ts.URL+"/whoami", nil)
+		c.Assert(err, IsNil)
+		req.SetBasicAuth(test.username, test.password)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Check(resp.StatusCode, Equals, test.status)
+		if test.status == http.StatusOK {
+			c.Check(string(body), Equals, "local:fry")
+		}
+	}
+}
+
+func (s *LocalSuite) TestHtpasswdFile(c *C) {
+	path := filepath.Join(c.MkDir(), "htpasswd")
+	scheme := local.NewScheme(local.NewFileUsers(path))
+	c.Assert(scheme.AddUser("fry", "slurm"), IsNil)
+	contents, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	// Entries added by other tools are picked up, and comments ignored.
+	err = ioutil.WriteFile(path, append([]byte("# local users\n\n"), contents...), 0600)
+	c.Assert(err, IsNil)
+	_, err = scheme.AuthenticateBasic("fry", "slurm")
+	c.Check(err, IsNil)
+
+	err = ioutil.WriteFile(path, []byte("fry\n"), 0600)
+	c.Assert(err, IsNil)
+	_, err = scheme.AuthenticateBasic("fry", "slurm")
+	c.Check(err, ErrorMatches, `malformed entry in .*`)
+	c.Assert(os.Remove(path), IsNil)
+	users, err := scheme.Users()
+	c.Assert(err, IsNil)
+	c.Check(users, HasLen, 0)
+}
@@ -0,0 +1,248 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/affinity/rbac"
+)
+
+// ErrUnknownUser is returned when a local user does not exist.
+var ErrUnknownUser error = fmt.Errorf("unknown user")
+
+// Users stores the password hashes of local users.
+type Users interface {
+	// Hash returns the password hash of a user, or ErrUnknownUser if the
+	// user does not exist.
+	Hash(username string) ([]byte, error)
+	// SetHash sets the password hash of a user, adding the user if it does
+	// not already exist.
+	SetHash(username string, hash []byte) error
+	// Remove removes a user. Removing a user which does not exist is not an
+	// error.
+	Remove(username string) error
+	// List returns the names of all users, in sorted order.
+	List() ([]string, error)
+}
+
+// FileUsers stores users in an htpasswd-format file, one "username:hash"
+// entry per line. Only bcrypt hashes are supported, such as those created by
+// "htpasswd -B". The file is read on each lookup, so that changes made by
+// other processes take effect immediately.
+type FileUsers struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileUsers creates a user store in the given file. The file is created
+// when the first user is added.
+func NewFileUsers(path string) *FileUsers {
+	return &FileUsers{path: path}
+}
+
+type fileEntry struct {
+	username string
+	hash     []byte
+}
+
+func (u *FileUsers) read() ([]fileEntry, error) {
+	contents, err := ioutil.ReadFile(u.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []fileEntry
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed entry in %q: %q", u.path, line)
+		}
+		entries = append(entries, fileEntry{parts[0], []byte(parts[1])})
+	}
+	return entries, scanner.Err()
+}
+
+func (u *FileUsers) write(entries []fileEntry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		fmt.Fprintf(&buf, "%s:%s\n", entry.username, entry.hash)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(u.path), filepath.Base(u.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), u.path)
+}
+
+func (u *FileUsers) Hash(username string) ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries, err := u.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.username == username {
+			return entry.hash, nil
+		}
+	}
+	return nil, ErrUnknownUser
+}
+
+func (u *FileUsers) SetHash(username string, hash []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries, err := u.read()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range entries {
+		if entries[i].username == username {
+			entries[i].hash = hash
+			found = true
+		}
+	}
+	if !found {
+		entries = append(entries, fileEntry{username, hash})
+	}
+	return u.write(entries)
+}
+
+func (u *FileUsers) Remove(username string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries, err := u.read()
+	if err != nil {
+		return err
+	}
+	var keep []fileEntry
+	for _, entry := range entries {
+		if entry.username != username {
+			keep = append(keep, entry)
+		}
+	}
+	if len(keep) == len(entries) {
+		return nil
+	}
+	return u.write(keep)
+}
+
+func (u *FileUsers) List() ([]string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries, err := u.read()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, entry := range entries {
+		result = append(result, entry.username)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+const (
+	usersTopic   = "affinity:local-users"
+	passwordHash = "password-hash"
+)
+
+// FactUsers stores users in a FactStore, alongside the groups and roles of
+// the service.
+type FactUsers struct {
+	store rbac.FactStore
+}
+
+// NewFactUsers creates a user store over the given FactStore.
+func NewFactUsers(store rbac.FactStore) *FactUsers {
+	return &FactUsers{store: store}
+}
+
+func (u *FactUsers) Hash(username string) ([]byte, error) {
+	facts, err := u.store.Match(rbac.Fact{Topic: usersTopic, Subject: username, Predicate: passwordHash})
+	if err != nil {
+		return nil, err
+	}
+	if len(facts) == 0 {
+		return nil, ErrUnknownUser
+	}
+	return []byte(facts[0].Object), nil
+}
+
+func (u *FactUsers) SetHash(username string, hash []byte) error {
+	facts, err := u.store.Match(rbac.Fact{Topic: usersTopic, Subject: username, Predicate: passwordHash})
+	if err != nil {
+		return err
+	}
+	var changes []rbac.Change
+	for _, fact := range facts {
+		changes = append(changes, rbac.Change{Fact: fact, Deny: true})
+	}
+	changes = append(changes, rbac.Change{Fact: rbac.Fact{
+		Topic: usersTopic, Subject: username, Predicate: passwordHash, Object: string(hash),
+	}})
+	return u.store.Apply(changes...)
+}
+
+func (u *FactUsers) Remove(username string) error {
+	facts, err := u.store.Match(rbac.Fact{Topic: usersTopic, Subject: username, Predicate: passwordHash})
+	if err != nil || len(facts) == 0 {
+		return err
+	}
+	return u.store.Deny(facts...)
+}
+
+func (u *FactUsers) List() ([]string, error) {
+	facts, err := u.store.Match(rbac.Fact{Topic: usersTopic, Predicate: passwordHash})
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, fact := range facts {
+		result = append(result, fact.Subject)
+	}
+	sort.Strings(result)
+	return result, nil
+}
@@ -0,0 +1,518 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package oidc provides a handshake scheme for OpenID Connect identity
+// providers, such as Google, Keycloak or Dex. Users sign in with the
+// authorization code flow, protected by PKCE, and are identified by the
+// claims of the ID token issued to them.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/providers/common"
+)
+
+// DefaultTimeout is how long requests to the identity provider may take,
+// unless the scheme is configured with its own client.
+const DefaultTimeout = 30 * time.Second
+
+// Config configures an OpenID Connect scheme.
+type Config struct {
+	// Name is the name of the scheme, and the default scheme of the
+	// principals it authenticates.
+	Name string
+	// Issuer is the issuer URL of the identity provider, from which its
+	// configuration is discovered.
+	Issuer string
+	// ClientID and ClientSecret are the credentials of the client registered
+	// with the identity provider. ClientSecret is empty for public clients.
+	ClientID, ClientSecret string
+	// RedirectURL is the callback URL registered with the identity provider,
+	// which is handled by Authenticated.
+	RedirectURL string
+	// Scopes are the scopes requested. If empty, the openid, email and
+	// profile scopes are requested.
+	Scopes []string
+	// Rules map ID token claims to principals. The first rule matching a
+	// claim is used. If empty, users are identified by their verified email
+	// address, in the scheme of the given Name.
+	Rules []Rule
+	// Client is the HTTP client used to reach the identity provider. If nil,
+	// a client which times out after DefaultTimeout is used.
+	Client *http.Client
+	// Handshakes stores the state of sign ins in progress. Servers sharing a
+	// store can complete each other's sign ins. If nil, the state is kept in
+	// memory.
+	Handshakes common.HandshakeStore
+}
+
+// Rule maps an ID token claim to a principal.
+type Rule struct {
+	// Scheme is the scheme of the principal.
+	Scheme string
+	// Claim is the name of the string claim identifying the principal. An
+	// email claim is only used if the email address is verified.
+	Claim string
+}
+
+// ParseRule parses a claim mapping rule of the form "scheme:claim". For
+// example, "google:email" maps an ID token for the verified email address
+// fry@planetexpress.com to google:fry@planetexpress.com.
+func ParseRule(spec string) (Rule, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Rule{}, fmt.Errorf("invalid claim rule: %q", spec)
+	}
+	return Rule{Scheme: parts[0], Claim: parts[1]}, nil
+}
+
+// Principal maps the claims of an ID token to a principal by the rule. It
+// returns false if the claim is missing.
+func (r Rule) Principal(claims map[string]interface{}) (affinity.Principal, bool) {
+	value, ok := claims[r.Claim].(string)
+	if !ok || value == "" {
+		return affinity.Principal{}, false
+	}
+	if r.Claim == "email" {
+		if verified, ok := claims["email_verified"].(bool); !ok || !verified {
+			return affinity.Principal{}, false
+		}
+	}
+	return affinity.Principal{Scheme: r.Scheme, Id: value}, true
+}
+
+// providerConfig is the discovered configuration of an identity provider.
+type providerConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// handshake is the state of a sign in which has not yet completed.
+type handshake struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	ReturnTo string `json:"return-to"`
+}
+
+// Scheme authenticates users with an OpenID Connect identity provider, and
+// keeps the established identity in a session.
+type Scheme struct {
+	config       Config
+	sessionStore sessions.Store
+
+	// fetchMu is held while fetching from the identity provider, so that
+	// concurrent requests wait for one fetch rather than each making their
+	// own. mu guards what has been fetched, and is not held while fetching.
+	fetchMu  sync.Mutex
+	mu       sync.Mutex
+	provider *providerConfig
+	keys     map[string]crypto.PublicKey
+}
+
+// NewScheme creates an OpenID Connect scheme. The identity provider's
+// configuration is discovered when it is first needed.
+func NewScheme(config Config, sessionStore sessions.Store) *Scheme {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if len(config.Rules) == 0 {
+		config.Rules = []Rule{{Scheme: config.Name, Claim: "email"}}
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if config.Handshakes == nil {
+		config.Handshakes = common.NewMemHandshakeStore(common.DefaultMaxHandshakes)
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &Scheme{
+		config:       config,
+		sessionStore: sessionStore,
+	}
+}
+
+func (s *Scheme) Name() string { return s.config.Name }
+
+func (s *Scheme) Authenticate(r *http.Request) (affinity.Principal, error) {
+	session, err := s.sessionStore.Get(r, s.Name())
+	if err != nil {
+		return affinity.Principal{}, err
+	}
+	principal, ok := session.Values["principal"].(string)
+	if session.IsNew || !ok {
+		return affinity.Principal{}, affinity.ErrUnauthorized
+	}
+	return affinity.ParsePrincipal(principal)
+}
+
+// SignIn redirects to the identity provider to sign in. Once signed in, the
+// user is returned to the path of the request.
+func (s *Scheme) SignIn(w http.ResponseWriter, r *http.Request) error {
+	provider, err := s.discover()
+	if err != nil {
+		return err
+	}
+	state, err := randomString()
+	if err != nil {
+		return err
+	}
+	hs := &handshake{ReturnTo: r.URL.RequestURI()}
+	if hs.Verifier, err = randomString(); err != nil {
+		return err
+	}
+	if hs.Nonce, err = randomString(); err != nil {
+		return err
+	}
+	hsJSON, err := json.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	err = s.config.Handshakes.Put(state, string(hsJSON), common.HandshakeTTL)
+	if err != nil {
+		return err
+	}
+
+	challenge := sha256.Sum256([]byte(hs.Verifier))
+	params := url.Values{
+		"response_type":         []string{"code"},
+		"client_id":             []string{s.config.ClientID},
+		"redirect_uri":          []string{s.config.RedirectURL},
+		"scope":                 []string{strings.Join(s.config.Scopes, " ")},
+		"state":                 []string{state},
+		"nonce":                 []string{hs.Nonce},
+		"code_challenge":        []string{encoding.EncodeToString(challenge[:])},
+		"code_challenge_method": []string{"S256"},
+	}
+	authURL, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		return err
+	}
+	query := authURL.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	authURL.RawQuery = query.Encode()
+	http.Redirect(w, r, authURL.String(), http.StatusSeeOther)
+	return nil
+}
+
+// Authenticated handles the redirect back from the identity provider. The
+// authorization code is exchanged for an ID token, which is validated and
+// mapped to a principal kept in the user's session.
+func (s *Scheme) Authenticated(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		respError(w, "Unauthorized", http.StatusUnauthorized,
+			fmt.Errorf("sign in failed: %s: %s", errCode, query.Get("error_description")))
+		return
+	}
+	hs, err := s.takeHandshake(query.Get("state"))
+	if err == common.ErrHandshakeNotFound {
+		respError(w, "Unauthorized", http.StatusUnauthorized,
+			fmt.Errorf("unknown or expired sign in state: %q", query.Get("state")))
+		return
+	} else if err != nil {
+		respError(w, "Server error", http.StatusInternalServerError,
+			fmt.Errorf("failed to get sign in state: %q", err))
+		return
+	}
+	code := query.Get("code")
+	if code == "" {
+		respError(w, "Unauthorized", http.StatusUnauthorized, fmt.Errorf("code not set in callback"))
+		return
+	}
+
+	claims, err := s.exchange(code, hs)
+	if err != nil {
+		respError(w, "Unauthorized", http.StatusUnauthorized, err)
+		return
+	}
+	principal, err := s.principal(claims)
+	if err != nil {
+		respError(w, "Unauthorized", http.StatusUnauthorized, err)
+		return
+	}
+
+	session, err := s.sessionStore.Get(r, s.Name())
+	if err != nil {
+		respError(w, "Server error", http.StatusInternalServerError,
+			fmt.Errorf("failed to get session: %q", err))
+		return
+	}
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 7, // One week
+		Secure:   true,      // Enforce https, same-origin policy
+		HttpOnly: true,
+	}
+	session.Values["principal"] = principal.String()
+	err = session.Save(r, w)
+	if err != nil {
+		respError(w, "Server error", http.StatusInternalServerError,
+			fmt.Errorf("failed to save session: %q", err))
+		return
+	}
+	http.Redirect(w, r, hs.ReturnTo, http.StatusSeeOther)
+}
+
+func respError(w http.ResponseWriter, msg string, statusCode int, cause error) {
+	log.Println(cause)
+	http.Error(w, msg, statusCode)
+}
+
+// principal maps ID token claims to a principal by the first matching rule.
+func (s *Scheme) principal(claims map[string]interface{}) (affinity.Principal, error) {
+	for _, rule := range s.config.Rules {
+		if principal, ok := rule.Principal(claims); ok {
+			return principal, nil
+		}
+	}
+	return affinity.Principal{}, fmt.Errorf("no claim rule matched ID token for %v", claims["sub"])
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(buf), nil
+}
+
+// takeHandshake removes and returns the state of a sign in, so that each can
+// only be completed once.
+func (s *Scheme) takeHandshake(state string) (*handshake, error) {
+	value, err := common.TakeHandshake(s.config.Handshakes, state)
+	if err != nil {
+		return nil, err
+	}
+	var hs handshake
+	err = json.Unmarshal([]byte(value), &hs)
+	if err != nil {
+		return nil, err
+	}
+	return &hs, nil
+}
+
+// discover returns the configuration of the identity provider, fetching it
+// on first use.
+func (s *Scheme) discover() (*providerConfig, error) {
+	if provider := s.cachedProvider(); provider != nil {
+		return provider, nil
+	}
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	if provider := s.cachedProvider(); provider != nil {
+		return provider, nil
+	}
+	var provider providerConfig
+	err := s.getJSON(s.config.Issuer+"/.well-known/openid-configuration", &provider)
+	if err != nil {
+		return nil, fmt.Errorf("cannot discover identity provider: %v", err)
+	}
+	if strings.TrimSuffix(provider.Issuer, "/") != s.config.Issuer {
+		return nil, fmt.Errorf("identity provider issuer %q does not match %q", provider.Issuer, s.config.Issuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete identity provider configuration")
+	}
+	s.mu.Lock()
+	s.provider = &provider
+	s.mu.Unlock()
+	return &provider, nil
+}
+
+// cachedProvider returns the configuration of the identity provider, or nil
+// if it has not been discovered.
+func (s *Scheme) cachedProvider() *providerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.provider
+}
+
+func (s *Scheme) getJSON(u string, v interface{}) error {
+	resp, err := s.config.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the identity provider's signing key with the given id. The key
+// set is fetched again when a key is not found, so that keys rotated by the
+// identity provider are picked up.
+func (s *Scheme) key(provider *providerConfig, kid string) (crypto.PublicKey, error) {
+	if key, ok := s.cachedKey(kid); ok {
+		return key, nil
+	}
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	// The key may have been fetched while waiting.
+	if key, ok := s.cachedKey(kid); ok {
+		return key, nil
+	}
+	var keySet jsonWebKeySet
+	err := s.getJSON(provider.JWKSURI, &keySet)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch identity provider keys: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Println("Warning: ignoring identity provider key:", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	s.mu.Lock()
+	s.keys = keys
+	s.mu.Unlock()
+	if key, ok := s.cachedKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown identity provider key %q", kid)
+}
+
+// cachedKey returns the signing key with the given id from the key set last
+// fetched.
+func (s *Scheme) cachedKey(kid string) (crypto.PublicKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[kid]; ok {
+		return key, true
+	}
+	// A key set with a single key may omit key ids.
+	if key, ok := s.keys[""]; ok && len(s.keys) == 1 {
+		return key, true
+	}
+	return nil, false
+}
+
+// exchange redeems an authorization code for an ID token, and returns its
+// validated claims.
+func (s *Scheme) exchange(code string, hs *handshake) (map[string]interface{}, error) {
+	provider, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    []string{"authorization_code"},
+		"code":          []string{code},
+		"redirect_uri":  []string{s.config.RedirectURL},
+		"client_id":     []string{s.config.ClientID},
+		"code_verifier": []string{hs.Verifier},
+	}
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if s.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+	}
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokenResp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token response: %v", err)
+	}
+	if tokenResp.Error != "" {
+		return nil, fmt.Errorf("code exchange failed: %s: %s", tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tokenResp.IDToken == "" {
+		return nil, fmt.Errorf("code exchange failed: %s", resp.Status)
+	}
+	return s.validate(provider, tokenResp.IDToken, hs.Nonce)
+}
+
+// validate checks the signature and claims of an ID token, and returns its
+// claims.
+func (s *Scheme) validate(provider *providerConfig, idToken, nonce string) (map[string]interface{}, error) {
+	header, claims, signed, sig, err := parseJWT(idToken)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.key(provider, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != provider.Issuer {
+		return nil, fmt.Errorf("ID token issuer %q does not match %q", iss, provider.Issuer)
+	}
+	if !hasAudience(claims["aud"], s.config.ClientID) {
+		return nil, fmt.Errorf("ID token not issued to client %q", s.config.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || !time.Now().Before(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("ID token expired")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether an aud claim, either a string or an array of
+// strings, includes the client.
+func hasAudience(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, v := range aud {
+			if v == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
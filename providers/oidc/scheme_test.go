@@ -0,0 +1,364 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package oidc_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	stdtesting "testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/providers/oidc"
+)
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+var encoding = base64.URLEncoding.WithPadding(base64.NoPadding)
+
+// fakeIssuer is an in-process OpenID Connect identity provider.
+type fakeIssuer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+
+	mu    sync.Mutex
+	codes map[string]fakeGrant
+	// kid is the id of the key named in the ID tokens issued.
+	kid string
+	// keysBlocked, if not nil, is closed to complete requests for the key
+	// set, which are reported on keysRequested.
+	keysBlocked   chan struct{}
+	keysRequested chan struct{}
+}
+
+type fakeGrant struct {
+	challenge string
+	claims    map[string]interface{}
+	kid       string
+}
+
+func newFakeIssuer(c *C) *fakeIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+	f := &fakeIssuer{key: key, clientID: "affinity", secret: "s3cret", codes: make(map[string]fakeGrant), kid: "k1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.URL,
+			"authorization_endpoint": f.URL + "/authorize",
+			"token_endpoint":         f.URL + "/token",
+			"jwks_uri":               f.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		blocked, requested := f.keysBlocked, f.keysRequested
+		f.mu.Unlock()
+		if blocked != nil {
+			requested <- struct{}{}
+			<-blocked
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   encoding.EncodeToString(f.key.N.Bytes()),
+			"e":   encoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", f.token)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// authorize signs in a user with the given claims, in response to an
+// authorization request, and returns the authorization code.
+func (f *fakeIssuer) authorize(c *C, params url.Values, claims map[string]interface{}) string {
+	c.Assert(params.Get("client_id"), Equals, f.clientID)
+	c.Assert(params.Get("code_challenge_method"), Equals, "S256")
+	code := encoding.EncodeToString([]byte(params.Get("state")))
+	if _, ok := claims["nonce"]; !ok {
+		claims["nonce"] = params.Get("nonce")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.codes[code] = fakeGrant{challenge: params.Get("code_challenge"), claims: claims, kid: f.kid}
+	return code
+}
+
+func (f *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != f.clientID || secret != f.secret {
+		tokenError("invalid_client")
+		return
+	}
+	f.mu.Lock()
+	grant, ok := f.codes[r.FormValue("code")]
+	delete(f.codes, r.FormValue("code"))
+	f.mu.Unlock()
+	if !ok || r.FormValue("grant_type") != "authorization_code" {
+		tokenError("invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if encoding.EncodeToString(challenge[:]) != grant.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": f.sign(grant.kid, grant.claims)})
+}
+
+func (f *fakeIssuer) sign(kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + encoding.EncodeToString(sig)
+}
+
+func (f *fakeIssuer) claims(extra map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":            f.URL,
+		"sub":            "1138",
+		"aud":            f.clientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"email":          "fry@planetexpress.com",
+		"email_verified": true,
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	return claims
+}
+
+type OIDCSuite struct {
+	issuer *fakeIssuer
+	scheme *oidc.Scheme
+}
+
+var _ = Suite(&OIDCSuite{})
+
+func (s *OIDCSuite) SetUpSuite(c *C) {
+	s.issuer = newFakeIssuer(c)
+}
+
+func (s *OIDCSuite) TearDownSuite(c *C) {
+	s.issuer.Close()
+}
+
+func (s *OIDCSuite) newScheme(rules ...oidc.Rule) *oidc.Scheme {
+	return oidc.NewScheme(oidc.Config{
+		Name:         "oidc",
+		Issuer:       s.issuer.URL,
+		ClientID:     s.issuer.clientID,
+		ClientSecret: s.issuer.secret,
+		RedirectURL:  "https://affinity.example.com/callback",
+		Rules:        rules,
+	}, sessions.NewCookieStore(securecookie.GenerateRandomKey(32)))
+}
+
+func (s *OIDCSuite) SetUpTest(c *C) {
+	s.scheme = s.newScheme()
+}
+
+// signIn starts signing in, and returns the authorization request parameters
+// sent to the identity provider.
+func (s *OIDCSuite) signIn(c *C, scheme *oidc.Scheme) url.Values {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "https://affinity.example.com/login?next=planet-express", nil)
+	c.Assert(err, IsNil)
+	c.Assert(scheme.SignIn(w, r), IsNil)
+	c.Assert(w.Code, Equals, http.StatusSeeOther)
+	location, err := url.Parse(w.Header().Get("Location"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(location.String(), s.issuer.URL+"/authorize?"), Equals, true)
+	return location.Query()
+}
+
+// callback completes signing in, and returns the response.
+func (s *OIDCSuite) callback(c *C, scheme *oidc.Scheme, query url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "https://affinity.example.com/callback?"+query.Encode(), nil)
+	c.Assert(err, IsNil)
+	scheme.Authenticated(w, r)
+	return w
+}
+
+// authenticate authenticates a request with the session cookies set in a
+// response.
+func (s *OIDCSuite) authenticate(c *C, scheme *oidc.Scheme, w *httptest.ResponseRecorder) (affinity.Principal, error) {
+	r, err := http.NewRequest("GET", "https://affinity.example.com/", nil)
+	c.Assert(err, IsNil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	return scheme.Authenticate(r)
+}
+
+func (s *OIDCSuite) TestSignIn(c *C) {
+	_, err := s.authenticate(c, s.scheme, httptest.NewRecorder())
+	c.Check(err, Equals, affinity.ErrUnauthorized)
+
+	params := s.signIn(c, s.scheme)
+	c.Check(params.Get("redirect_uri"), Equals, "https://affinity.example.com/callback")
+	c.Check(params.Get("scope"), Equals, "openid email profile")
+	code := s.issuer.authorize(c, params, s.issuer.claims(nil))
+
+	w := s.callback(c, s.scheme, url.Values{"code": {code}, "state": {params.Get("state")}})
+	c.Assert(w.Code, Equals, http.StatusSeeOther)
+	c.Check(w.Header().Get("Location"), Equals, "/login?next=planet-express")
+	principal, err := s.authenticate(c, s.scheme, w)
+	c.Assert(err, IsNil)
+	c.Check(principal, Equals, affinity.MustParsePrincipal("oidc:fry@planetexpress.com"))
+
+	// Each sign in can only be completed once.
+	w = s.callback(c, s.scheme, url.Values{"code": {code}, "state": {params.Get("state")}})
+	c.Check(w.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *OIDCSuite) TestRules(c *C) {
+	rule, err := oidc.ParseRule("dex:sub")
+	c.Assert(err, IsNil)
+	scheme := s.newScheme(oidc.Rule{Scheme: "google", Claim: "email"}, rule)
+	for _, test := range []struct {
+		claims    map[string]interface{}
+		principal string
+	}{
+		{nil, "google:fry@planetexpress.com"},
+		// Unverified email addresses do not identify the user.
+		{map[string]interface{}{"email_verified": false}, "dex:1138"},
+		{map[string]interface{}{"email": nil}, "dex:1138"},
+	} {
+		params := s.signIn(c, scheme)
+		code := s.issuer.authorize(c, params, s.issuer.claims(test.claims))
+		w := s.callback(c, scheme, url.Values{"code": {code}, "state": {params.Get("state")}})
+		c.Assert(w.Code, Equals, http.StatusSeeOther)
+		principal, err := s.authenticate(c, scheme, w)
+		c.Assert(err, IsNil)
+		c.Check(principal.String(), Equals, test.principal)
+	}
+
+	_, err = oidc.ParseRule("sub")
+	c.Check(err, ErrorMatches, `invalid claim rule: "sub"`)
+}
+
+func (s *OIDCSuite) TestInvalidIDToken(c *C) {
+	for i, claims := range []map[string]interface{}{
+		{"iss": "https://momcorp.com"},
+		{"aud": "planet-express"},
+		{"exp": time.Now().Add(-time.Minute).Unix()},
+		{"nonce": "replayed"},
+		{"email_verified": false},
+	} {
+		params := s.signIn(c, s.scheme)
+		code := s.issuer.authorize(c, params, s.issuer.claims(claims))
+		w := s.callback(c, s.scheme, url.Values{"code": {code}, "state": {params.Get("state")}})
+		c.Check(w.Code, Equals, http.StatusUnauthorized, Commentf("%d: %v", i, claims))
+		_, err := s.authenticate(c, s.scheme, w)
+		c.Check(err, Equals, affinity.ErrUnauthorized)
+	}
+}
+
+func (s *OIDCSuite) TestInvalidCallback(c *C) {
+	params := s.signIn(c, s.scheme)
+	code := s.issuer.authorize(c, params, s.issuer.claims(nil))
+
+	// The code must be redeemed with the verifier of the sign in which
+	// requested it.
+	other := s.signIn(c, s.scheme)
+	w := s.callback(c, s.scheme, url.Values{"code": {code}, "state": {other.Get("state")}})
+	c.Check(w.Code, Equals, http.StatusUnauthorized)
+
+	w = s.callback(c, s.scheme, url.Values{"code": {code}, "state": {"bogus"}})
+	c.Check(w.Code, Equals, http.StatusUnauthorized)
+	w = s.callback(c, s.scheme, url.Values{"error": {"access_denied"}, "state": {params.Get("state")}})
+	c.Check(w.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *OIDCSuite) TestKeyFetchDoesNotBlock(c *C) {
+	params := s.signIn(c, s.scheme)
+	code := s.issuer.authorize(c, params, s.issuer.claims(nil))
+	w := s.callback(c, s.scheme, url.Values{"code": {code}, "state": {params.Get("state")}})
+	c.Assert(w.Code, Equals, http.StatusSeeOther)
+
+	// An ID token signed with an unknown key makes the key set be fetched
+	// again, which the identity provider is slow to answer.
+	s.issuer.mu.Lock()
+	s.issuer.kid = "k2"
+	s.issuer.mu.Unlock()
+	unknown := s.signIn(c, s.scheme)
+	unknownCode := s.issuer.authorize(c, unknown, s.issuer.claims(nil))
+	s.issuer.mu.Lock()
+	s.issuer.kid = "k1"
+	s.issuer.keysBlocked = make(chan struct{})
+	s.issuer.keysRequested = make(chan struct{}, 1)
+	blocked, requested := s.issuer.keysBlocked, s.issuer.keysRequested
+	s.issuer.mu.Unlock()
+	defer func() {
+		s.issuer.mu.Lock()
+		s.issuer.keysBlocked, s.issuer.keysRequested = nil, nil
+		s.issuer.mu.Unlock()
+	}()
+	fetched := make(chan int)
+	go func() {
+		w := s.callback(c, s.scheme, url.Values{"code": {unknownCode}, "state": {unknown.Get("state")}})
+		fetched <- w.Code
+	}()
+	<-requested
+
+	// Meanwhile, sign ins with known keys complete.
+	signedIn := make(chan int)
+	go func() {
+		params := s.signIn(c, s.scheme)
+		code := s.issuer.authorize(c, params, s.issuer.claims(nil))
+		w := s.callback(c, s.scheme, url.Values{"code": {code}, "state": {params.Get("state")}})
+		signedIn <- w.Code
+	}()
+	select {
+	case status := <-signedIn:
+		c.Check(status, Equals, http.StatusSeeOther)
+	case <-time.After(5 * time.Second):
+		c.Error("sign in blocked by fetching keys")
+	}
+	close(blocked)
+	c.Check(<-fetched, Equals, http.StatusUnauthorized)
+}
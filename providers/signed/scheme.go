@@ -0,0 +1,388 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package signed provides a TokenScheme of self-contained, signed tokens.
+// A token carries the principal it authenticates, its expiry and any caveats
+// limiting its use, and is validated offline by checking its signature,
+// without any storage lookup.
+//
+// Ed25519 keys use the standard library's crypto/ed25519, which requires
+// Go 1.13 or later.
+package signed
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/affinity"
+)
+
+const (
+	// SchemeName is the name of the signed token scheme.
+	SchemeName = "signed"
+
+	// DefaultTTL is the lifetime of tokens created by Authorize.
+	DefaultTTL = 24 * time.Hour
+
+	// ScopeCaveat limits a token to a comma-separated list of permission
+	// names, which is empty to allow no permissions. It is checked by the
+	// scheme itself.
+	ScopeCaveat = "scope"
+)
+
+var encoding = base64.URLEncoding.WithPadding(base64.NoPadding)
+
+// Key signs and verifies tokens. Keys are identified, so that a token names
+// the key which verifies it.
+type Key struct {
+	Id      string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// NewHMACKey creates a key which signs and verifies tokens with HMAC-SHA256,
+// using a shared secret.
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{Id: id, secret: secret}
+}
+
+// NewEd25519Key creates a key which signs tokens with an Ed25519 private key,
+// and verifies them with its public key.
+func NewEd25519Key(id string, private ed25519.PrivateKey) *Key {
+	return &Key{Id: id, private: private, public: private.Public().(ed25519.PublicKey)}
+}
+
+// NewEd25519VerifyKey creates a key which only verifies tokens, with an
+// Ed25519 public key.
+func NewEd25519VerifyKey(id string, public ed25519.PublicKey) *Key {
+	return &Key{Id: id, public: public}
+}
+
+// CanSign reports whether the key can sign tokens.
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *Key) sign(msg []byte) ([]byte, error) {
+	switch {
+	case k.secret != nil:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(msg)
+		return mac.Sum(nil), nil
+	case k.private != nil:
+		return ed25519.Sign(k.private, msg), nil
+	}
+	return nil, fmt.Errorf("key %q cannot sign", k.Id)
+}
+
+func (k *Key) verify(msg, sig []byte) bool {
+	switch {
+	case k.secret != nil:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(msg)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case k.public != nil:
+		return ed25519.Verify(k.public, msg, sig)
+	}
+	return false
+}
+
+// Caveat is a condition which must hold for a token to be valid.
+type Caveat struct {
+	Name  string `json:"n"`
+	Value string `json:"v"`
+}
+
+// CaveatChecker checks the value of a caveat, returning an error if it does
+// not hold.
+type CaveatChecker func(value string) error
+
+// claims is the signed content of a token.
+type claims struct {
+	Principal string   `json:"p"`
+	Issued    int64    `json:"iat"`
+	Expires   int64    `json:"exp"`
+	Caveats   []Caveat `json:"c,omitempty"`
+}
+
+// Scheme issues and validates signed tokens. Tokens are signed by the current
+// signing key, and verified by any of the active verification keys, so that
+// keys can be rotated without invalidating tokens signed by a prior key.
+type Scheme struct {
+	mu       sync.RWMutex
+	signing  *Key
+	verify   map[string]*Key
+	checkers map[string]CaveatChecker
+}
+
+// NewScheme creates a signed token scheme which signs with the given key, if
+// it is able to sign, and verifies with it and any other keys given.
+func NewScheme(signing *Key, verify ...*Key) *Scheme {
+	s := &Scheme{
+		verify:   make(map[string]*Key),
+		checkers: make(map[string]CaveatChecker),
+	}
+	if signing.CanSign() {
+		s.signing = signing
+	}
+	s.verify[signing.Id] = signing
+	for _, key := range verify {
+		s.verify[key.Id] = key
+	}
+	return s
+}
+
+func (s *Scheme) Name() string { return SchemeName }
+
+// Rotate signs new tokens with a new key. Prior keys remain active for
+// verification until they are retired.
+func (s *Scheme) Rotate(signing *Key) error {
+	if !signing.CanSign() {
+		return fmt.Errorf("key %q cannot sign", signing.Id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signing = signing
+	s.verify[signing.Id] = signing
+	return nil
+}
+
+// AddKey activates a key for verifying tokens.
+func (s *Scheme) AddKey(key *Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verify[key.Id] = key
+}
+
+// Retire deactivates a key, so that tokens it signed no longer validate. The
+// current signing key cannot be retired.
+func (s *Scheme) Retire(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signing != nil && s.signing.Id == id {
+		return fmt.Errorf("cannot retire signing key %q", id)
+	}
+	delete(s.verify, id)
+	return nil
+}
+
+// RegisterCaveat sets the checker for caveats of the given name. Tokens with
+// caveats that have no checker do not validate.
+func (s *Scheme) RegisterCaveat(name string, checker CaveatChecker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkers[name] = checker
+}
+
+func (s *Scheme) Authenticate(r *http.Request) (affinity.Principal, error) {
+	return affinity.AuthRequestToken(s, r)
+}
+
+// Authorize issues a token for a principal, which expires after DefaultTTL.
+// The principal is not authenticated here; callers must only issue tokens to
+// principals which have otherwise proven their identity.
+func (s *Scheme) Authorize(principal affinity.Principal) (*affinity.TokenInfo, error) {
+	return s.Issue(principal, DefaultTTL)
+}
+
+// Issue issues a token for a principal, which expires after ttl and is
+// limited by any caveats given.
+func (s *Scheme) Issue(principal affinity.Principal, ttl time.Duration, caveats ...Caveat) (*affinity.TokenInfo, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid token lifetime: %v", ttl)
+	}
+	s.mu.RLock()
+	signing := s.signing
+	s.mu.RUnlock()
+	if signing == nil {
+		return nil, fmt.Errorf("no signing key")
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(&claims{
+		Principal: principal.String(),
+		Issued:    now.Unix(),
+		Expires:   now.Add(ttl).Unix(),
+		Caveats:   caveats,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encPayload := encoding.EncodeToString(payload)
+	sig, err := signing.sign(signedContent(signing.Id, encPayload))
+	if err != nil {
+		return nil, err
+	}
+	return &affinity.TokenInfo{
+		Scheme: SchemeName,
+		Values: url.Values{
+			"kid":     []string{signing.Id},
+			"payload": []string{encPayload},
+			"sig":     []string{encoding.EncodeToString(sig)},
+		},
+	}, nil
+}
+
+// signedContent returns the content signed for a token, which binds the
+// payload to the key that signed it.
+func signedContent(kid, encPayload string) []byte {
+	return []byte(kid + "." + encPayload)
+}
+
+// Validate checks the signature, expiry and caveats of a token, and returns
+// the principal it authenticates.
+func (s *Scheme) Validate(token *affinity.TokenInfo) (affinity.Principal, error) {
+	c, err := s.validate(token)
+	if err != nil {
+		return affinity.Principal{}, err
+	}
+	return affinity.ParsePrincipal(c.Principal)
+}
+
+func (s *Scheme) validate(token *affinity.TokenInfo) (*claims, error) {
+	if token.Scheme != SchemeName {
+		return nil, fmt.Errorf("not a signed token: %q", token.Scheme)
+	}
+	kid, encPayload := token.Values.Get("kid"), token.Values.Get("payload")
+	sig, err := encoding.DecodeString(token.Values.Get("sig"))
+	if err != nil || kid == "" || encPayload == "" {
+		return nil, fmt.Errorf("malformed signed token")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.verify[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown token key %q", kid)
+	}
+	if !key.verify(signedContent(kid, encPayload), sig) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	payload, err := encoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signed token")
+	}
+	var c claims
+	err = json.Unmarshal(payload, &c)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signed token")
+	}
+	if !time.Now().Before(time.Unix(c.Expires, 0)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	for _, caveat := range c.Caveats {
+		if caveat.Name == ScopeCaveat {
+			continue
+		}
+		checker, ok := s.checkers[caveat.Name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported caveat %q", caveat.Name)
+		}
+		if err := checker(caveat.Value); err != nil {
+			return nil, fmt.Errorf("caveat %q not satisfied: %v", caveat.Name, err)
+		}
+	}
+	return &c, nil
+}
+
+// Expires returns the expiration of the signed token authenticating a
+// request.
+func (s *Scheme) Expires(r *http.Request) (time.Time, error) {
+	for _, auth := range r.Header[http.CanonicalHeaderKey("Authorization")] {
+		token, err := affinity.ParseTokenInfo(auth)
+		if err != nil || token.Scheme != SchemeName {
+			continue
+		}
+		c, err := s.validate(token)
+		if err != nil {
+			continue
+		}
+		return time.Unix(c.Expires, 0), nil
+	}
+	return time.Time{}, affinity.ErrUnauthorized
+}
+
+// Scope returns the permissions to which the signed token authenticating a
+// request is limited by its scope caveats. A token with several scope caveats
+// is limited to the permissions common to all of them.
+func (s *Scheme) Scope(r *http.Request) ([]string, error) {
+	for _, auth := range r.Header[http.CanonicalHeaderKey("Authorization")] {
+		token, err := affinity.ParseTokenInfo(auth)
+		if err != nil || token.Scheme != SchemeName {
+			continue
+		}
+		c, err := s.validate(token)
+		if err != nil {
+			continue
+		}
+		var scope []string
+		limited := false
+		for _, caveat := range c.Caveats {
+			if caveat.Name != ScopeCaveat {
+				continue
+			}
+			perms := scopePerms(caveat.Value)
+			if limited {
+				perms = intersect(scope, perms)
+			}
+			scope, limited = perms, true
+		}
+		if limited && scope == nil {
+			scope = []string{}
+		}
+		return scope, nil
+	}
+	return nil, affinity.ErrUnauthorized
+}
+
+// scopePerms returns the permission names listed in a scope caveat. An empty
+// caveat lists none.
+func scopePerms(value string) []string {
+	perms := []string{}
+	for _, perm := range strings.Split(value, ",") {
+		if perm = strings.TrimSpace(perm); perm != "" {
+			perms = append(perms, perm)
+		}
+	}
+	return perms
+}
+
+// intersect returns the strings in both a and b, in the order of a.
+func intersect(a, b []string) []string {
+	in := make(map[string]bool)
+	for _, v := range b {
+		in[v] = true
+	}
+	var result []string
+	for _, v := range a {
+		if in[v] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,206 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package signed_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	stdtesting "testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity"
+	"github.com/juju/affinity/providers/signed"
+)
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+type SignedSuite struct {
+	fry affinity.Principal
+}
+
+var _ = Suite(&SignedSuite{})
+
+func (s *SignedSuite) SetUpTest(c *C) {
+	s.fry = affinity.MustParsePrincipal("usso:fry@planetexpress.com")
+}
+
+func newEd25519Key(c *C, id string) *signed.Key {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	return signed.NewEd25519Key(id, private)
+}
+
+func authRequest(c *C, tokenInfo *affinity.TokenInfo) *http.Request {
+	r, err := http.NewRequest("GET", "http://example.com/", nil)
+	c.Assert(err, IsNil)
+	r.Header.Set("Authorization", tokenInfo.Serialize())
+	return r
+}
+
+func (s *SignedSuite) TestAuthorizeValidate(c *C) {
+	for _, key := range []*signed.Key{
+		signed.NewHMACKey("hmac", []byte("bite my shiny metal secret")),
+		newEd25519Key(c, "ed25519"),
+	} {
+		scheme := signed.NewScheme(key)
+		tokenInfo, err := scheme.Authorize(s.fry)
+		c.Assert(err, IsNil)
+		c.Check(tokenInfo.Scheme, Equals, signed.SchemeName)
+
+		// Tokens survive serialization, as stored by the client.
+		parsed, err := affinity.ParseTokenInfo(tokenInfo.Serialize())
+		c.Assert(err, IsNil)
+		user, err := scheme.Validate(parsed)
+		c.Assert(err, IsNil, Commentf("%s", key.Id))
+		c.Check(user, Equals, s.fry)
+
+		user, err = scheme.Authenticate(authRequest(c, tokenInfo))
+		c.Assert(err, IsNil)
+		c.Check(user, Equals, s.fry)
+	}
+}
+
+func (s *SignedSuite) TestVerifyOnly(c *C) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	issuer := signed.NewScheme(signed.NewEd25519Key("k1", private))
+	verifier := signed.NewScheme(signed.NewEd25519VerifyKey("k1", private.Public().(ed25519.PublicKey)))
+
+	tokenInfo, err := issuer.Authorize(s.fry)
+	c.Assert(err, IsNil)
+	user, err := verifier.Validate(tokenInfo)
+	c.Assert(err, IsNil)
+	c.Check(user, Equals, s.fry)
+
+	_, err = verifier.Authorize(s.fry)
+	c.Check(err, ErrorMatches, "no signing key")
+}
+
+func (s *SignedSuite) TestInvalid(c *C) {
+	scheme := signed.NewScheme(signed.NewHMACKey("k1", []byte("secret")))
+	tokenInfo, err := scheme.Authorize(s.fry)
+	c.Assert(err, IsNil)
+
+	// A token signed by another key with the same id does not validate.
+	other := signed.NewScheme(signed.NewHMACKey("k1", []byte("other secret")))
+	_, err = other.Validate(tokenInfo)
+	c.Check(err, ErrorMatches, "invalid token signature")
+
+	// Tampering with the payload invalidates the signature.
+	otherInfo, err := other.Authorize(affinity.MustParsePrincipal("usso:bender@planetexpress.com"))
+	c.Assert(err, IsNil)
+	tokenInfo.Values.Set("payload", otherInfo.Values.Get("payload"))
+	_, err = scheme.Validate(tokenInfo)
+	c.Check(err, ErrorMatches, "invalid token signature")
+
+	_, err = scheme.Validate(&affinity.TokenInfo{Scheme: signed.SchemeName})
+	c.Check(err, ErrorMatches, "malformed signed token")
+
+	_, err = scheme.Issue(s.fry, -time.Hour)
+	c.Check(err, ErrorMatches, "invalid token lifetime.*")
+}
+
+func (s *SignedSuite) TestExpired(c *C) {
+	scheme := signed.NewScheme(signed.NewHMACKey("k1", []byte("secret")))
+	tokenInfo, err := scheme.Issue(s.fry, time.Nanosecond)
+	c.Assert(err, IsNil)
+	time.Sleep(time.Second)
+	_, err = scheme.Validate(tokenInfo)
+	c.Check(err, ErrorMatches, "token expired")
+}
+
+func (s *SignedSuite) TestRotate(c *C) {
+	scheme := signed.NewScheme(newEd25519Key(c, "k1"))
+	oldToken, err := scheme.Authorize(s.fry)
+	c.Assert(err, IsNil)
+
+	c.Assert(scheme.Rotate(newEd25519Key(c, "k2")), IsNil)
+	newToken, err := scheme.Authorize(s.fry)
+	c.Assert(err, IsNil)
+	c.Check(newToken.Values.Get("kid"), Equals, "k2")
+
+	// Tokens signed by either key validate until the old key is retired.
+	for _, tokenInfo := range []*affinity.TokenInfo{oldToken, newToken} {
+		_, err = scheme.Validate(tokenInfo)
+		c.Check(err, IsNil)
+	}
+	c.Assert(scheme.Retire("k1"), IsNil)
+	_, err = scheme.Validate(oldToken)
+	c.Check(err, ErrorMatches, `unknown token key "k1"`)
+	_, err = scheme.Validate(newToken)
+	c.Check(err, IsNil)
+
+	c.Check(scheme.Retire("k2"), ErrorMatches, `cannot retire signing key "k2"`)
+	c.Check(scheme.Rotate(signed.NewEd25519VerifyKey("k3", nil)), ErrorMatches, `key "k3" cannot sign`)
+}
+
+func (s *SignedSuite) TestCaveats(c *C) {
+	scheme := signed.NewScheme(signed.NewHMACKey("k1", []byte("secret")))
+	tokenInfo, err := scheme.Issue(s.fry, time.Hour, signed.Caveat{Name: "service", Value: "planet-express"})
+	c.Assert(err, IsNil)
+
+	// Caveats without a checker are not satisfied.
+	_, err = scheme.Validate(tokenInfo)
+	c.Check(err, ErrorMatches, `unsupported caveat "service"`)
+
+	service := "mom-corp"
+	scheme.RegisterCaveat("service", func(value string) error {
+		if value != service {
+			return fmt.Errorf("not valid for %q", service)
+		}
+		return nil
+	})
+	_, err = scheme.Validate(tokenInfo)
+	c.Check(err, ErrorMatches, `caveat "service" not satisfied: not valid for "mom-corp"`)
+	service = "planet-express"
+	user, err := scheme.Validate(tokenInfo)
+	c.Assert(err, IsNil)
+	c.Check(user, Equals, s.fry)
+}
+
+func (s *SignedSuite) TestScope(c *C) {
+	scheme := signed.NewScheme(signed.NewHMACKey("k1", []byte("secret")))
+	for _, test := range []struct {
+		caveats []signed.Caveat
+		scope   []string
+	}{
+		{nil, nil},
+		{[]signed.Caveat{{signed.ScopeCaveat, "check-member,add-member"}}, []string{"check-member", "add-member"}},
+		{[]signed.Caveat{{signed.ScopeCaveat, " check-member, add-member ,"}}, []string{"check-member", "add-member"}},
+		{[]signed.Caveat{{signed.ScopeCaveat, ""}}, []string{}},
+		{[]signed.Caveat{{signed.ScopeCaveat, " , "}}, []string{}},
+		{[]signed.Caveat{
+			{signed.ScopeCaveat, "check-member,add-member"},
+			{signed.ScopeCaveat, "add-member,remove-member"},
+		}, []string{"add-member"}},
+		{[]signed.Caveat{
+			{signed.ScopeCaveat, "check-member"},
+			{signed.ScopeCaveat, "add-member"},
+		}, []string{}},
+	} {
+		tokenInfo, err := scheme.Issue(s.fry, time.Hour, test.caveats...)
+		c.Assert(err, IsNil)
+		scope, err := scheme.Scope(authRequest(c, tokenInfo))
+		c.Assert(err, IsNil)
+		c.Check(scope, DeepEquals, test.scope, Commentf("%v", test.caveats))
+	}
+}
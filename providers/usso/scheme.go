@@ -52,11 +52,19 @@ type handshakeScheme struct {
 // redirectHost is "", OpenID redirects will use the same hostname as the
 // request.
 func NewOpenIdWeb(token string, redirectHost string, sessionStore sessions.Store) affinity.HandshakeScheme {
+	return NewOpenIdWebStore(token, redirectHost, sessionStore,
+		common.NewMemHandshakeStore(common.DefaultMaxHandshakes))
+}
+
+// NewOpenIdWebStore creates a new Ubuntu SSO OpenID authentication helper,
+// which keeps handshake state in the given store. Servers sharing a store can
+// complete each other's OpenID callbacks.
+func NewOpenIdWebStore(token string, redirectHost string, sessionStore sessions.Store, handshakes common.HandshakeStore) affinity.HandshakeScheme {
 	return &handshakeScheme{
 		scheme: scheme{
 			token: token,
 		},
-		openID: common.NewSimpleOpenID(token, redirectHost, sessionStore),
+		openID: common.NewOpenID(token, redirectHost, sessionStore, handshakes),
 	}
 }
 
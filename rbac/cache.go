@@ -0,0 +1,315 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rbac
+
+// This file contains a caching wrapper around Access.
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/affinity"
+)
+
+const (
+	// DefaultCacheSize is the default number of entries kept by each
+	// cache of a CachedAccess.
+	DefaultCacheSize = 10000
+	// DefaultCacheTTL is the default time for which a CachedAccess keeps
+	// an entry.
+	DefaultCacheTTL = time.Minute
+)
+
+// CacheStats counts the use of a cache.
+type CacheStats struct {
+	// Hits is the number of lookups answered from the cache.
+	Hits uint64
+	// Misses is the number of lookups not found in the cache, or found
+	// expired.
+	Misses uint64
+	// Evictions is the number of entries removed to make room for others.
+	Evictions uint64
+	// Entries is the number of entries in the cache.
+	Entries int
+}
+
+// CachedAccessStats counts the use of the caches of a CachedAccess.
+type CachedAccessStats struct {
+	// Groups counts the use of the cached group closures of subjects.
+	Groups CacheStats
+	// Decisions counts the use of the cached results of Can.
+	Decisions CacheStats
+	// Invalidations is the number of times the caches were cleared.
+	Invalidations uint64
+}
+
+// CachedAccess is an Access which caches the groups each subject belongs to,
+// and the decisions made by Can. Entries are kept for a bounded time, and no
+// longer than the facts they were derived from hold. The least recently used
+// entries are evicted when a cache is full.
+//
+// The caches are cleared when grants, denials or group memberships change
+// through the FactStore returned by Store, or through the Admin returned by
+// Admin. Changes made by other processes are observed once the affected
+// entries expire.
+type CachedAccess struct {
+	*Access
+	store FactStore
+	ttl   time.Duration
+
+	mu            sync.Mutex
+	groups        *lruCache
+	decisions     *lruCache
+	generation    uint64
+	invalidations uint64
+}
+
+// NewCachedAccess creates a CachedAccess over the given store, keeping at
+// most size entries in each cache for at most ttl. A size or ttl of zero
+// uses DefaultCacheSize or DefaultCacheTTL.
+func NewCachedAccess(store FactStore, roles RoleMap, size int, ttl time.Duration) *CachedAccess {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	c := &CachedAccess{
+		Access:    NewAccess(store, roles),
+		ttl:       ttl,
+		groups:    newLRUCache(size),
+		decisions: newLRUCache(size),
+	}
+	c.store = &invalidatingStore{FactStore: store, cache: c}
+	return c
+}
+
+// Store returns the underlying FactStore, which clears the caches when facts
+// affecting access are asserted or denied through it.
+func (c *CachedAccess) Store() FactStore {
+	return c.store
+}
+
+// Admin returns an Admin whose changes clear the caches.
+func (c *CachedAccess) Admin() *Admin {
+	return NewAdmin(c.store, c.Roles)
+}
+
+// Invalidate clears the caches.
+func (c *CachedAccess) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateLocked()
+}
+
+func (c *CachedAccess) invalidateLocked() {
+	c.groups.clear()
+	c.decisions.clear()
+	c.generation++
+	c.invalidations++
+}
+
+// invalidate clears the caches if any of the facts affect access.
+func (c *CachedAccess) invalidate(facts ...Fact) {
+	for _, fact := range facts {
+		switch fact.Topic {
+		case groupTopic, rbacTopic, rbacDenyTopic:
+			c.Invalidate()
+			return
+		}
+	}
+}
+
+// Stats returns the hit and miss statistics of the caches.
+func (c *CachedAccess) Stats() CachedAccessStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	groups, decisions := c.groups.stats, c.decisions.stats
+	groups.Entries = c.groups.order.Len()
+	decisions.Entries = c.decisions.order.Len()
+	return CachedAccessStats{
+		Groups:        groups,
+		Decisions:     decisions,
+		Invalidations: c.invalidations,
+	}
+}
+
+// Can tests if the principal's granted roles provide a permission on a given
+// resource or its container, as Access.Can does, answering from the cache
+// where possible.
+func (c *CachedAccess) Can(pr affinity.Principal, pm Permission, r Resource) (bool, error) {
+	if _, supported := r.Capabilities()[pm.Perm()]; !supported {
+		return false, nil
+	}
+	key := []string{pr.String(), pm.Perm()}
+	for rc := r; rc != nil; rc = rc.Parent() {
+		key = append(key, rc.URI())
+	}
+	decisionKey := strings.Join(key, "\x00")
+
+	c.mu.Lock()
+	value, ok := c.decisions.get(decisionKey, time.Now())
+	generation := c.generation
+	c.mu.Unlock()
+	if ok {
+		return value.(bool), nil
+	}
+
+	subjects, expires, err := c.closure(pr.String())
+	if err != nil {
+		return false, err
+	}
+	can, factExpires, err := c.Access.can(subjects, pm, r)
+	if err != nil {
+		return false, err
+	}
+	c.put(c.decisions, generation, decisionKey, can, earliest(expires, factExpires))
+	return can, nil
+}
+
+// groupClosure is a subject and all the groups containing it.
+type groupClosure struct {
+	subjects []string
+	expires  time.Time
+}
+
+// closure returns a subject and all the groups containing it, as
+// GroupFacts.closure does, answering from the cache where possible.
+func (c *CachedAccess) closure(subject string) ([]string, time.Time, error) {
+	c.mu.Lock()
+	value, ok := c.groups.get(subject, time.Now())
+	generation := c.generation
+	c.mu.Unlock()
+	if ok {
+		closure := value.(*groupClosure)
+		return closure.subjects, closure.expires, nil
+	}
+
+	subjects, expires, err := c.facts.closure(subject)
+	if err != nil {
+		return nil, expires, err
+	}
+	c.put(c.groups, generation, subject, &groupClosure{subjects, expires}, expires)
+	return subjects, expires, nil
+}
+
+// put adds an entry to a cache, unless the caches were cleared since the
+// entry was looked up. The entry expires after the TTL, or when the facts it
+// was derived from expire, if sooner.
+func (c *CachedAccess) put(cache *lruCache, generation uint64, key string, value interface{}, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	cache.put(key, value, earliest(time.Now().Add(c.ttl), expires))
+}
+
+// invalidatingStore clears the caches of a CachedAccess when facts affecting
+// access are changed through it.
+type invalidatingStore struct {
+	FactStore
+	cache *CachedAccess
+}
+
+func (s *invalidatingStore) Assert(facts ...Fact) error {
+	defer s.cache.invalidate(facts...)
+	return s.FactStore.Assert(facts...)
+}
+
+func (s *invalidatingStore) Deny(facts ...Fact) error {
+	defer s.cache.invalidate(facts...)
+	return s.FactStore.Deny(facts...)
+}
+
+func (s *invalidatingStore) Apply(changes ...Change) error {
+	facts := make([]Fact, len(changes))
+	for i := range changes {
+		facts[i] = changes[i].Fact
+	}
+	defer s.cache.invalidate(facts...)
+	return s.FactStore.Apply(changes...)
+}
+
+func (s *invalidatingStore) Insert(fact Fact) (bool, error) {
+	defer s.cache.invalidate(fact)
+	return s.FactStore.Insert(fact)
+}
+
+// lruCache is a bounded map of expiring entries, which evicts the least
+// recently used entry when full. It is not safe for concurrent use.
+type lruCache struct {
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	stats   CacheStats
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache) get(key string, now time.Time) (interface{}, bool) {
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if !now.Before(entry.expires) {
+		c.remove(elem)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	c.stats.Hits++
+	return entry.value, true
+}
+
+func (c *lruCache) put(key string, value interface{}, expires time.Time) {
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.order.Len() >= c.size {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value, expires})
+}
+
+func (c *lruCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*lruEntry).key)
+	c.order.Remove(elem)
+}
+
+func (c *lruCache) clear() {
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
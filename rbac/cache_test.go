@@ -0,0 +1,207 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rbac_test
+
+import (
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	. "github.com/juju/affinity"
+	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/rbac/storage/mem"
+)
+
+func TestCacheSuite(t *testing.T) { TestingT(t) }
+
+type CacheSuite struct {
+	store  rbac.FactStore
+	access *rbac.CachedAccess
+	admin  *rbac.Admin
+	facts  *rbac.GroupFacts
+}
+
+var _ = Suite(&CacheSuite{})
+
+var (
+	alice = MustParsePrincipal("test:alice")
+	board = rbac.NewPathResource("message-board:/general/announcements",
+		ReadPerm, ListPerm, PostPerm, DeletePerm, StickyPerm, BanPerm)
+)
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	s.store = mem.NewFactStore()
+	s.access = rbac.NewCachedAccess(s.store, MessageBoardRoles, 0, 0)
+	s.admin = s.access.Admin()
+	s.facts = rbac.NewGroupFacts(s.access.Store())
+}
+
+func (s *CacheSuite) checkCan(c *C, pr Principal, pm rbac.Permission, expect bool) {
+	can, err := s.access.Can(pr, pm, board)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, expect, Commentf("%s %s", pr.String(), pm.Perm()))
+}
+
+func (s *CacheSuite) TestCachedDecision(c *C) {
+	err := s.admin.Grant(alice, LurkerRole, board)
+	c.Assert(err, IsNil)
+
+	s.checkCan(c, alice, ReadPerm, true)
+	s.checkCan(c, alice, ReadPerm, true)
+	s.checkCan(c, alice, PostPerm, false)
+	stats := s.access.Stats()
+	c.Check(stats.Decisions.Hits, Equals, uint64(1))
+	c.Check(stats.Decisions.Misses, Equals, uint64(2))
+	c.Check(stats.Decisions.Entries, Equals, 2)
+	c.Check(stats.Groups.Hits, Equals, uint64(1))
+	c.Check(stats.Groups.Misses, Equals, uint64(1))
+	c.Check(stats.Groups.Entries, Equals, 1)
+
+	// Unsupported permissions are not cached.
+	can, err := s.access.Can(alice, rbac.NewPermission("unsupported"), board)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, false)
+	c.Check(s.access.Stats().Decisions.Entries, Equals, 2)
+}
+
+func (s *CacheSuite) TestInvalidateOnChange(c *C) {
+	s.checkCan(c, alice, PostPerm, false)
+
+	err := s.admin.Grant(alice, PosterRole, board)
+	c.Assert(err, IsNil)
+	c.Check(s.access.Stats().Invalidations, Equals, uint64(1))
+	s.checkCan(c, alice, PostPerm, true)
+
+	err = s.admin.Deny(alice, PosterRole, rbac.NewPathResource("message-board:/general", PostPerm))
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, PostPerm, false)
+
+	err = s.admin.RevokeDeny(alice, PosterRole, rbac.NewPathResource("message-board:/general", PostPerm))
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, PostPerm, true)
+
+	// Facts on other topics do not affect access.
+	invalidations := s.access.Stats().Invalidations
+	err = s.access.Store().Assert(rbac.Fact{Topic: "other", Subject: "a", Predicate: "b", Object: "c"})
+	c.Assert(err, IsNil)
+	c.Check(s.access.Stats().Invalidations, Equals, invalidations)
+}
+
+func (s *CacheSuite) TestGroupMembership(c *C) {
+	mods := MustParsePrincipal("test:mods")
+	staff := MustParsePrincipal("test:staff")
+	err := s.admin.Grant(staff, ModeratorRole, board)
+	c.Assert(err, IsNil)
+	err = s.facts.AddMember(staff.String(), mods.String())
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, BanPerm, false)
+
+	err = s.facts.AddMember(mods.String(), alice.String())
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, BanPerm, true)
+
+	err = s.facts.RemoveMember(mods.String(), alice.String())
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, BanPerm, false)
+}
+
+func (s *CacheSuite) TestChangeElsewhere(c *C) {
+	s.checkCan(c, alice, ReadPerm, false)
+
+	// Changes not made through the cache are observed once invalidated.
+	err := rbac.NewAdmin(s.store, MessageBoardRoles).Grant(alice, LurkerRole, board)
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, ReadPerm, false)
+	s.access.Invalidate()
+	s.checkCan(c, alice, ReadPerm, true)
+}
+
+func (s *CacheSuite) TestTTL(c *C) {
+	s.access = rbac.NewCachedAccess(s.store, MessageBoardRoles, 0, 50*time.Millisecond)
+	s.checkCan(c, alice, ReadPerm, false)
+
+	err := rbac.NewAdmin(s.store, MessageBoardRoles).Grant(alice, LurkerRole, board)
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, ReadPerm, false)
+	time.Sleep(100 * time.Millisecond)
+	s.checkCan(c, alice, ReadPerm, true)
+}
+
+func (s *CacheSuite) TestGrantExpires(c *C) {
+	err := s.admin.GrantUntil(alice, LurkerRole, board, time.Now().Add(50*time.Millisecond))
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, ReadPerm, true)
+	time.Sleep(100 * time.Millisecond)
+	s.checkCan(c, alice, ReadPerm, false)
+}
+
+func (s *CacheSuite) TestMembershipExpires(c *C) {
+	mods := MustParsePrincipal("test:mods")
+	err := s.admin.Grant(mods, ModeratorRole, board)
+	c.Assert(err, IsNil)
+	err = s.access.Store().Assert(rbac.Fact{
+		Topic:     "affinity:groups",
+		Subject:   alice.String(),
+		Predicate: rbac.MemberOf,
+		Object:    mods.String(),
+		Expires:   time.Now().Add(50 * time.Millisecond),
+	})
+	c.Assert(err, IsNil)
+	s.checkCan(c, alice, BanPerm, true)
+	time.Sleep(100 * time.Millisecond)
+	s.checkCan(c, alice, BanPerm, false)
+}
+
+func (s *CacheSuite) TestEviction(c *C) {
+	s.access = rbac.NewCachedAccess(s.store, MessageBoardRoles, 2, 0)
+	for _, pm := range []rbac.Permission{ReadPerm, ListPerm, PostPerm} {
+		s.checkCan(c, alice, pm, false)
+	}
+	stats := s.access.Stats()
+	c.Check(stats.Decisions.Entries, Equals, 2)
+	c.Check(stats.Decisions.Evictions, Equals, uint64(1))
+
+	// The least recently used decision was evicted.
+	s.checkCan(c, alice, PostPerm, false)
+	s.checkCan(c, alice, ListPerm, false)
+	c.Check(s.access.Stats().Decisions.Hits, Equals, uint64(2))
+	s.checkCan(c, alice, ReadPerm, false)
+	c.Check(s.access.Stats().Decisions.Misses, Equals, uint64(4))
+}
+
+func (s *CacheSuite) TestMatchesAccess(c *C) {
+	staff := MustParsePrincipal("test:staff")
+	bob := MustParsePrincipal("test:bob")
+	err := s.admin.Grant(staff, PosterRole, rbac.NewPathResource("message-board:/general", PostPerm))
+	c.Assert(err, IsNil)
+	err = s.admin.Deny(bob, PosterRole, board)
+	c.Assert(err, IsNil)
+	for _, member := range []Principal{alice, bob} {
+		err = s.facts.AddMember(staff.String(), member.String())
+		c.Assert(err, IsNil)
+	}
+	access := rbac.NewAccess(s.store, MessageBoardRoles)
+	for _, pr := range []Principal{alice, bob, staff} {
+		for _, pm := range []rbac.Permission{ReadPerm, PostPerm, BanPerm} {
+			expect, err := access.Can(pr, pm, board)
+			c.Assert(err, IsNil)
+			s.checkCan(c, pr, pm, expect)
+		}
+	}
+}
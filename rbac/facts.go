@@ -17,10 +17,23 @@
 
 package rbac
 
+import (
+	"fmt"
+	"time"
+)
+
 // Fact is a statement that can be asserted in a knowledge base.
 type Fact struct {
 	Topic                      string
 	Subject, Predicate, Object string
+	// Expires is the time at which the fact no longer holds. The zero value
+	// never expires. Expires is not part of the fact's identity.
+	Expires time.Time
+}
+
+// Expired reports whether the fact no longer holds at the given time.
+func (f Fact) Expired(now time.Time) bool {
+	return !f.Expires.IsZero() && !now.Before(f.Expires)
 }
 
 // Matches reports whether a fact matches a concrete fact as a pattern.  Empty
@@ -32,18 +45,80 @@ func MatchFact(pattern, concrete Fact) bool {
 		((pattern.Object == concrete.Object) || pattern.Object == ""))
 }
 
+// Change is an assertion or denial of a fact.
+type Change struct {
+	Fact
+	// Deny is true if the fact is to be denied rather than asserted.
+	Deny bool
+}
+
 // FactStore is a simple collection of unique, assertable, searchable facts.
 type FactStore interface {
-	// Assert ensures facts are in the store (idempotent).
+	// Assert ensures facts are in the store (idempotent). Asserting a fact
+	// already in the store replaces its expiration.
 	Assert(facts ...Fact) error
-	// Deny ensures facts are not in the store (idempotent).
+	// Deny ensures facts are not in the store (idempotent), regardless of
+	// their expiration.
 	Deny(facts ...Fact) error
-	// Exists reports whether all facts have been asserted.
+	// Exists reports whether all facts have been asserted, regardless of
+	// their expiration.
 	Exists(facts ...Fact) (bool, error)
 	// Match returns facts in the store matching the pattern of the provided
-	// fact. Empty strings are treated as wildcards. No match returns an
-	// empty result, not an error.
+	// fact, including their expiration. Empty strings are treated as
+	// wildcards. No match returns an empty result, not an error.
 	Match(fact Fact) ([]Fact, error)
+	// Apply makes a set of changes to the store, as if asserted or denied in
+	// the given order. Either all of the changes are made, or none are.
+	Apply(changes ...Change) error
+	// Insert asserts a fact unless it is already in the store and has not
+	// expired, and reports whether it was asserted. The check and the
+	// assertion are made atomically.
+	Insert(fact Fact) (bool, error)
+}
+
+// batchStore defers all changes made to a FactStore, to apply them at once.
+type batchStore struct {
+	FactStore
+	changes []Change
+}
+
+func (s *batchStore) Assert(facts ...Fact) error {
+	for _, fact := range facts {
+		s.changes = append(s.changes, Change{Fact: fact})
+	}
+	return nil
+}
+
+func (s *batchStore) Deny(facts ...Fact) error {
+	for _, fact := range facts {
+		s.changes = append(s.changes, Change{Fact: fact, Deny: true})
+	}
+	return nil
+}
+
+func (s *batchStore) Apply(changes ...Change) error {
+	s.changes = append(s.changes, changes...)
+	return nil
+}
+
+func (s *batchStore) Insert(fact Fact) (bool, error) {
+	return false, fmt.Errorf("cannot insert facts in a batch")
+}
+
+// Batch calls a function with a FactStore which defers all changes made to
+// the given store. If the function succeeds, the deferred changes are then
+// applied to the store all at once, so that either all of them are made or
+// none are. Queries made within the function do not observe deferred changes,
+// and facts cannot be inserted within it.
+func Batch(store FactStore, f func(FactStore) error) error {
+	batch := &batchStore{FactStore: store}
+	if err := f(batch); err != nil {
+		return err
+	}
+	if len(batch.changes) == 0 {
+		return nil
+	}
+	return store.Apply(batch.changes...)
 }
 
 const (
@@ -72,12 +147,56 @@ func (s *GroupFacts) Deny(facts ...Fact) error {
 	return s.store.Deny(facts...)
 }
 
+func (s *GroupFacts) Apply(changes ...Change) error {
+	return s.store.Apply(changes...)
+}
+
+func (s *GroupFacts) Insert(fact Fact) (bool, error) {
+	return s.store.Insert(fact)
+}
+
 func (s *GroupFacts) Exists(facts ...Fact) (bool, error) {
 	return s.store.Exists(facts...)
 }
 
+// Match returns the facts matching a pattern which have not expired.
 func (s *GroupFacts) Match(fact Fact) ([]Fact, error) {
-	return s.store.Match(fact)
+	facts, err := s.store.Match(fact)
+	if err != nil {
+		return nil, err
+	}
+	return unexpired(facts, time.Now()), nil
+}
+
+func unexpired(facts []Fact, now time.Time) []Fact {
+	var result []Fact
+	for _, fact := range facts {
+		if !fact.Expired(now) {
+			result = append(result, fact)
+		}
+	}
+	return result
+}
+
+// Sweep removes all expired facts on the given topics from the store.
+func (s *GroupFacts) Sweep(topics ...string) error {
+	var expired []Fact
+	now := time.Now()
+	for _, topic := range topics {
+		facts, err := s.store.Match(Fact{Topic: topic})
+		if err != nil {
+			return err
+		}
+		for _, fact := range facts {
+			if fact.Expired(now) {
+				expired = append(expired, fact)
+			}
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	return s.store.Deny(expired...)
 }
 
 // IsGroup returns whether a given subject is a group.
@@ -106,10 +225,12 @@ func (s *GroupFacts) AddGroup(group string) error {
 // AddMember adds a subject to a group. The group is created if it did not
 // already exist.
 func (s *GroupFacts) AddMember(group, member string) error {
-	if err := s.AddGroup(group); err != nil {
-		return err
-	}
 	return s.store.Assert(Fact{
+		Topic:     groupTopic,
+		Subject:   group,
+		Predicate: Isa,
+		Object:    GroupObject,
+	}, Fact{
 		Topic:     groupTopic,
 		Subject:   member,
 		Predicate: MemberOf,
@@ -129,11 +250,17 @@ func (s *GroupFacts) RemoveMember(group, member string) error {
 func (s *GroupFacts) RemoveGroup(group string) error {
 	var deny []Fact
 	// Find all member-of assertions on this group.
-	members, err := s.store.Match(Fact{Predicate: MemberOf, Object: group})
+	members, err := s.store.Match(Fact{Topic: groupTopic, Predicate: MemberOf, Object: group})
 	if err != nil {
 		return err
 	}
 	deny = append(deny, members...)
+	// Find all member-of assertions of this group in other groups.
+	memberOf, err := s.store.Match(Fact{Topic: groupTopic, Subject: group, Predicate: MemberOf})
+	if err != nil {
+		return err
+	}
+	deny = append(deny, memberOf...)
 	// Find the assertion that this is a group.
 	isa, err := s.store.Match(Fact{
 		Topic:     groupTopic,
@@ -152,7 +279,7 @@ func (s *GroupFacts) RemoveGroup(group string) error {
 // Groups returns the groups which the given subject is a member of.
 func (s *GroupFacts) Groups(member string) ([]string, error) {
 	var result []string
-	stmts, err := s.store.Match(Fact{
+	stmts, err := s.Match(Fact{
 		Topic:     groupTopic,
 		Subject:   member,
 		Predicate: MemberOf,
@@ -167,24 +294,136 @@ func (s *GroupFacts) Groups(member string) ([]string, error) {
 	return result, nil
 }
 
-// MatchAll returns all facts that match a fact for the given subject and the
-// set of all its containing groups.
+// closure returns a subject and all the groups containing it, immediately or
+// through other groups, and when the closure expires, or the zero time if it
+// does not.
+func (s *GroupFacts) closure(subject string) ([]string, time.Time, error) {
+	var expires time.Time
+	visited := map[string]bool{subject: true}
+	subjects := []string{subject}
+	for i := 0; i < len(subjects); i++ {
+		memberships, err := s.Match(Fact{
+			Topic:     groupTopic,
+			Subject:   subjects[i],
+			Predicate: MemberOf,
+		})
+		if err != nil {
+			return nil, expires, err
+		}
+		for _, membership := range memberships {
+			expires = earliest(expires, membership.Expires)
+			if !visited[membership.Object] {
+				visited[membership.Object] = true
+				subjects = append(subjects, membership.Object)
+			}
+		}
+	}
+	return subjects, expires, nil
+}
+
+// earliest returns the earlier of two expiration times, where the zero time
+// never expires.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// Members returns the subjects which are immediate members of the given group.
+func (s *GroupFacts) Members(group string) ([]string, error) {
+	var result []string
+	stmts, err := s.Match(Fact{
+		Topic:     groupTopic,
+		Predicate: MemberOf,
+		Object:    group,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range stmts {
+		result = append(result, stmt.Subject)
+	}
+	return result, nil
+}
+
+// IsMember tests if a subject is a member of a group, either immediately or
+// through the groups containing it. Nested groups are followed to at most
+// maxDepth levels of membership, where a depth of 1 considers only immediate
+// membership. A maxDepth of zero or less is unlimited. Cycles in group
+// membership are followed only once.
+func (s *GroupFacts) IsMember(group, member string, maxDepth int) (bool, error) {
+	visited := map[string]bool{member: true}
+	pending := []string{member}
+	for depth := 1; len(pending) > 0 && (maxDepth <= 0 || depth <= maxDepth); depth++ {
+		var next []string
+		for _, subject := range pending {
+			groups, err := s.Groups(subject)
+			if err != nil {
+				return false, err
+			}
+			for _, g := range groups {
+				if g == group {
+					return true, nil
+				}
+				if !visited[g] {
+					visited[g] = true
+					next = append(next, g)
+				}
+			}
+		}
+		pending = next
+	}
+	return false, nil
+}
+
+// MatchPath is a fact matched on behalf of a subject, through the groups
+// containing the subject.
+type MatchPath struct {
+	Fact
+	// Groups is the chain of groups from the subject to the subject of the
+	// matched fact. Each group is a member of the next. Groups is empty if the
+	// fact was matched on the subject itself.
+	Groups []string
+}
+
+// MatchAll returns all unexpired facts that match a fact for the given subject
+// and the set of all its containing groups.
 func (s *GroupFacts) MatchAll(start Fact) ([]Fact, error) {
+	paths, err := s.MatchAllPaths(start)
+	if err != nil {
+		return nil, err
+	}
 	var result []Fact
-	visited := make(map[string]bool)
-	pending := []Fact{start}
+	for _, path := range paths {
+		result = append(result, path.Fact)
+	}
+	return result, nil
+}
+
+// MatchAllPaths returns all unexpired facts that match a fact for the given
+// subject and the set of all its containing groups, along with the chain of
+// groups through which each fact applies to the subject.
+func (s *GroupFacts) MatchAllPaths(start Fact) ([]MatchPath, error) {
+	type pendingMatch struct {
+		Fact
+		groups []string
+	}
+	var result []MatchPath
+	visited := map[string]bool{start.Subject: true}
+	pending := []pendingMatch{{start, nil}}
 	for len(pending) > 0 {
 		current := pending[0]
 		pending = pending[1:]
 
-		matches, err := s.store.Match(current)
+		matches, err := s.Match(current.Fact)
 		if err != nil {
 			return nil, err
 		}
 
-		visited[current.Subject] = true
 		for _, match := range matches {
-			result = append(result, match)
+			result = append(result, MatchPath{match, current.groups})
 		}
 
 		// Queue up facts for groups containing the current subject
@@ -193,11 +432,16 @@ func (s *GroupFacts) MatchAll(start Fact) ([]Fact, error) {
 			return nil, err
 		}
 		for _, group := range groups {
-			if _, ok := visited[group]; !ok {
-				// Queue up only groups we haven't seen yet.
+			if !visited[group] {
+				// Queue up only groups we haven't seen yet. Groups are
+				// marked as they are queued, so that a group reachable by
+				// several paths is only matched once, by the shortest.
+				visited[group] = true
 				groupFact := start
 				groupFact.Subject = group
-				pending = append(pending, groupFact)
+				groupPath := make([]string, len(current.groups), len(current.groups)+1)
+				copy(groupPath, current.groups)
+				pending = append(pending, pendingMatch{groupFact, append(groupPath, group)})
 			}
 		}
 	}
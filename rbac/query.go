@@ -0,0 +1,304 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package rbac
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/juju/affinity"
+)
+
+// EffectiveGrant describes a role a principal holds on a resource, and how
+// the principal came to hold it.
+type EffectiveGrant struct {
+	// Role is the role granted.
+	Role Role
+	// Resource is the URI of the resource on which the role was granted.
+	Resource string
+	// Subject is the principal or group to which the role was granted.
+	Subject string
+	// Groups is the chain of groups through which the principal is a member
+	// of the subject. Groups is empty if the role was granted directly.
+	Groups []string
+	// Expires is the time at which the grant expires, or the zero value if
+	// the grant is permanent.
+	Expires time.Time
+}
+
+// Grants returns all the roles effectively granted to a principal, directly
+// or through the groups containing it. Grants of roles which have been denied
+// to the principal on the same resource or any of its containers are
+// excluded, as they are by HasGrant. The containers of a resource are found
+// with ResolveResource. Roles not defined in the Roles map are ignored.
+func (s *Access) Grants(pr affinity.Principal) ([]EffectiveGrant, error) {
+	denials, err := s.facts.MatchAll(Fact{Topic: rbacDenyTopic, Subject: pr.String()})
+	if err != nil {
+		return nil, err
+	}
+	denied := make(map[Fact]bool)
+	for _, denial := range denials {
+		denied[Fact{Predicate: denial.Predicate, Object: denial.Object}] = true
+	}
+
+	matches, err := s.facts.MatchAllPaths(Fact{Topic: rbacTopic, Subject: pr.String()})
+	if err != nil {
+		return nil, err
+	}
+	var result []EffectiveGrant
+	for _, match := range matches {
+		role, ok := s.Roles[match.Predicate]
+		if !ok {
+			continue
+		}
+		if s.deniedOn(denied, match.Predicate, s.resolveResource(match.Object)) {
+			continue
+		}
+		result = append(result, EffectiveGrant{
+			Role:     role,
+			Resource: match.Object,
+			Subject:  match.Subject,
+			Groups:   match.Groups,
+			Expires:  match.Expires,
+		})
+	}
+	return result, nil
+}
+
+// resolveResource returns the resource identified by a URI, with
+// ResolveResource if it is set, or otherwise as a path resource.
+func (s *Access) resolveResource(uri string) Resource {
+	if s.ResolveResource != nil {
+		if r := s.ResolveResource(uri); r != nil {
+			return r
+		}
+	}
+	return NewPathResource(uri)
+}
+
+// deniedOn tests if a role is among the denials on a resource or any of its
+// containers.
+func (s *Access) deniedOn(denied map[Fact]bool, role string, r Resource) bool {
+	for ; r != nil; r = r.Parent() {
+		if denied[Fact{Predicate: role, Object: r.URI()}] {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantsOn returns all the roles granted directly on a resource, ordered by
+// role and subject. Grants of roles which have been denied to the same subject
+// on the resource are excluded. Roles not defined in the Roles map are
+// ignored.
+func (s *Access) GrantsOn(r Resource) ([]EffectiveGrant, error) {
+	denials, err := s.facts.Match(Fact{Topic: rbacDenyTopic, Object: r.URI()})
+	if err != nil {
+		return nil, err
+	}
+	denied := make(map[Fact]bool)
+	for _, denial := range denials {
+		denied[Fact{Subject: denial.Subject, Predicate: denial.Predicate}] = true
+	}
+
+	matches, err := s.facts.Match(Fact{Topic: rbacTopic, Object: r.URI()})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(factsByPredicate(matches))
+	var result []EffectiveGrant
+	for _, match := range matches {
+		role, ok := s.Roles[match.Predicate]
+		if !ok {
+			continue
+		}
+		if denied[Fact{Subject: match.Subject, Predicate: match.Predicate}] {
+			continue
+		}
+		result = append(result, EffectiveGrant{
+			Role:     role,
+			Resource: match.Object,
+			Subject:  match.Subject,
+			Expires:  match.Expires,
+		})
+	}
+	return result, nil
+}
+
+// factsByPredicate orders facts by predicate, then subject.
+type factsByPredicate []Fact
+
+func (f factsByPredicate) Len() int { return len(f) }
+
+func (f factsByPredicate) Less(i, j int) bool {
+	if f[i].Predicate != f[j].Predicate {
+		return f[i].Predicate < f[j].Predicate
+	}
+	return f[i].Subject < f[j].Subject
+}
+
+func (f factsByPredicate) Swap(i, j int) { f[i], f[j] = f[j], f[i] }
+
+// Who returns all the principals which have a permission on a given resource,
+// through a role granted on the resource or its container. Members of groups
+// granted such a role are included, as well as the groups themselves.
+func (s *Access) Who(pm Permission, r Resource) ([]affinity.Principal, error) {
+	if _, supported := r.Capabilities()[pm.Perm()]; !supported {
+		return nil, nil
+	}
+
+	// Find the subjects of grants providing the permission.
+	var pending []string
+	for rc := r; rc != nil; rc = rc.Parent() {
+		matches, err := s.facts.Match(Fact{Topic: rbacTopic, Object: rc.URI()})
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if role, ok := s.Roles[match.Predicate]; ok && role.Can(pm) {
+				pending = append(pending, match.Subject)
+			}
+		}
+	}
+
+	// Expand the subjects to all the members of groups, and check each one,
+	// since any of them may have been denied the permission.
+	var result []affinity.Principal
+	visited := make(map[string]bool)
+	for len(pending) > 0 {
+		subject := pending[0]
+		pending = pending[1:]
+		if visited[subject] {
+			continue
+		}
+		visited[subject] = true
+
+		members, err := s.facts.Members(subject)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, members...)
+
+		pr, err := affinity.ParsePrincipal(subject)
+		if err != nil {
+			// A malformed subject cannot act, and should not hide those
+			// which can.
+			log.Printf("Warning: ignoring invalid subject %q: %v", subject, err)
+			continue
+		}
+		can, err := s.Can(pr, pm, r)
+		if err != nil {
+			return nil, err
+		}
+		if can {
+			result = append(result, pr)
+		}
+	}
+	return result, nil
+}
+
+// Derivation describes how a grant or denial of a role applies to a principal.
+type Derivation struct {
+	// Role is the name of the role granted or denied.
+	Role string
+	// Resource is the URI of the resource, or the container of the resource,
+	// on which the role was granted or denied.
+	Resource string
+	// Subject is the principal or group to which the role was granted or denied.
+	Subject string
+	// Groups is the chain of member-of relations from the principal to the
+	// subject. Groups is empty if the principal is the subject.
+	Groups []string
+}
+
+// Explanation is the derivation of an access decision made by Access.Can.
+type Explanation struct {
+	Principal  string
+	Permission string
+	Resource   string
+	// Allowed is the access decision.
+	Allowed bool
+	// Supported reports whether the resource supports the permission at all.
+	Supported bool
+	// Grant is the grant of a role providing the permission, if any.
+	Grant *Derivation
+	// Denial is the denial of a role providing the permission, if any. A
+	// denial overrides any grant.
+	Denial *Derivation
+}
+
+// Explain returns the derivation of the decision Can makes for the principal's
+// permission on a given resource.
+func (s *Access) Explain(pr affinity.Principal, pm Permission, r Resource) (*Explanation, error) {
+	result := &Explanation{
+		Principal:  pr.String(),
+		Permission: pm.Perm(),
+		Resource:   r.URI(),
+	}
+	if _, supported := r.Capabilities()[pm.Perm()]; !supported {
+		return result, nil
+	}
+	result.Supported = true
+
+	for ; r != nil; r = r.Parent() {
+		denials, err := s.facts.MatchAllPaths(Fact{
+			Topic:   rbacDenyTopic,
+			Subject: pr.String(),
+			Object:  r.URI(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, denial := range denials {
+			if role, ok := s.Roles[denial.Predicate]; ok && role.Can(pm) {
+				result.Denial = newDerivation(denial)
+				result.Allowed = false
+				return result, nil
+			}
+		}
+		if result.Grant != nil {
+			continue
+		}
+		matches, err := s.facts.MatchAllPaths(Fact{
+			Topic:   rbacTopic,
+			Subject: pr.String(),
+			Object:  r.URI(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if role, ok := s.Roles[match.Predicate]; ok && role.Can(pm) {
+				result.Grant = newDerivation(match)
+				result.Allowed = true
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+func newDerivation(match MatchPath) *Derivation {
+	return &Derivation{
+		Role:     match.Predicate,
+		Resource: match.Object,
+		Subject:  match.Subject,
+		Groups:   match.Groups,
+	}
+}
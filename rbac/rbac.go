@@ -19,6 +19,9 @@ package rbac
 
 import (
 	"fmt"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/juju/affinity"
 )
@@ -66,6 +69,48 @@ func NewResource(uri string, capabilities ...Permission) Resource {
 	return &basicResource{uri, NewPermissionMap(capabilities...)}
 }
 
+type pathResource struct {
+	basicResource
+	pathStart int
+}
+
+// Parent returns the resource identified by the parent path of this
+// resource's URI, or nil if the URI has no parent path.
+func (pr *pathResource) Parent() Resource {
+	parentPath := path.Dir(pr.uri[pr.pathStart:])
+	if parentPath == "/" || parentPath == "." {
+		return nil
+	}
+	return &pathResource{
+		basicResource{pr.uri[:pr.pathStart] + parentPath, pr.capabilities},
+		pr.pathStart,
+	}
+}
+
+// NewPathResource defines a resource contained by the resources identified
+// by each parent path of its URI. For example, "project:/acme/web/prod" is
+// contained by "project:/acme/web", which is contained by "project:/acme".
+// Each containing resource has the same capabilities. The path of the URI is
+// cleaned, so that equivalent paths identify the same resource.
+func NewPathResource(uri string, capabilities ...Permission) Resource {
+	pathStart := strings.Index(uri, ":") + 1
+	if strings.HasPrefix(uri[pathStart:], "//") {
+		// Skip the authority component, it is not part of the path.
+		if i := strings.Index(uri[pathStart+2:], "/"); i != -1 {
+			pathStart += i + 2
+		} else {
+			pathStart = len(uri)
+		}
+	}
+	if uri[pathStart:] != "" {
+		uri = uri[:pathStart] + path.Clean(uri[pathStart:])
+	}
+	return &pathResource{
+		basicResource{uri, NewPermissionMap(capabilities...)},
+		pathStart,
+	}
+}
+
 // Role represents a set of permissions (capabilities, actions) to operate on a resource.
 type Role interface {
 	// Permissions that have been relegated to this role.
@@ -100,6 +145,55 @@ func NewRole(name string, permissions ...Permission) Role {
 	return &basicRole{name, NewPermissionMap(permissions...)}
 }
 
+// CompositeRole is a role which inherits all the capabilities of its parent roles,
+// transitively.
+type CompositeRole interface {
+	Role
+	// Parents returns the roles this role inherits from.
+	Parents() []Role
+}
+
+type compositeRole struct {
+	basicRole
+	parents []Role
+}
+
+func (cr *compositeRole) Parents() []Role {
+	return cr.parents
+}
+
+func (cr *compositeRole) Capabilities() PermissionMap {
+	result := NewPermissionMap()
+	for _, parent := range cr.parents {
+		for name, perm := range parent.Capabilities() {
+			result[name] = perm
+		}
+	}
+	for name, perm := range cr.perms {
+		result[name] = perm
+	}
+	return result
+}
+
+func (cr *compositeRole) Can(p Permission) bool {
+	if cr.basicRole.Can(p) {
+		return true
+	}
+	for _, parent := range cr.parents {
+		if parent.Can(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCompositeRole defines a new role identified by a well-known, unique name
+// with access to the specified permissions, in addition to all the permissions
+// of its parent roles.
+func NewCompositeRole(name string, parents []Role, permissions ...Permission) Role {
+	return &compositeRole{basicRole{name, NewPermissionMap(permissions...)}, parents}
+}
+
 // Grant represents a statement of fact that a principal (user, group, identity)
 // can act in a given role (perform actions on) with regard to some resource object.
 type Grant interface {
@@ -113,14 +207,51 @@ type Grant interface {
 
 type RoleMap map[string]Role
 
-func NewRoleMap(roles ...Role) RoleMap {
+// BuildRoleMap creates a RoleMap from the given roles. An error is returned if
+// any composite role inherits from itself.
+func BuildRoleMap(roles ...Role) (RoleMap, error) {
 	roleMap := make(RoleMap)
 	for _, role := range roles {
+		if err := checkInheritance(role, nil); err != nil {
+			return nil, err
+		}
 		roleMap[role.Role()] = role
 	}
+	return roleMap, nil
+}
+
+// NewRoleMap creates a RoleMap from the given roles. It panics if any
+// composite role inherits from itself.
+func NewRoleMap(roles ...Role) RoleMap {
+	roleMap, err := BuildRoleMap(roles...)
+	if err != nil {
+		panic(err)
+	}
 	return roleMap
 }
 
+// checkInheritance returns an error if a role's ancestors include a role
+// already on the given inheritance path.
+func checkInheritance(role Role, path []string) error {
+	for _, name := range path {
+		if name == role.Role() {
+			return fmt.Errorf("role inheritance cycle: %s -> %s",
+				strings.Join(path, " -> "), role.Role())
+		}
+	}
+	composite, ok := role.(CompositeRole)
+	if !ok {
+		return nil
+	}
+	path = append(path, role.Role())
+	for _, parent := range composite.Parents() {
+		if err := checkInheritance(parent, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type PermissionMap map[string]Permission
 
 func NewPermissionMap(permissions ...Permission) PermissionMap {
@@ -131,13 +262,22 @@ func NewPermissionMap(permissions ...Permission) PermissionMap {
 	return permissionMap
 }
 
-const rbacTopic = "affinity:rbac"
+const (
+	rbacTopic     = "affinity:rbac"
+	rbacDenyTopic = "affinity:rbac-deny"
+)
 
 // Access provides query capabilities over the role-based
 // access control system.
 type Access struct {
 	Roles RoleMap
-	facts *GroupFacts
+	// ResolveResource returns the resource identified by a URI, or nil if
+	// it is unknown. Queries which start from a principal rather than a
+	// resource use it to find the containers of the resources on which
+	// roles were granted. If nil, or if it returns nil, the URI is resolved
+	// with NewPathResource.
+	ResolveResource func(uri string) Resource
+	facts           *GroupFacts
 }
 
 func NewAccess(store FactStore, roles RoleMap) *Access {
@@ -148,10 +288,32 @@ func NewAccess(store FactStore, roles RoleMap) *Access {
 }
 
 // HasGrant tests if the principal has been granted a role on a given resource or its container.
+// An explicit denial of the role on the resource or any of its containers overrides the grant.
 func (s *Access) HasGrant(pr affinity.Principal, ro Role, r Resource) (bool, error) {
-	var result bool
-	var err error
+	grants, err := s.grants(pr, ro, r)
+	if err != nil {
+		return false, err
+	}
+	return len(grants) > 0, nil
+}
+
+// grants returns the unexpired facts granting the principal a role on a given resource or
+// its container. No facts are returned if the role has been denied.
+func (s *Access) grants(pr affinity.Principal, ro Role, r Resource) ([]Fact, error) {
+	var result []Fact
 	for r != nil {
+		denials, err := s.facts.MatchAll(Fact{
+			Topic:     rbacDenyTopic,
+			Subject:   pr.String(),
+			Predicate: ro.Role(),
+			Object:    r.URI(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(denials) > 0 {
+			return nil, nil
+		}
 		matches, err := s.facts.MatchAll(Fact{
 			Topic:     rbacTopic,
 			Subject:   pr.String(),
@@ -159,40 +321,66 @@ func (s *Access) HasGrant(pr affinity.Principal, ro Role, r Resource) (bool, err
 			Object:    r.URI(),
 		})
 		if err != nil {
-			return false, err
-		}
-		if len(matches) > 0 {
-			return true, nil
+			return nil, err
 		}
+		result = append(result, matches...)
 		r = r.Parent()
 	}
-	return result, err
+	return result, nil
 }
 
 // Can tests if the principal's granted roles provide a permission on a given resource or its container.
+// If any role denied to the principal on the resource or its containers provides the permission,
+// the permission is denied regardless of grants.
 func (s *Access) Can(pr affinity.Principal, pm Permission, r Resource) (bool, error) {
 	// Does this resource support the capability being requested?
 	if _, supported := r.Capabilities()[pm.Perm()]; !supported {
 		return false, nil
 	}
 
-	for r != nil {
-		matches, err := s.facts.MatchAll(Fact{
-			Topic:   rbacTopic,
-			Subject: pr.String(),
-			Object:  r.URI(),
-		})
-		if err != nil {
-			return false, err
-		}
-		for _, match := range matches {
-			if role, ok := s.Roles[match.Predicate]; ok && role.Can(pm) {
-				return true, nil
+	subjects, _, err := s.facts.closure(pr.String())
+	if err != nil {
+		return false, err
+	}
+	can, _, err := s.can(subjects, pm, r)
+	return can, err
+}
+
+// can tests if the roles granted to any of the subjects provide a permission
+// on a given resource or its container, and returns when the decision
+// expires, or the zero time if it does not.
+func (s *Access) can(subjects []string, pm Permission, r Resource) (bool, time.Time, error) {
+	var granted bool
+	var expires time.Time
+	for ; r != nil; r = r.Parent() {
+		for _, subject := range subjects {
+			denials, err := s.facts.Match(Fact{Topic: rbacDenyTopic, Subject: subject, Object: r.URI()})
+			if err != nil {
+				return false, expires, err
+			}
+			for _, denial := range denials {
+				expires = earliest(expires, denial.Expires)
+				if role, ok := s.Roles[denial.Predicate]; ok && role.Can(pm) {
+					return false, expires, nil
+				}
+			}
+			if granted {
+				continue
+			}
+			matches, err := s.facts.Match(Fact{Topic: rbacTopic, Subject: subject, Object: r.URI()})
+			if err != nil {
+				return false, expires, err
+			}
+			for _, match := range matches {
+				if role, ok := s.Roles[match.Predicate]; ok && role.Can(pm) {
+					expires = earliest(expires, match.Expires)
+					granted = true
+					break
+				}
 			}
 		}
-		r = r.Parent()
 	}
-	return false, nil
+	return granted, expires, nil
 }
 
 // Admin provides administrative capabilities over the role-based
@@ -207,19 +395,38 @@ func NewAdmin(store FactStore, roles RoleMap) *Admin {
 
 // Grant allows a principal permissions to act upon a given resource.
 func (s *Admin) Grant(pr affinity.Principal, ro Role, rs Resource) error {
-	can, err := s.HasGrant(pr, ro, rs)
+	return s.grant(pr, ro, rs, time.Time{})
+}
+
+// GrantUntil allows a principal permissions to act upon a given resource
+// until the given expiration time. A temporary grant may be extended by
+// granting it again with a later expiration, or made permanent with Grant.
+func (s *Admin) GrantUntil(pr affinity.Principal, ro Role, rs Resource, expires time.Time) error {
+	if expires.IsZero() {
+		return fmt.Errorf("grant of role %q to %q on %q requires an expiration",
+			ro.Role(), pr.String(), rs.URI())
+	}
+	return s.grant(pr, ro, rs, expires)
+}
+
+func (s *Admin) grant(pr affinity.Principal, ro Role, rs Resource, expires time.Time) error {
+	grants, err := s.grants(pr, ro, rs)
 	if err != nil {
 		return err
 	}
-	if can {
-		return fmt.Errorf("role %q already effectively granted to %q on %q",
-			ro.Role(), pr.String(), rs.URI())
+	for _, grant := range grants {
+		// An existing grant lasting at least as long makes this one redundant.
+		if grant.Expires.IsZero() || (!expires.IsZero() && !grant.Expires.Before(expires)) {
+			return fmt.Errorf("role %q already effectively granted to %q on %q",
+				ro.Role(), pr.String(), rs.URI())
+		}
 	}
 	return s.facts.Assert(Fact{
 		Topic:     rbacTopic,
 		Subject:   pr.String(),
 		Predicate: ro.Role(),
 		Object:    rs.URI(),
+		Expires:   expires,
 	})
 }
 
@@ -233,19 +440,59 @@ func (s *Admin) Revoke(pr affinity.Principal, ro Role, rs Resource) error {
 	})
 }
 
+// Deny explicitly withholds a role from a principal on a given resource and
+// all resources it contains. A denial takes precedence over any grant of the
+// role, whether made directly or through a group, and prevents the principal
+// from exercising any permission the denied role provides.
+func (s *Admin) Deny(pr affinity.Principal, ro Role, rs Resource) error {
+	return s.facts.Assert(Fact{
+		Topic:     rbacDenyTopic,
+		Subject:   pr.String(),
+		Predicate: ro.Role(),
+		Object:    rs.URI(),
+	})
+}
+
+// RevokeDeny removes a prior denial specifically.
+func (s *Admin) RevokeDeny(pr affinity.Principal, ro Role, rs Resource) error {
+	return s.facts.Deny(Fact{
+		Topic:     rbacDenyTopic,
+		Subject:   pr.String(),
+		Predicate: ro.Role(),
+		Object:    rs.URI(),
+	})
+}
+
+// RevokeAll removes all grants and denials made to a principal specifically.
+// Grants made to groups containing the principal are not affected.
 func (s *Admin) RevokeAll(pr affinity.Principal) error {
-	facts, err := s.facts.MatchAll(Fact{Topic: rbacTopic, Subject: pr.String()})
-	if err != nil {
-		return err
+	var facts []Fact
+	for _, topic := range []string{rbacTopic, rbacDenyTopic} {
+		matches, err := s.facts.Match(Fact{Topic: topic, Subject: pr.String()})
+		if err != nil {
+			return err
+		}
+		facts = append(facts, matches...)
 	}
 	return s.facts.Deny(facts...)
 }
 
-// RemoveAll removes all grants that were made on a given resource.
+// RemoveAll removes all grants and denials that were made on a given resource.
 func (s *Admin) RemoveAll(rs Resource) error {
-	facts, err := s.facts.MatchAll(Fact{Topic: rbacTopic, Object: rs.URI()})
-	if err != nil {
-		return err
+	var facts []Fact
+	for _, topic := range []string{rbacTopic, rbacDenyTopic} {
+		matches, err := s.facts.Match(Fact{Topic: topic, Object: rs.URI()})
+		if err != nil {
+			return err
+		}
+		facts = append(facts, matches...)
 	}
 	return s.facts.Deny(facts...)
 }
+
+// Sweep removes all expired grants, denials and group memberships from storage.
+// Expired facts are already ignored by access queries, so sweeping only
+// reclaims storage.
+func (s *Admin) Sweep() error {
+	return s.facts.Sweep(rbacTopic, rbacDenyTopic, groupTopic)
+}
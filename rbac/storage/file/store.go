@@ -0,0 +1,275 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package file provides an rbac.FactStore persisted in an embedded key-value
+// file, for single-binary deployments without a database server.
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/juju/affinity/rbac"
+)
+
+var (
+	// factsBucket maps the identity of each fact to its value.
+	factsBucket = []byte("facts")
+	// Index buckets map a field value followed by a fact identity to nothing,
+	// so that facts with a given field value can be found by prefix.
+	subjectBucket   = []byte("subject")
+	predicateBucket = []byte("predicate")
+	objectBucket    = []byte("object")
+)
+
+type fileStore struct {
+	db *bolt.DB
+}
+
+// OpenFactStore opens or creates the file at the given path and uses it to
+// store facts.
+func OpenFactStore(path string) (rbac.FactStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewFactStore(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// NewFactStore creates an rbac.FactStore over an open database, creating the
+// buckets used for facts and their indexes if necessary.
+func NewFactStore(db *bolt.DB) (rbac.FactStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{factsBucket, subjectBucket, predicateBucket, objectBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{db: db}, nil
+}
+
+// encodeField length-prefixes a field value, so that concatenated fields
+// cannot be confused with one another.
+func encodeField(buf *bytes.Buffer, field string) {
+	var n [binary.MaxVarintLen64]byte
+	buf.Write(n[:binary.PutUvarint(n[:], uint64(len(field)))])
+	buf.WriteString(field)
+}
+
+// factKey returns the identity of a fact, without its expiration.
+func factKey(fact rbac.Fact) []byte {
+	var buf bytes.Buffer
+	for _, field := range []string{fact.Topic, fact.Subject, fact.Predicate, fact.Object} {
+		encodeField(&buf, field)
+	}
+	return buf.Bytes()
+}
+
+// indexKey returns the key indexing a fact identity under a field value.
+func indexKey(field string, key []byte) []byte {
+	var buf bytes.Buffer
+	encodeField(&buf, field)
+	buf.Write(key)
+	return buf.Bytes()
+}
+
+// index is an entry for a fact in one of the index buckets.
+type index struct {
+	bucket []byte
+	field  string
+}
+
+// factIndexes returns the index entries for a fact.
+func factIndexes(fact rbac.Fact) []index {
+	return []index{
+		{subjectBucket, fact.Subject},
+		{predicateBucket, fact.Predicate},
+		{objectBucket, fact.Object},
+	}
+}
+
+// Close closes the underlying database.
+func (s *fileStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *fileStore) Assert(facts ...rbac.Fact) error {
+	var changes []rbac.Change
+	for _, fact := range facts {
+		changes = append(changes, rbac.Change{Fact: fact})
+	}
+	return s.Apply(changes...)
+}
+
+func (s *fileStore) Deny(facts ...rbac.Fact) error {
+	var changes []rbac.Change
+	for _, fact := range facts {
+		changes = append(changes, rbac.Change{Fact: fact, Deny: true})
+	}
+	return s.Apply(changes...)
+}
+
+// Apply makes all the changes in a single transaction.
+func (s *fileStore) Apply(changes ...rbac.Change) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, change := range changes {
+			err := applyChange(tx, change)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func applyChange(tx *bolt.Tx, change rbac.Change) error {
+	key := factKey(change.Fact)
+	facts := tx.Bucket(factsBucket)
+	if change.Deny {
+		if facts.Get(key) == nil {
+			return nil
+		}
+		err := facts.Delete(key)
+		if err != nil {
+			return err
+		}
+		for _, idx := range factIndexes(change.Fact) {
+			err = tx.Bucket(idx.bucket).Delete(indexKey(idx.field, key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	value, err := json.Marshal(change.Fact)
+	if err != nil {
+		return err
+	}
+	err = facts.Put(key, value)
+	if err != nil {
+		return err
+	}
+	for _, idx := range factIndexes(change.Fact) {
+		err = tx.Bucket(idx.bucket).Put(indexKey(idx.field, key), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert checks for the fact and asserts it in a single transaction.
+func (s *fileStore) Insert(fact rbac.Fact) (bool, error) {
+	inserted := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(factsBucket).Get(factKey(fact)); value != nil {
+			var prior rbac.Fact
+			err := json.Unmarshal(value, &prior)
+			if err != nil {
+				return err
+			}
+			if !prior.Expired(time.Now()) {
+				return nil
+			}
+		}
+		inserted = true
+		return applyChange(tx, rbac.Change{Fact: fact})
+	})
+	return inserted, err
+}
+
+func (s *fileStore) Exists(facts ...rbac.Fact) (bool, error) {
+	var match bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(factsBucket)
+		for _, fact := range facts {
+			match = bucket.Get(factKey(fact)) != nil
+			if !match {
+				return nil
+			}
+		}
+		return nil
+	})
+	return match, err
+}
+
+// Match finds facts through the index of the first field given in the pattern,
+// checking subject, object and then predicate. If the pattern gives none of
+// these, all facts are scanned.
+func (s *fileStore) Match(pattern rbac.Fact) ([]rbac.Fact, error) {
+	var result []rbac.Fact
+	err := s.db.View(func(tx *bolt.Tx) error {
+		facts := tx.Bucket(factsBucket)
+		check := func(value []byte) error {
+			var fact rbac.Fact
+			err := json.Unmarshal(value, &fact)
+			if err != nil {
+				return err
+			}
+			if rbac.MatchFact(pattern, fact) {
+				result = append(result, fact)
+			}
+			return nil
+		}
+
+		var index *bolt.Bucket
+		var field string
+		switch {
+		case pattern.Subject != "":
+			index, field = tx.Bucket(subjectBucket), pattern.Subject
+		case pattern.Object != "":
+			index, field = tx.Bucket(objectBucket), pattern.Object
+		case pattern.Predicate != "":
+			index, field = tx.Bucket(predicateBucket), pattern.Predicate
+		default:
+			return facts.ForEach(func(k, v []byte) error {
+				return check(v)
+			})
+		}
+
+		prefix := indexKey(field, nil)
+		c := index.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			value := facts.Get(k[len(prefix):])
+			if value == nil {
+				continue
+			}
+			err := check(value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,85 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package file_test
+
+import (
+	"io"
+	"path/filepath"
+	stdtesting "testing"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/rbac/storage/file"
+	"github.com/juju/affinity/testing"
+)
+
+type FileSuite struct {
+	*testing.StoreSuite
+	*testing.RbacSuite
+	stores []rbac.FactStore
+}
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+var _ = Suite(&FileSuite{})
+
+func (s *FileSuite) SetUpTest(c *C) {
+	dir := c.MkDir()
+	{
+		store, err := file.OpenFactStore(filepath.Join(dir, "store.db"))
+		c.Assert(err, IsNil)
+		s.stores = append(s.stores, store)
+		s.StoreSuite = testing.NewStoreSuite(store)
+		s.StoreSuite.SetUp(c)
+	}
+	{
+		store, err := file.OpenFactStore(filepath.Join(dir, "rbac.db"))
+		c.Assert(err, IsNil)
+		s.stores = append(s.stores, store)
+		s.RbacSuite = testing.NewRbacSuite(store)
+		s.RbacSuite.SetUp(c)
+	}
+}
+
+func (s *FileSuite) TearDownTest(c *C) {
+	for _, store := range s.stores {
+		c.Check(store.(io.Closer).Close(), IsNil)
+	}
+	s.stores = nil
+}
+
+func (s *FileSuite) TestReopen(c *C) {
+	path := filepath.Join(c.MkDir(), "facts.db")
+	fact := rbac.Fact{Topic: "test", Subject: "fry", Predicate: "delivers", Object: "fry"}
+	{
+		store, err := file.OpenFactStore(path)
+		c.Assert(err, IsNil)
+		c.Assert(store.Assert(fact), IsNil)
+		c.Assert(store.(io.Closer).Close(), IsNil)
+	}
+	store, err := file.OpenFactStore(path)
+	c.Assert(err, IsNil)
+	facts, err := store.Match(rbac.Fact{Topic: "test", Object: "fry"})
+	c.Assert(err, IsNil)
+	c.Assert(facts, DeepEquals, []rbac.Fact{fact})
+	c.Assert(store.Deny(fact), IsNil)
+	facts, err = store.Match(rbac.Fact{Topic: "test", Subject: "fry"})
+	c.Assert(err, IsNil)
+	c.Assert(facts, HasLen, 0)
+}
@@ -18,37 +18,95 @@
 package mem
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
 	"github.com/juju/affinity/rbac"
 )
 
-type memStore struct {
-	facts map[rbac.Fact]bool
+// Store is an in-memory FactStore which is safe for concurrent use. Its facts
+// can be saved to and restored from a file, so that it can be used as a
+// single-node backend.
+type Store struct {
+	mu      sync.RWMutex
+	facts   map[rbac.Fact]rbac.Fact
+	changes uint64
 }
 
+// NewFactStore creates an empty in-memory FactStore.
 func NewFactStore() rbac.FactStore {
-	return &memStore{
-		facts: make(map[rbac.Fact]bool),
+	return NewStore()
+}
+
+// NewStore creates an empty in-memory Store.
+func NewStore() *Store {
+	return &Store{
+		facts: make(map[rbac.Fact]rbac.Fact),
 	}
 }
 
-func (s *memStore) Assert(facts ...rbac.Fact) error {
+// factKey returns the identity of a fact, without its expiration.
+func factKey(fact rbac.Fact) rbac.Fact {
+	fact.Expires = time.Time{}
+	return fact
+}
+
+func (s *Store) Assert(facts ...rbac.Fact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, t := range facts {
-		s.facts[t] = true
+		s.facts[factKey(t)] = t
 	}
+	s.changes++
 	return nil
 }
 
-func (s *memStore) Deny(facts ...rbac.Fact) error {
+func (s *Store) Deny(facts ...rbac.Fact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, t := range facts {
-		delete(s.facts, t)
+		delete(s.facts, factKey(t))
 	}
+	s.changes++
 	return nil
 }
 
-func (s *memStore) Exists(facts ...rbac.Fact) (bool, error) {
+func (s *Store) Apply(changes ...rbac.Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, change := range changes {
+		if change.Deny {
+			delete(s.facts, factKey(change.Fact))
+		} else {
+			s.facts[factKey(change.Fact)] = change.Fact
+		}
+	}
+	s.changes++
+	return nil
+}
+
+func (s *Store) Insert(fact rbac.Fact) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := factKey(fact)
+	if prior, ok := s.facts[key]; ok && !prior.Expired(time.Now()) {
+		return false, nil
+	}
+	s.facts[key] = fact
+	s.changes++
+	return true, nil
+}
+
+func (s *Store) Exists(facts ...rbac.Fact) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var match bool
 	for _, t := range facts {
-		_, match = s.facts[t]
+		_, match = s.facts[factKey(t)]
 		if !match {
 			return match, nil
 		}
@@ -56,12 +114,75 @@ func (s *memStore) Exists(facts ...rbac.Fact) (bool, error) {
 	return match, nil
 }
 
-func (s *memStore) Match(pattern rbac.Fact) ([]rbac.Fact, error) {
+func (s *Store) Match(pattern rbac.Fact) ([]rbac.Fact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	var result []rbac.Fact
-	for t := range s.facts {
+	for _, t := range s.facts {
 		if rbac.MatchFact(pattern, t) {
 			result = append(result, t)
 		}
 	}
 	return result, nil
 }
+
+// Snapshot saves all the facts in the store to a file. The file is replaced
+// atomically, so that an interrupted snapshot does not corrupt a prior one.
+func (s *Store) Snapshot(path string) error {
+	s.mu.RLock()
+	facts := make([]rbac.Fact, 0, len(s.facts))
+	for _, fact := range s.facts {
+		facts = append(facts, fact)
+	}
+	s.mu.RUnlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	err = json.NewEncoder(f).Encode(facts)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Restore replaces all the facts in the store with those saved to a file by
+// Snapshot.
+func (s *Store) Restore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var facts []rbac.Fact
+	err = json.NewDecoder(f).Decode(&facts)
+	if err != nil {
+		return err
+	}
+
+	restored := make(map[rbac.Fact]rbac.Fact)
+	for _, fact := range facts {
+		restored[factKey(fact)] = fact
+	}
+	s.mu.Lock()
+	s.facts = restored
+	s.changes++
+	s.mu.Unlock()
+	return nil
+}
+
+// Changes returns a count of the changes made to the store, so that callers
+// can tell whether it has changed since it was last saved.
+func (s *Store) Changes() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.changes
+}
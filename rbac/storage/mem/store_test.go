@@ -0,0 +1,104 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package mem_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/rbac/storage/mem"
+)
+
+type MemStoreSuite struct{}
+
+var _ = Suite(&MemStoreSuite{})
+
+func (s *MemStoreSuite) TestConcurrentAccess(c *C) {
+	store := mem.NewStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				fact := rbac.Fact{Topic: "test", Subject: fmt.Sprintf("user%d", i), Predicate: "member-of", Object: fmt.Sprintf("group%d", j)}
+				c.Check(store.Assert(fact), IsNil)
+				_, err := store.Match(rbac.Fact{Topic: "test", Subject: fact.Subject})
+				c.Check(err, IsNil)
+				if j%2 == 0 {
+					c.Check(store.Deny(fact), IsNil)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	facts, err := store.Match(rbac.Fact{Topic: "test"})
+	c.Assert(err, IsNil)
+	c.Check(facts, HasLen, 500)
+}
+
+func (s *MemStoreSuite) TestSnapshotRestore(c *C) {
+	path := filepath.Join(c.MkDir(), "facts.json")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	fry := rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "passenger", Object: "spacecraft:ship"}
+	leela := rbac.Fact{Topic: "affinity:rbac", Subject: "test:leela", Predicate: "pilot", Object: "spacecraft:ship", Expires: expires}
+
+	store := mem.NewStore()
+	c.Assert(store.Assert(fry, leela), IsNil)
+	c.Assert(store.Snapshot(path), IsNil)
+
+	restored := mem.NewStore()
+	c.Assert(restored.Assert(rbac.Fact{Topic: "affinity:rbac", Subject: "test:zoidberg", Predicate: "pilot", Object: "spacecraft:ship"}), IsNil)
+	c.Assert(restored.Restore(path), IsNil)
+	facts, err := restored.Match(rbac.Fact{Topic: "affinity:rbac"})
+	c.Assert(err, IsNil)
+	c.Assert(facts, HasLen, 2)
+	facts, err = restored.Match(rbac.Fact{Topic: "affinity:rbac", Subject: "test:leela"})
+	c.Assert(err, IsNil)
+	c.Assert(facts, HasLen, 1)
+	c.Check(facts[0].Expires.Equal(expires), Equals, true)
+
+	c.Check(restored.Restore(filepath.Join(c.MkDir(), "missing.json")), NotNil)
+}
+
+func (s *MemStoreSuite) TestChanges(c *C) {
+	fry := rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "passenger", Object: "spacecraft:ship"}
+	store := mem.NewStore()
+	changes := store.Changes()
+
+	_, err := store.Match(rbac.Fact{Topic: "affinity:rbac"})
+	c.Assert(err, IsNil)
+	c.Check(store.Changes(), Equals, changes)
+
+	c.Assert(store.Assert(fry), IsNil)
+	c.Check(store.Changes() > changes, Equals, true)
+	changes = store.Changes()
+
+	inserted, err := store.Insert(fry)
+	c.Assert(err, IsNil)
+	c.Assert(inserted, Equals, false)
+	c.Check(store.Changes(), Equals, changes)
+
+	c.Assert(store.Deny(fry), IsNil)
+	c.Check(store.Changes() > changes, Equals, true)
+}
@@ -18,16 +18,27 @@
 package mongo
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"time"
+
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+	"labix.org/v2/mgo/txn"
 
 	"github.com/juju/affinity/rbac"
 )
 
+// maxTxnAttempts limits how many times a set of changes is attempted, when
+// its transaction is aborted by concurrent changes to the same facts.
+const maxTxnAttempts = 3
+
 type mongoStore struct {
 	*mgo.Session
-	db *mgo.Database
-	c  *mgo.Collection
+	db     *mgo.Database
+	c      *mgo.Collection
+	runner *txn.Runner
 }
 
 // DialMongoStore connects to MongoDB and uses an opinionated default for
@@ -49,9 +60,13 @@ func DialMongoStore(url string, dbuser, dbpass string) (rbac.FactStore, error) {
 
 // NewFactStore creates an rbac.FactStore over an established MongoDB session
 // and database, using the given collection name for storing the facts.
+// Changes to the facts are made with multi-document transactions, which are
+// kept in a collection with the suffix ".txns". Any transactions interrupted
+// by a prior failure are resumed.
 func NewFactStore(session *mgo.Session, db *mgo.Database, collection string) (rbac.FactStore, error) {
 	store := &mongoStore{Session: session, db: db}
 	store.c = store.db.C(collection)
+	store.runner = txn.NewRunner(store.db.C(collection + ".txns"))
 
 	err := store.db.C(collection).EnsureIndex(mgo.Index{
 		Key:    []string{"subject", "predicate", "object", "topic"},
@@ -61,34 +76,183 @@ func NewFactStore(session *mgo.Session, db *mgo.Database, collection string) (rb
 		return nil, err
 	}
 
+	err = store.runner.ResumeAll()
+	if err != nil {
+		return nil, err
+	}
+	err = store.migrate()
+	if err != nil {
+		return nil, err
+	}
+
 	return store, nil
 }
 
+// factId returns the document id of a fact, derived from its identity.
+func factId(fact rbac.Fact) string {
+	h := sha1.New()
+	for _, field := range []string{fact.Topic, fact.Subject, fact.Predicate, fact.Object} {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// factDoc returns the document stored for a fact. The expiration is only
+// stored if the fact expires.
+func factDoc(fact rbac.Fact) bson.M {
+	doc := bson.M{
+		"topic":     fact.Topic,
+		"subject":   fact.Subject,
+		"predicate": fact.Predicate,
+		"object":    fact.Object,
+	}
+	if !fact.Expires.IsZero() {
+		doc["expires"] = fact.Expires
+	}
+	return doc
+}
+
+// migrate re-keys facts stored by prior versions of the store, which were
+// not created with an id derived from their identity.
+func (s *mongoStore) migrate() error {
+	var legacy struct {
+		Id        bson.ObjectId `bson:"_id"`
+		rbac.Fact `bson:",inline"`
+	}
+	// Prior versions stored facts with generated ObjectIds.
+	iter := s.c.Find(bson.M{"_id": bson.M{"$type": 7}}).Iter()
+	for iter.Next(&legacy) {
+		err := s.runner.Run([]txn.Op{{
+			C:      s.c.Name,
+			Id:     legacy.Id,
+			Remove: true,
+		}, {
+			C:      s.c.Name,
+			Id:     factId(legacy.Fact),
+			Assert: txn.DocMissing,
+			Insert: factDoc(legacy.Fact),
+		}}, "", nil)
+		if err != nil && err != txn.ErrAborted {
+			return err
+		}
+	}
+	return iter.Close()
+}
+
 func (s *mongoStore) Assert(facts ...rbac.Fact) error {
-	var docs []interface{}
+	var changes []rbac.Change
 	for _, fact := range facts {
-		docs = append(docs, fact)
+		changes = append(changes, rbac.Change{Fact: fact})
 	}
-	err := s.c.Insert(docs...)
-	if err != nil && !mgo.IsDup(err) {
-		return err
-	}
-	return nil
+	return s.Apply(changes...)
 }
 
 func (s *mongoStore) Deny(facts ...rbac.Fact) error {
+	var changes []rbac.Change
 	for _, fact := range facts {
-		err := s.c.Remove(fact)
+		changes = append(changes, rbac.Change{Fact: fact, Deny: true})
+	}
+	return s.Apply(changes...)
+}
+
+func (s *mongoStore) Apply(changes ...rbac.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	for i := 0; i < maxTxnAttempts; i++ {
+		ops, err := s.changeOps(changes)
 		if err != nil {
 			return err
 		}
+		err = s.runner.Run(ops, "", nil)
+		if err != txn.ErrAborted {
+			return err
+		}
+		// A fact was asserted or denied concurrently. Try again.
+	}
+	return fmt.Errorf("cannot apply %d changes: too much contention", len(changes))
+}
+
+// changeOps returns the transaction operations which make a set of changes.
+// Only the last change to each fact is made, since it determines the
+// outcome.
+func (s *mongoStore) changeOps(changes []rbac.Change) ([]txn.Op, error) {
+	var ids []string
+	last := make(map[string]rbac.Change)
+	for _, change := range changes {
+		id := factId(change.Fact)
+		if _, ok := last[id]; !ok {
+			ids = append(ids, id)
+		}
+		last[id] = change
+	}
+
+	var ops []txn.Op
+	for _, id := range ids {
+		change := last[id]
+		if change.Deny {
+			ops = append(ops, txn.Op{C: s.c.Name, Id: id, Remove: true})
+			continue
+		}
+		n, err := s.c.FindId(id).Count()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			ops = append(ops, txn.Op{
+				C:      s.c.Name,
+				Id:     id,
+				Assert: txn.DocMissing,
+				Insert: factDoc(change.Fact),
+			})
+			continue
+		}
+		update := bson.M{"$unset": bson.M{"expires": 1}}
+		if !change.Expires.IsZero() {
+			update = bson.M{"$set": bson.M{"expires": change.Expires}}
+		}
+		ops = append(ops, txn.Op{
+			C:      s.c.Name,
+			Id:     id,
+			Assert: txn.DocExists,
+			Update: update,
+		})
+	}
+	return ops, nil
+}
+
+// Insert inserts a fact, or replaces it if it has expired, in a transaction
+// asserting that the fact is missing or expired. The transaction is aborted if
+// the fact is asserted concurrently.
+func (s *mongoStore) Insert(fact rbac.Fact) (bool, error) {
+	id := factId(fact)
+	n, err := s.c.FindId(id).Count()
+	if err != nil {
+		return false, err
+	}
+	op := txn.Op{C: s.c.Name, Id: id, Assert: txn.DocMissing, Insert: factDoc(fact)}
+	if n > 0 {
+		update := bson.M{"$unset": bson.M{"expires": 1}}
+		if !fact.Expires.IsZero() {
+			update = bson.M{"$set": bson.M{"expires": fact.Expires}}
+		}
+		op = txn.Op{
+			C:      s.c.Name,
+			Id:     id,
+			Assert: bson.M{"expires": bson.M{"$lte": time.Now()}},
+			Update: update,
+		}
+	}
+	err = s.runner.Run([]txn.Op{op}, "", nil)
+	if err == txn.ErrAborted {
+		return false, nil
 	}
-	return nil
+	return err == nil, err
 }
 
 func (s *mongoStore) Exists(facts ...rbac.Fact) (bool, error) {
 	for _, fact := range facts {
-		n, err := s.c.Find(fact).Count()
+		n, err := s.c.FindId(factId(fact)).Count()
 		if err != nil {
 			return false, err
 		}
@@ -0,0 +1,186 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package sql provides an rbac.FactStore over database/sql. The SQL it uses is
+// supported by both SQLite and PostgreSQL.
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/juju/affinity/rbac"
+)
+
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type sqlStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewFactStore creates an rbac.FactStore over an open database, using the
+// given table name for storing the facts. The table and its indexes are
+// created if they do not already exist.
+//
+// Facts are keyed on topic, subject, predicate and object. Every fact pattern
+// has a topic, and is served by the key when it has a subject, and otherwise
+// by the indexes on topic, predicate and object, or topic and object.
+// Subjects and objects may be of any length, as they may hold URLs or
+// serialized state.
+func NewFactStore(db *sql.DB, table string) (rbac.FactStore, error) {
+	if !validTable.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	schema := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	topic VARCHAR(255) NOT NULL,
+	subject TEXT NOT NULL,
+	predicate VARCHAR(255) NOT NULL,
+	object TEXT NOT NULL,
+	expires BIGINT,
+	PRIMARY KEY (topic, subject, predicate, object))`, table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_predicate ON %s (topic, predicate, object)`, table, table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_object ON %s (topic, object, subject)`, table, table),
+	}
+	for _, stmt := range schema {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &sqlStore{db: db, table: table}, nil
+}
+
+// expiresValue returns the expiration stored for a fact, as nanoseconds since
+// the Unix epoch, or NULL if the fact does not expire.
+func expiresValue(fact rbac.Fact) sql.NullInt64 {
+	if fact.Expires.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: fact.Expires.UnixNano(), Valid: true}
+}
+
+func (s *sqlStore) Assert(facts ...rbac.Fact) error {
+	var changes []rbac.Change
+	for _, fact := range facts {
+		changes = append(changes, rbac.Change{Fact: fact})
+	}
+	return s.Apply(changes...)
+}
+
+func (s *sqlStore) Deny(facts ...rbac.Fact) error {
+	var changes []rbac.Change
+	for _, fact := range facts {
+		changes = append(changes, rbac.Change{Fact: fact, Deny: true})
+	}
+	return s.Apply(changes...)
+}
+
+// Apply makes all the changes in a single transaction.
+func (s *sqlStore) Apply(changes ...rbac.Change) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		if change.Deny {
+			_, err = tx.Exec(fmt.Sprintf(
+				`DELETE FROM %s WHERE topic = $1 AND subject = $2 AND predicate = $3 AND object = $4`, s.table),
+				change.Topic, change.Subject, change.Predicate, change.Object)
+		} else {
+			_, err = tx.Exec(fmt.Sprintf(
+				`INSERT INTO %s (topic, subject, predicate, object, expires) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (topic, subject, predicate, object) DO UPDATE SET expires = excluded.expires`, s.table),
+				change.Topic, change.Subject, change.Predicate, change.Object, expiresValue(change.Fact))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Insert replaces a fact already in the table only if it has expired.
+func (s *sqlStore) Insert(fact rbac.Fact) (bool, error) {
+	result, err := s.db.Exec(fmt.Sprintf(
+		`INSERT INTO %s (topic, subject, predicate, object, expires) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (topic, subject, predicate, object) DO UPDATE SET expires = excluded.expires
+WHERE %s.expires IS NOT NULL AND %s.expires <= $6`, s.table, s.table, s.table),
+		fact.Topic, fact.Subject, fact.Predicate, fact.Object, expiresValue(fact), time.Now().UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) Exists(facts ...rbac.Fact) (bool, error) {
+	var match bool
+	for _, fact := range facts {
+		var n int
+		err := s.db.QueryRow(fmt.Sprintf(
+			`SELECT COUNT(*) FROM %s WHERE topic = $1 AND subject = $2 AND predicate = $3 AND object = $4`, s.table),
+			fact.Topic, fact.Subject, fact.Predicate, fact.Object).Scan(&n)
+		if err != nil {
+			return false, err
+		}
+		match = n > 0
+		if !match {
+			return match, nil
+		}
+	}
+	return match, nil
+}
+
+func (s *sqlStore) Match(pattern rbac.Fact) ([]rbac.Fact, error) {
+	query := fmt.Sprintf(`SELECT topic, subject, predicate, object, expires FROM %s WHERE topic = $1`, s.table)
+	args := []interface{}{pattern.Topic}
+	for _, field := range []struct{ column, value string }{
+		{"subject", pattern.Subject},
+		{"predicate", pattern.Predicate},
+		{"object", pattern.Object},
+	} {
+		if field.value != "" {
+			args = append(args, field.value)
+			query += fmt.Sprintf(" AND %s = $%d", field.column, len(args))
+		}
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []rbac.Fact
+	for rows.Next() {
+		var fact rbac.Fact
+		var expires sql.NullInt64
+		err = rows.Scan(&fact.Topic, &fact.Subject, &fact.Predicate, &fact.Object, &expires)
+		if err != nil {
+			return nil, err
+		}
+		if expires.Valid {
+			fact.Expires = time.Unix(0, expires.Int64)
+		}
+		result = append(result, fact)
+	}
+	return result, rows.Err()
+}
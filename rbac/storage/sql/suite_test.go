@@ -0,0 +1,67 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package sql_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	stdtesting "testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "launchpad.net/gocheck"
+
+	rbac_sql "github.com/juju/affinity/rbac/storage/sql"
+	"github.com/juju/affinity/testing"
+)
+
+type SqlSuite struct {
+	*testing.StoreSuite
+	*testing.RbacSuite
+	db *sql.DB
+}
+
+func Test(t *stdtesting.T) { TestingT(t) }
+
+var _ = Suite(&SqlSuite{})
+
+func (s *SqlSuite) SetUpTest(c *C) {
+	var err error
+	s.db, err = sql.Open("sqlite3", filepath.Join(c.MkDir(), "facts.db"))
+	c.Assert(err, IsNil)
+	{
+		store, err := rbac_sql.NewFactStore(s.db, "store_facts")
+		c.Assert(err, IsNil)
+		s.StoreSuite = testing.NewStoreSuite(store)
+		s.StoreSuite.SetUp(c)
+	}
+	{
+		store, err := rbac_sql.NewFactStore(s.db, "rbac_facts")
+		c.Assert(err, IsNil)
+		s.RbacSuite = testing.NewRbacSuite(store)
+		s.RbacSuite.SetUp(c)
+	}
+}
+
+func (s *SqlSuite) TearDownTest(c *C) {
+	c.Check(s.db.Close(), IsNil)
+}
+
+func (s *SqlSuite) TestInvalidTable(c *C) {
+	_, err := rbac_sql.NewFactStore(s.db, "facts; DROP TABLE rbac_facts")
+	c.Assert(err, ErrorMatches, `invalid table name .*`)
+}
@@ -0,0 +1,120 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package affinity
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ResponseVersion is the version of the Response envelope sent by affinity
+// services.
+const ResponseVersion = 1
+
+// Response is the JSON envelope of every response from an affinity service.
+// Result is set if the request succeeded, otherwise Error.
+type Response struct {
+	Version int
+	Result  json.RawMessage `json:",omitempty"`
+	Error   *Error          `json:",omitempty"`
+}
+
+// ErrorCode classifies an error reported by an affinity service, so that
+// clients can handle it without matching its message.
+type ErrorCode string
+
+const (
+	// CodeUnauthorized indicates that the request was not authenticated.
+	CodeUnauthorized ErrorCode = "unauthorized"
+	// CodeForbidden indicates that the user lacks permission for the request.
+	CodeForbidden ErrorCode = "forbidden"
+	// CodeNotFound indicates that a group or member does not exist.
+	CodeNotFound ErrorCode = "not-found"
+	// CodeConflict indicates that a group or member already exists.
+	CodeConflict ErrorCode = "conflict"
+	// CodeInvalidPrincipal indicates that a principal is malformed, or not
+	// supported where it was used.
+	CodeInvalidPrincipal ErrorCode = "invalid-principal"
+	// CodeBadRequest indicates any other problem with the request.
+	CodeBadRequest ErrorCode = "bad-request"
+	// CodeInternal indicates a failure of the service.
+	CodeInternal ErrorCode = "internal"
+)
+
+var codeStatus = map[ErrorCode]int{
+	CodeUnauthorized:     http.StatusUnauthorized,
+	CodeForbidden:        http.StatusForbidden,
+	CodeNotFound:         http.StatusNotFound,
+	CodeConflict:         http.StatusConflict,
+	CodeInvalidPrincipal: http.StatusBadRequest,
+	CodeBadRequest:       http.StatusBadRequest,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// StatusCode returns the HTTP status code which responds with an error of
+// this code.
+func (c ErrorCode) StatusCode() int {
+	if status, ok := codeStatus[c]; ok {
+		return status
+	}
+	return http.StatusBadRequest
+}
+
+// StatusErrorCode returns the error code for an HTTP error status.
+func StatusErrorCode(status int) ErrorCode {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// Error is an error with a code, as reported by an affinity service.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// ErrorCode returns the code of the error.
+func (e *Error) ErrorCode() ErrorCode { return e.Code }
+
+// ErrorCodeOf returns the code classifying an error. Errors are classified by
+// their ErrorCode method if they have one. ErrUnauthorized is classified as
+// CodeUnauthorized. All other errors are unclassified, and have an empty code.
+func ErrorCodeOf(err error) ErrorCode {
+	if coded, ok := err.(interface {
+		ErrorCode() ErrorCode
+	}); ok {
+		return coded.ErrorCode()
+	}
+	if err == ErrUnauthorized {
+		return CodeUnauthorized
+	}
+	return ""
+}
@@ -18,9 +18,13 @@
 package affinity
 
 import (
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"code.google.com/p/go.crypto/ssh/terminal"
 )
@@ -99,6 +103,70 @@ type TokenScheme interface {
 	Validate(token *TokenInfo) (principal Principal, err error)
 }
 
+// ScopedScheme is a scheme whose credentials may be limited to a subset of
+// the permissions held by the principal they identify.
+type ScopedScheme interface {
+	Scheme
+
+	// Scope returns the names of the permissions to which the credentials
+	// authenticating an HTTP request are limited, or nil if the credentials
+	// are not limited.
+	Scope(r *http.Request) ([]string, error)
+}
+
+// ExpiringScheme is a scheme whose credentials may expire.
+type ExpiringScheme interface {
+	Scheme
+
+	// Expires returns the time at which the credentials authenticating an
+	// HTTP request expire, or the zero time if they do not expire.
+	Expires(r *http.Request) (time.Time, error)
+}
+
+// Credentials describes a valid token: the principal it identifies, and the
+// limits on its use.
+type Credentials struct {
+	Principal Principal
+	// Scope is the names of the permissions to which the token is limited,
+	// or nil if it is not limited.
+	Scope []string
+	// Expires is the time at which the token expires, or the zero time if it
+	// does not expire.
+	Expires time.Time
+}
+
+// DescribingScheme is a token scheme which can check a token and describe
+// its limits at once, rather than looking it up again for its scope and
+// expiration.
+type DescribingScheme interface {
+	TokenScheme
+
+	// Describe checks an authorization token. If valid, returns the
+	// credentials it carries.
+	Describe(token *TokenInfo) (*Credentials, error)
+}
+
+// BasicScheme is a scheme which also accepts HTTP Basic (RFC 2617)
+// credentials, for clients which cannot obtain a token.
+type BasicScheme interface {
+	Scheme
+
+	// AuthenticateBasic checks a user name and password, and returns the
+	// user identity if they are valid.
+	AuthenticateBasic(username, password string) (principal Principal, err error)
+}
+
+// CertificateScheme is a scheme which authenticates requests by the verified
+// TLS client certificate of their connection, rather than by an
+// authorization header.
+type CertificateScheme interface {
+	Scheme
+
+	// AuthenticateCertificate maps a verified client certificate to a user
+	// identity.
+	AuthenticateCertificate(cert *x509.Certificate) (principal Principal, err error)
+}
+
 // HandshakeScheme handles handshake identity protocols such as OpenID or OAuth 2
 // for HTTP services.
 type HandshakeScheme interface {
@@ -157,6 +225,41 @@ func (sm *SchemeMap) HandshakeAll() []HandshakeScheme {
 	return result
 }
 
+// BasicAll retrieves all registered schemes which accept HTTP Basic
+// credentials.
+func (sm *SchemeMap) BasicAll() []BasicScheme {
+	var result []BasicScheme
+	for _, v := range sm.schemes {
+		if s, is := v.(BasicScheme); is {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// CertificateAll retrieves all registered schemes which authenticate TLS
+// client certificates.
+func (sm *SchemeMap) CertificateAll() []CertificateScheme {
+	var result []CertificateScheme
+	for _, v := range sm.schemes {
+		if s, is := v.(CertificateScheme); is {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// TokenAll retrieves all registered token schemes.
+func (sm *SchemeMap) TokenAll() []TokenScheme {
+	var result []TokenScheme
+	for _, v := range sm.schemes {
+		if s, is := v.(TokenScheme); is {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 // Token retrieves a token scheme by name, or nil.
 func (sm *SchemeMap) Token(name string) TokenScheme {
 	s, has := sm.schemes[name]
@@ -205,3 +308,21 @@ func AuthRequestToken(scheme TokenScheme, r *http.Request) (Principal, error) {
 	}
 	return Principal{}, ErrUnauthorized
 }
+
+// ParseBasicAuth parses an HTTP Basic authorization header into its user name
+// and password.
+func ParseBasicAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.Index(string(decoded), ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return string(decoded[:i]), string(decoded[i+1:]), true
+}
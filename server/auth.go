@@ -0,0 +1,363 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server
+
+// This file contains the authentication pipeline of an AuthServer.
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/juju/affinity"
+)
+
+// Methods by which a request may be authenticated.
+const (
+	MethodToken       = "token"
+	MethodBasic       = "basic"
+	MethodCertificate = "certificate"
+	MethodHandshake   = "handshake"
+	MethodAnonymous   = "anonymous"
+)
+
+// AuthResult records how a request was authenticated.
+type AuthResult struct {
+	// Principal is the authenticated user. It is the zero value for
+	// anonymous requests.
+	Principal affinity.Principal
+	// Scheme is the scheme which authenticated the request, or nil for
+	// anonymous requests.
+	Scheme affinity.Scheme
+	// Method is the means by which the request was authenticated.
+	Method string
+	// Scope is the names of the permissions to which the request's
+	// credentials are limited, or nil if they are not limited.
+	Scope []string
+	// Expires is the time at which the request's credentials expire, or
+	// the zero time if they do not expire.
+	Expires time.Time
+
+	// described is true if Scope and Expires were given when the request
+	// was authenticated.
+	described bool
+}
+
+// Anonymous reports whether the request was not authenticated.
+func (r *AuthResult) Anonymous() bool {
+	return r.Method == MethodAnonymous
+}
+
+// Authenticator authenticates a request by one method, with the schemes
+// allowed by a policy. It returns a nil result if the request does not carry
+// credentials it can check, and an error if the credentials are invalid.
+type Authenticator func(schemes []affinity.Scheme, r *http.Request) (*AuthResult, error)
+
+// DefaultAuthenticators returns the authenticators tried by a new
+// AuthServer: authorization tokens, HTTP Basic credentials, TLS client
+// certificates, and then handshake sessions.
+func DefaultAuthenticators() []Authenticator {
+	return []Authenticator{TokenAuth, BasicAuth, CertificateAuth, HandshakeAuth}
+}
+
+// TokenAuth validates the tokens in a request's authorization headers with
+// the token schemes they name. Schemes which describe their tokens give the
+// scope and expiration of the token at the same time.
+func TokenAuth(schemes []affinity.Scheme, r *http.Request) (*AuthResult, error) {
+	var lastErr error
+	for _, auth := range r.Header[http.CanonicalHeaderKey("Authorization")] {
+		token, err := affinity.ParseTokenInfo(auth)
+		if err != nil {
+			continue
+		}
+		for _, scheme := range schemes {
+			tokenScheme, ok := scheme.(affinity.TokenScheme)
+			if !ok || scheme.Name() != token.Scheme {
+				continue
+			}
+			if describing, ok := scheme.(affinity.DescribingScheme); ok {
+				creds, err := describing.Describe(token)
+				if err != nil {
+					lastErr = err
+					continue
+				}
+				return &AuthResult{Principal: creds.Principal, Scheme: scheme, Method: MethodToken,
+					Scope: creds.Scope, Expires: creds.Expires, described: true}, nil
+			}
+			user, err := tokenScheme.Validate(token)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return &AuthResult{Principal: user, Scheme: scheme, Method: MethodToken}, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// BasicAuth checks the HTTP Basic credentials in a request's authorization
+// headers with the schemes that accept them.
+func BasicAuth(schemes []affinity.Scheme, r *http.Request) (*AuthResult, error) {
+	var lastErr error
+	for _, auth := range r.Header[http.CanonicalHeaderKey("Authorization")] {
+		username, password, ok := affinity.ParseBasicAuth(auth)
+		if !ok {
+			continue
+		}
+		for _, scheme := range schemes {
+			basicScheme, ok := scheme.(affinity.BasicScheme)
+			if !ok {
+				continue
+			}
+			user, err := basicScheme.AuthenticateBasic(username, password)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return &AuthResult{Principal: user, Scheme: scheme, Method: MethodBasic}, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// CertificateAuth maps the verified TLS client certificate of a request's
+// connection with the schemes that accept certificates.
+func CertificateAuth(schemes []affinity.Scheme, r *http.Request) (*AuthResult, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	var lastErr error
+	for _, scheme := range schemes {
+		certScheme, ok := scheme.(affinity.CertificateScheme)
+		if !ok {
+			continue
+		}
+		user, err := certScheme.AuthenticateCertificate(cert)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return &AuthResult{Principal: user, Scheme: scheme, Method: MethodCertificate}, nil
+	}
+	return nil, lastErr
+}
+
+// HandshakeAuth authenticates a request by the sessions established with
+// handshake schemes. Every handshake scheme is tried until one succeeds.
+func HandshakeAuth(schemes []affinity.Scheme, r *http.Request) (*AuthResult, error) {
+	var lastErr error
+	for _, scheme := range schemes {
+		handshakeScheme, ok := scheme.(affinity.HandshakeScheme)
+		if !ok {
+			continue
+		}
+		user, err := handshakeScheme.Authenticate(r)
+		if err == affinity.ErrUnauthorized {
+			continue
+		} else if err != nil {
+			lastErr = err
+			continue
+		}
+		return &AuthResult{Principal: user, Scheme: scheme, Method: MethodHandshake}, nil
+	}
+	return nil, lastErr
+}
+
+// Policy determines how the requests to a route must be authenticated.
+type Policy struct {
+	// Optional allows requests which cannot be authenticated, as anonymous.
+	Optional bool
+	// Schemes, if not empty, are the names of the only schemes allowed to
+	// authenticate requests.
+	Schemes []string
+}
+
+var (
+	// Required requires requests to be authenticated by any scheme.
+	Required = Policy{}
+	// Optional authenticates requests if possible, allowing anonymous
+	// requests otherwise.
+	Optional = Policy{Optional: true}
+)
+
+// RequireScheme requires requests to be authenticated by one of the given
+// schemes.
+func RequireScheme(names ...string) Policy {
+	return Policy{Schemes: names}
+}
+
+func (p Policy) allows(name string) bool {
+	if len(p.Schemes) == 0 {
+		return true
+	}
+	for _, allowed := range p.Schemes {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// schemes returns the registered schemes allowed by a policy, in name order.
+func (s *AuthServer) schemes(policy Policy) []affinity.Scheme {
+	var names []string
+	for _, scheme := range s.Schemes.TokenAll() {
+		names = append(names, scheme.Name())
+	}
+	for _, scheme := range s.Schemes.HandshakeAll() {
+		names = append(names, scheme.Name())
+	}
+	for _, scheme := range s.Schemes.BasicAll() {
+		names = append(names, scheme.Name())
+	}
+	for _, scheme := range s.Schemes.CertificateAll() {
+		names = append(names, scheme.Name())
+	}
+	sort.Strings(names)
+	var result []affinity.Scheme
+	for i, name := range names {
+		if (i > 0 && names[i-1] == name) || !policy.allows(name) {
+			continue
+		}
+		result = append(result, s.Schemes.Scheme(name))
+	}
+	return result
+}
+
+type authResultKey struct{}
+
+// AuthResultOf returns how a request was authenticated, if it was
+// authenticated by Protect.
+func AuthResultOf(r *http.Request) (*AuthResult, bool) {
+	return AuthResultFromContext(r.Context())
+}
+
+// AuthResultFromContext returns the authentication result carried by a
+// request context.
+func AuthResultFromContext(ctx context.Context) (*AuthResult, bool) {
+	result, ok := ctx.Value(authResultKey{}).(*AuthResult)
+	return result, ok
+}
+
+// WithAuthResult returns a copy of a context which carries an
+// authentication result.
+func WithAuthResult(ctx context.Context, result *AuthResult) context.Context {
+	return context.WithValue(ctx, authResultKey{}, result)
+}
+
+// AuthenticateRequest authenticates a request according to a policy, trying
+// each of the server's authenticators in turn. A request already
+// authenticated by Protect is not authenticated again, but its result must
+// still satisfy the policy. A request whose authorization credentials are
+// rejected fails to authenticate, even if the policy is optional.
+func (s *AuthServer) AuthenticateRequest(r *http.Request, policy Policy) (*AuthResult, error) {
+	schemes := s.schemes(policy)
+	if result, ok := AuthResultOf(r); ok {
+		if !result.Anonymous() && allowsScheme(schemes, result.Scheme) {
+			return result, nil
+		}
+		if policy.Optional {
+			return &AuthResult{Method: MethodAnonymous}, nil
+		}
+		return nil, affinity.ErrUnauthorized
+	}
+	rejected := false
+	for _, authenticator := range s.Authenticators {
+		result, err := authenticator(schemes, r)
+		if err != nil {
+			log.Println("authentication failed:", err)
+			rejected = true
+			continue
+		}
+		if result == nil {
+			continue
+		}
+		if result.described {
+			return result, nil
+		}
+		if scoped, ok := result.Scheme.(affinity.ScopedScheme); ok {
+			result.Scope, err = scoped.Scope(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if expiring, ok := result.Scheme.(affinity.ExpiringScheme); ok && result.Method == MethodToken {
+			result.Expires, err = expiring.Expires(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+	if policy.Optional && !(rejected && r.Header.Get("Authorization") != "") {
+		return &AuthResult{Method: MethodAnonymous}, nil
+	}
+	return nil, affinity.ErrUnauthorized
+}
+
+// allowsScheme reports whether a scheme is among those allowed.
+func allowsScheme(schemes []affinity.Scheme, scheme affinity.Scheme) bool {
+	for _, allowed := range schemes {
+		if allowed == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// Protect wraps a handler so that its requests are authenticated according
+// to a policy. Requests which fail to authenticate are challenged to do so.
+// The handler obtains the result with AuthResultOf. The result is passed in
+// a copy of the request, which keeps its route variables only with a release
+// of gorilla/mux that stores them in the request context, as pinned in
+// dependencies.tsv.
+func (s *AuthServer) Protect(policy Policy, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := s.AuthenticateRequest(r, policy)
+		if err != nil {
+			resp := s.Unauthorized(r, err)
+			resp.Challenges = s.challenges(r, policy)
+			resp.Send(w)
+			return
+		}
+		h(w, r.WithContext(WithAuthResult(r.Context(), result)))
+	}
+}
+
+// Authenticate authenticates a request by any scheme.
+func (s *AuthServer) Authenticate(r *http.Request) (user affinity.Principal, err error) {
+	result, err := s.AuthenticateRequest(r, Required)
+	if err != nil {
+		return affinity.Principal{}, err
+	}
+	return result.Principal, nil
+}
+
+// AuthenticateScope authenticates a request, and also returns the names of the
+// permissions to which the request's credentials are limited, or nil if the
+// credentials are not limited.
+func (s *AuthServer) AuthenticateScope(r *http.Request) (user affinity.Principal, scope []string, err error) {
+	result, err := s.AuthenticateRequest(r, Required)
+	if err != nil {
+		return affinity.Principal{}, nil, err
+	}
+	return result.Principal, result.Scope, nil
+}
@@ -0,0 +1,250 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gorilla/mux"
+	. "launchpad.net/gocheck"
+
+	. "github.com/juju/affinity"
+	"github.com/juju/affinity/rbac/storage/mem"
+	"github.com/juju/affinity/server"
+)
+
+type AuthSuite struct {
+	*httptest.Server
+	auth *server.AuthServer
+}
+
+var _ = Suite(&AuthSuite{})
+
+// MockHandshakeScheme authenticates every request as a fixed user, or fails
+// with a fixed error.
+type MockHandshakeScheme struct {
+	name string
+	user Principal
+	err  error
+}
+
+func (s *MockHandshakeScheme) Name() string { return s.name }
+
+func (s *MockHandshakeScheme) Authenticate(r *http.Request) (Principal, error) {
+	return s.user, s.err
+}
+
+func (s *MockHandshakeScheme) SignIn(w http.ResponseWriter, r *http.Request) error { return nil }
+
+func (s *MockHandshakeScheme) Authenticated(w http.ResponseWriter, r *http.Request) {}
+
+// MockDescribingScheme authenticates tokens like MockScheme, describing them
+// with a fixed scope, and counts the lookups made.
+type MockDescribingScheme struct {
+	MockScheme
+	lookups int
+}
+
+func (s *MockDescribingScheme) Describe(token *TokenInfo) (*Credentials, error) {
+	s.lookups++
+	user, err := s.MockScheme.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Credentials{Principal: user, Scope: []string{"check-member"}}, nil
+}
+
+func (s *MockDescribingScheme) Validate(token *TokenInfo) (Principal, error) {
+	s.lookups++
+	return s.MockScheme.Validate(token)
+}
+
+func (s *MockDescribingScheme) Scope(r *http.Request) ([]string, error) {
+	s.lookups++
+	return nil, nil
+}
+
+type authResult struct {
+	User, Scheme, Method string
+}
+
+func (ss *AuthSuite) SetUpTest(c *C) {
+	ss.auth = server.NewAuthServer(mem.NewFactStore())
+	ss.auth.Schemes.Register(&MockScheme{})
+	whoami := func(w http.ResponseWriter, r *http.Request) {
+		result, ok := server.AuthResultOf(r)
+		c.Assert(ok, Equals, true)
+		resp := authResult{Method: result.Method}
+		if !result.Anonymous() {
+			resp.User, resp.Scheme = result.Principal.String(), result.Scheme.Name()
+		}
+		(&server.Response{Result: resp}).Send(w)
+	}
+	ss.auth.HandleFunc("/required", ss.auth.Protect(server.Required, whoami))
+	ss.auth.HandleFunc("/optional", ss.auth.Protect(server.Optional, whoami))
+	ss.auth.HandleFunc("/session", ss.auth.Protect(server.RequireScheme("session"), whoami))
+	ss.Server = httptest.NewServer(ss.auth)
+}
+
+func (ss *AuthSuite) TearDownTest(c *C) {
+	ss.Server.Close()
+}
+
+func (ss *AuthSuite) get(c *C, path string, user string) (*http.Response, *authResult) {
+	req, err := http.NewRequest("GET", ss.URL+path, nil)
+	c.Assert(err, IsNil)
+	if user != "" {
+		tokenInfo, err := (&MockScheme{}).Authorize(MustParsePrincipal(user))
+		c.Assert(err, IsNil)
+		req.Header.Set("Authorization", tokenInfo.Serialize())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	var envelope struct {
+		Result *authResult
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&envelope), IsNil)
+	return resp, envelope.Result
+}
+
+func (ss *AuthSuite) TestPolicies(c *C) {
+	resp, result := ss.get(c, "/required", "mock:fry")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(*result, Equals, authResult{"mock:fry", "mock", server.MethodToken})
+
+	resp, _ = ss.get(c, "/required", "")
+	c.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	resp, result = ss.get(c, "/optional", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(*result, Equals, authResult{Method: server.MethodAnonymous})
+	resp, result = ss.get(c, "/optional", "mock:fry")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(result.User, Equals, "mock:fry")
+
+	// Only the schemes allowed by the policy authenticate, and are challenged.
+	resp, _ = ss.get(c, "/session", "mock:fry")
+	c.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Check(resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")], HasLen, 0)
+	ss.auth.Schemes.Register(&MockHandshakeScheme{name: "session", user: MustParsePrincipal("mock:leela")})
+	resp, result = ss.get(c, "/session", "mock:fry")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(*result, Equals, authResult{"mock:leela", "session", server.MethodHandshake})
+}
+
+func (ss *AuthSuite) TestHandshakeChain(c *C) {
+	// A failing handshake scheme does not prevent the next from succeeding.
+	ss.auth.Schemes.Register(&MockHandshakeScheme{name: "broken", err: fmt.Errorf("session store unavailable")})
+	ss.auth.Schemes.Register(&MockHandshakeScheme{name: "nobody", err: ErrUnauthorized})
+	ss.auth.Schemes.Register(&MockHandshakeScheme{name: "session", user: MustParsePrincipal("mock:leela")})
+	resp, result := ss.get(c, "/required", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(*result, Equals, authResult{"mock:leela", "session", server.MethodHandshake})
+
+	// Tokens are tried before handshake sessions.
+	resp, result = ss.get(c, "/required", "mock:fry")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(*result, Equals, authResult{"mock:fry", "mock", server.MethodToken})
+
+	// The order of authentication methods is configurable.
+	ss.auth.Authenticators = []server.Authenticator{server.HandshakeAuth, server.TokenAuth}
+	resp, result = ss.get(c, "/required", "mock:fry")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Check(result.User, Equals, "mock:leela")
+}
+
+func (ss *AuthSuite) TestProtectRouteVars(c *C) {
+	// Route variables remain available to a protected handler.
+	ss.auth.HandleFunc("/vars/{name}", ss.auth.Protect(server.Required, func(w http.ResponseWriter, r *http.Request) {
+		(&server.Response{Result: mux.Vars(r)["name"]}).Send(w)
+	}))
+	req, err := http.NewRequest("GET", ss.URL+"/vars/nibbler", nil)
+	c.Assert(err, IsNil)
+	tokenInfo, err := (&MockScheme{}).Authorize(MustParsePrincipal("mock:fry"))
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", tokenInfo.Serialize())
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	var envelope struct {
+		Result string
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&envelope), IsNil)
+	c.Check(envelope.Result, Equals, "nibbler")
+}
+
+func (ss *AuthSuite) TestRejectedCredentials(c *C) {
+	// Credentials which fail validation are not served as anonymous.
+	req, err := http.NewRequest("GET", ss.URL+"/optional", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", `mock data="bogus"`)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	c.Check(resp.Header.Get("WWW-Authenticate"), Matches, `mock error="invalid_token", .*`)
+}
+
+func (ss *AuthSuite) TestProtectedPolicy(c *C) {
+	// A result authenticated by Protect must satisfy later policies.
+	ss.auth.HandleFunc("/nested", ss.auth.Protect(server.Optional, func(w http.ResponseWriter, r *http.Request) {
+		var resp authResult
+		if _, err := ss.auth.Authenticate(r); err != nil {
+			resp.Method = "required: " + err.Error()
+		} else if _, err := ss.auth.AuthenticateRequest(r, server.RequireScheme("session")); err != nil {
+			resp.Method = "session: " + err.Error()
+		}
+		(&server.Response{Result: resp}).Send(w)
+	}))
+	_, result := ss.get(c, "/nested", "")
+	c.Check(result.Method, Equals, "required: "+ErrUnauthorized.Error())
+	_, result = ss.get(c, "/nested", "mock:fry")
+	c.Check(result.Method, Equals, "session: "+ErrUnauthorized.Error())
+}
+
+func (ss *AuthSuite) TestDescribedTokens(c *C) {
+	scheme := &MockDescribingScheme{}
+	auth := server.NewAuthServer(mem.NewFactStore())
+	auth.Schemes.Register(scheme)
+	var result *server.AuthResult
+	auth.HandleFunc("/required", auth.Protect(server.Required, func(w http.ResponseWriter, r *http.Request) {
+		result, _ = server.AuthResultOf(r)
+	}))
+	srv := httptest.NewServer(auth)
+	defer srv.Close()
+
+	// A token is looked up once to authenticate the request and describe
+	// its scope.
+	req, err := http.NewRequest("GET", srv.URL+"/required", nil)
+	c.Assert(err, IsNil)
+	tokenInfo, err := scheme.Authorize(MustParsePrincipal("mock:fry"))
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", tokenInfo.Serialize())
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(result, NotNil)
+	c.Check(result.Principal, Equals, MustParsePrincipal("mock:fry"))
+	c.Check(result.Scope, DeepEquals, []string{"check-member"})
+	c.Check(scheme.lookups, Equals, 1)
+}
@@ -21,11 +21,15 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/juju/affinity"
 	"github.com/juju/affinity/group"
+	"github.com/juju/affinity/providers/apitoken"
 	"github.com/juju/affinity/rbac"
 	"github.com/juju/affinity/server"
 )
@@ -37,11 +41,42 @@ type GroupServer struct {
 
 func NewGroupServer(store rbac.FactStore) *GroupServer {
 	s := &GroupServer{server.NewAuthServer(store)}
-	s.HandleFunc("/{group}/", s.HandleGroup)
-	s.HandleFunc("/{group}/{user}/", s.HandleUser)
+	s.HandleFunc("/_/whoami", s.Protect(server.Required, s.HandleWhoami))
+	s.HandleFunc("/_/groups/{user}", s.Protect(server.Required, s.HandleGroupsOf))
+	s.HandleFunc("/_/managed", s.Protect(server.Required, s.HandleManaged))
+	s.HandleFunc("/_/tokens", s.Protect(server.Required, s.HandleTokens))
+	s.HandleFunc("/_/tokens/{id}", s.Protect(server.Required, s.HandleTokens))
+	s.HandleFunc("/_/roles", s.Protect(server.Required, s.HandleRoles))
+	s.HandleFunc("/_/roles/{role}/{user}", s.Protect(server.Required, s.HandleRoles))
+	s.HandleFunc("/{group}/_/roles", s.Protect(server.Required, s.HandleRoles))
+	s.HandleFunc("/{group}/_/roles/{role}/{user}", s.Protect(server.Required, s.HandleRoles))
+	s.HandleFunc("/{group}/", s.Protect(server.Required, s.HandleGroup))
+	s.HandleFunc("/{group}/{user}/", s.Protect(server.Required, s.HandleUser))
+	s.HandleFunc("/{group}/{user}/why", s.Protect(server.Required, s.HandleWhy))
 	return s
 }
 
+// groupService authenticates a request, and returns a group service acting as
+// the authenticated user within the scope of the request's credentials.
+func (s *GroupServer) groupService(r *http.Request) (*group.GroupService, *server.Response) {
+	authUser, scope, err := s.AuthenticateScope(r)
+	if err != nil {
+		return nil, s.Unauthorized(r, fmt.Errorf("auth failed: %q", err))
+	}
+	groupSrv := group.NewGroupService(s.Store, authUser)
+	groupSrv.Scope = scope
+	return groupSrv, nil
+}
+
+// parsePrincipal parses a principal given in a request.
+func parsePrincipal(s string) (affinity.Principal, error) {
+	p, err := affinity.ParsePrincipal(s)
+	if err != nil {
+		return p, &affinity.Error{Code: affinity.CodeInvalidPrincipal, Message: err.Error()}
+	}
+	return p, nil
+}
+
 func (s *GroupServer) HandleGroup(w http.ResponseWriter, r *http.Request) {
 	resp := s.handleGroup(r)
 	resp.Send(w)
@@ -52,26 +87,19 @@ func (s *GroupServer) handleGroup(r *http.Request) *server.Response {
 	vars := mux.Vars(r)
 	g := affinity.Principal{Scheme: group.SchemeName, Id: vars["group"]}
 
-	authUser, err := s.Authenticate(r)
-	if err != nil {
-		return &server.Response{
-			Error:      fmt.Errorf("auth failed: %q", err),
-			StatusCode: http.StatusUnauthorized,
-		}
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
 	}
 
-	groupSrv := group.NewGroupService(s.Store, authUser)
-
 	switch r.Method {
 	case "PUT":
-		err = groupSrv.AddGroup(g)
+		err := groupSrv.AddGroup(g)
 		return &server.Response{Error: err}
 	case "GET":
-		resp := &server.Response{Error: err}
-		resp.Write([]byte(g.String()))
-		return resp
+		return listMembers(groupSrv, g, r)
 	case "DELETE":
-		err = groupSrv.RemoveGroup(g)
+		err := groupSrv.RemoveGroup(g)
 		return &server.Response{Error: err}
 	}
 	return &server.Response{
@@ -90,29 +118,29 @@ func (s *GroupServer) handleUser(r *http.Request) *server.Response {
 	vars := mux.Vars(r)
 	g := affinity.Principal{Scheme: group.SchemeName, Id: vars["group"]}
 	userString := vars["user"]
-	user, err := affinity.ParsePrincipal(userString)
+	user, err := parsePrincipal(userString)
 	if err != nil {
 		return &server.Response{Error: err}
 	}
 
-	authUser, err := s.Authenticate(r)
-	if err != nil {
-		return &server.Response{
-			Error:      fmt.Errorf("auth failed: %q", err),
-			StatusCode: http.StatusUnauthorized,
-		}
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
 	}
 
-	groupSrv := group.NewGroupService(s.Store, authUser)
-
 	switch r.Method {
 	case "GET":
-		has, err := groupSrv.CheckMember(g, user)
+		transitive, maxDepth, err := memberQuery(r)
+		if err != nil {
+			return &server.Response{Error: err, StatusCode: http.StatusBadRequest}
+		}
+		groupSrv.MaxMemberDepth = maxDepth
+		has, err := groupSrv.CheckMember(g, user, transitive)
 		if err != nil {
 			return &server.Response{Error: err}
 		}
 		if !has {
-			return &server.Response{StatusCode: http.StatusNotFound}
+			return &server.Response{Error: &group.NotFoundError{Group: g, Member: &user}}
 		}
 		return &server.Response{}
 	case "PUT":
@@ -127,3 +155,392 @@ func (s *GroupServer) handleUser(r *http.Request) *server.Response {
 		StatusCode: http.StatusMethodNotAllowed,
 	}
 }
+
+const (
+	// defaultMemberPageSize is the number of members listed per page, unless
+	// a limit is requested.
+	defaultMemberPageSize = 100
+	// maxMemberPageSize is the largest number of members listed per page.
+	maxMemberPageSize = 1000
+)
+
+// listMembers responds with a page of the group's members. The "offset" and
+// "limit" query parameters select the page, and "recursive" includes the
+// members of nested groups.
+func listMembers(groupSrv *group.GroupService, g affinity.Principal, r *http.Request) *server.Response {
+	query := r.URL.Query()
+	var recursive bool
+	var err error
+	if v := query.Get("recursive"); v != "" {
+		recursive, err = strconv.ParseBool(v)
+		if err != nil {
+			return &server.Response{Error: fmt.Errorf("invalid recursive parameter: %q", v),
+				StatusCode: http.StatusBadRequest}
+		}
+	}
+	offset, limit := 0, defaultMemberPageSize
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return &server.Response{Error: fmt.Errorf("invalid offset parameter: %q", v),
+				StatusCode: http.StatusBadRequest}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return &server.Response{Error: fmt.Errorf("invalid limit parameter: %q", v),
+				StatusCode: http.StatusBadRequest}
+		}
+		if limit > maxMemberPageSize {
+			limit = maxMemberPageSize
+		}
+	}
+
+	members, err := groupSrv.Members(g, recursive)
+	if err != nil {
+		return &server.Response{Error: err}
+	}
+	list := &group.MemberList{Group: g, Offset: offset, Total: len(members)}
+	if offset < len(members) {
+		end := offset + limit
+		if end > len(members) {
+			end = len(members)
+		}
+		list.Members = members[offset:end]
+	}
+	return &server.Response{Result: list}
+}
+
+// memberQuery parses the query parameters of a membership check. The
+// "transitive" parameter follows nested groups, to at most "depth" levels if
+// given.
+func memberQuery(r *http.Request) (transitive bool, maxDepth int, err error) {
+	query := r.URL.Query()
+	if v := query.Get("transitive"); v != "" {
+		transitive, err = strconv.ParseBool(v)
+		if err != nil {
+			return false, 0, fmt.Errorf("invalid transitive parameter: %q", v)
+		}
+	}
+	if v := query.Get("depth"); v != "" {
+		maxDepth, err = strconv.Atoi(v)
+		if err != nil || maxDepth < 0 {
+			return false, 0, fmt.Errorf("invalid depth parameter: %q", v)
+		}
+	}
+	return transitive, maxDepth, nil
+}
+
+func (s *GroupServer) HandleWhy(w http.ResponseWriter, r *http.Request) {
+	resp := s.handleWhy(r)
+	resp.Send(w)
+}
+
+func (s *GroupServer) handleWhy(r *http.Request) *server.Response {
+	log.Println(r)
+	vars := mux.Vars(r)
+	g := affinity.Principal{Scheme: group.SchemeName, Id: vars["group"]}
+	userString := vars["user"]
+	user, err := parsePrincipal(userString)
+	if err != nil {
+		return &server.Response{Error: err}
+	}
+	perm, err := group.GroupPermission(r.URL.Query().Get("perm"))
+	if err != nil {
+		return &server.Response{Error: err}
+	}
+
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
+	}
+
+	switch r.Method {
+	case "GET":
+		explanation, err := groupSrv.Explain(user, perm, g)
+		if err != nil {
+			return &server.Response{Error: err}
+		}
+		return &server.Response{Result: explanation}
+	}
+	return &server.Response{
+		Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+}
+
+func (s *GroupServer) HandleWhoami(w http.ResponseWriter, r *http.Request) {
+	resp := s.handleWhoami(r)
+	resp.Send(w)
+}
+
+func (s *GroupServer) handleWhoami(r *http.Request) *server.Response {
+	log.Println(r)
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
+	}
+
+	switch r.Method {
+	case "GET":
+		return &server.Response{Result: groupSrv.AsUser}
+	}
+	return &server.Response{
+		Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+}
+
+func (s *GroupServer) HandleGroupsOf(w http.ResponseWriter, r *http.Request) {
+	resp := s.handleGroupsOf(r)
+	resp.Send(w)
+}
+
+func (s *GroupServer) handleGroupsOf(r *http.Request) *server.Response {
+	log.Println(r)
+	vars := mux.Vars(r)
+	user, err := parsePrincipal(vars["user"])
+	if err != nil {
+		return &server.Response{Error: err}
+	}
+
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
+	}
+
+	switch r.Method {
+	case "GET":
+		groups, err := groupSrv.GroupsOf(user)
+		if err != nil {
+			return &server.Response{Error: err}
+		}
+		return &server.Response{Result: groups}
+	}
+	return &server.Response{
+		Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+}
+
+func (s *GroupServer) HandleManaged(w http.ResponseWriter, r *http.Request) {
+	resp := s.handleManaged(r)
+	resp.Send(w)
+}
+
+func (s *GroupServer) handleManaged(r *http.Request) *server.Response {
+	log.Println(r)
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
+	}
+
+	switch r.Method {
+	case "GET":
+		groups, err := groupSrv.ManagedGroups()
+		if err != nil {
+			return &server.Response{Error: err}
+		}
+		return &server.Response{Result: groups}
+	}
+	return &server.Response{
+		Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+}
+
+// HandleRoles lists the roles granted on a group, or on the service if no
+// group is given. Given a role and user, it grants or revokes that role.
+func (s *GroupServer) HandleRoles(w http.ResponseWriter, r *http.Request) {
+	resp := s.handleRoles(r)
+	resp.Send(w)
+}
+
+func (s *GroupServer) handleRoles(r *http.Request) *server.Response {
+	log.Println(r)
+	vars := mux.Vars(r)
+	var g *affinity.Principal
+	if groupId, ok := vars["group"]; ok {
+		g = &affinity.Principal{Scheme: group.SchemeName, Id: groupId}
+	}
+
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
+	}
+
+	if _, ok := vars["role"]; !ok {
+		switch r.Method {
+		case "GET":
+			var grants []group.RoleGrant
+			var err error
+			if g != nil {
+				grants, err = groupSrv.RolesOnGroup(*g)
+			} else {
+				grants, err = groupSrv.RolesOnService()
+			}
+			if err != nil {
+				return &server.Response{Error: err}
+			}
+			return &server.Response{Result: grants}
+		}
+		return &server.Response{
+			Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+			StatusCode: http.StatusMethodNotAllowed,
+		}
+	}
+
+	role, err := group.GroupRole(vars["role"])
+	if err != nil {
+		return &server.Response{Error: err}
+	}
+	user, err := parsePrincipal(vars["user"])
+	if err != nil {
+		return &server.Response{Error: err}
+	}
+
+	switch r.Method {
+	case "PUT":
+		if g != nil {
+			err = groupSrv.GrantOnGroup(user, role, *g)
+		} else {
+			err = groupSrv.GrantOnService(user, role)
+		}
+		return &server.Response{Error: err}
+	case "DELETE":
+		if g != nil {
+			err = groupSrv.RevokeOnGroup(user, role, *g)
+		} else {
+			err = groupSrv.RevokeOnService(user, role)
+		}
+		return &server.Response{Error: err}
+	}
+	return &server.Response{
+		Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+}
+
+// HandleTokens lists, mints and revokes the authenticated user's API tokens.
+// Tokens are only available if the apitoken scheme is registered. Credentials
+// limited to a scope must include the manage-tokens permission.
+func (s *GroupServer) HandleTokens(w http.ResponseWriter, r *http.Request) {
+	resp := s.handleTokens(r)
+	resp.Send(w)
+}
+
+func (s *GroupServer) handleTokens(r *http.Request) *server.Response {
+	log.Println(r)
+	vars := mux.Vars(r)
+	tokens, ok := s.Schemes.Scheme(apitoken.SchemeName).(*apitoken.Scheme)
+	if !ok {
+		return &server.Response{Error: fmt.Errorf("API tokens are not enabled"),
+			StatusCode: http.StatusNotFound}
+	}
+
+	groupSrv, errResp := s.groupService(r)
+	if errResp != nil {
+		return errResp
+	}
+	if err := groupSrv.CanManageTokens(); err != nil {
+		return &server.Response{Error: err}
+	}
+
+	if id, ok := vars["id"]; ok {
+		switch r.Method {
+		case "DELETE":
+			err := tokens.Revoke(groupSrv.AsUser, id)
+			return &server.Response{Error: err}
+		}
+		return &server.Response{
+			Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+			StatusCode: http.StatusMethodNotAllowed,
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		owned, err := tokens.Tokens(groupSrv.AsUser)
+		if err != nil {
+			return &server.Response{Error: err}
+		}
+		return &server.Response{Result: owned}
+	case "POST":
+		result, err := s.AuthenticateRequest(r, server.Required)
+		if err != nil {
+			return s.Unauthorized(r, err)
+		}
+		name, scope, expires, err := mintQuery(r, groupSrv.Scope, result.Expires)
+		if err != nil {
+			return &server.Response{Error: err}
+		}
+		token, tokenInfo, err := tokens.MintUntil(groupSrv.AsUser, name, scope, expires)
+		if err != nil {
+			return &server.Response{Error: err}
+		}
+		return &server.Response{Result: &apitoken.MintedToken{
+			Token:         *token,
+			Authorization: tokenInfo.Serialize(),
+		}}
+	}
+	return &server.Response{
+		Error:      fmt.Errorf("unsupported HTTP method: %q", r.Method),
+		StatusCode: http.StatusMethodNotAllowed,
+	}
+}
+
+// mintQuery parses the query parameters for minting a token. The "scope"
+// parameter is a comma-separated list of permission names, and "ttl" is a
+// duration such as "720h". A token minted with credentials limited to a scope
+// must be limited to the same or a narrower scope. A token minted with
+// credentials which expire at limitExpires, if not zero, expires no later than
+// they do. The expiration of the token is returned, or the zero time if it
+// does not expire.
+func mintQuery(r *http.Request, limit []string, limitExpires time.Time) (name string, scope []string, expires time.Time, err error) {
+	query := r.URL.Query()
+	name = query.Get("name")
+	if v := query.Get("scope"); v != "" {
+		for _, permName := range strings.Split(v, ",") {
+			perm, err := group.Permission(strings.TrimSpace(permName))
+			if err != nil {
+				return "", nil, time.Time{}, err
+			}
+			scope = append(scope, perm.Perm())
+		}
+	}
+	if limit != nil {
+		if len(scope) == 0 {
+			scope = limit
+		}
+		allowed := make(map[string]bool)
+		for _, permName := range limit {
+			allowed[permName] = true
+		}
+		for _, permName := range scope {
+			if !allowed[permName] {
+				return "", nil, time.Time{}, &affinity.Error{Code: affinity.CodeForbidden,
+					Message: fmt.Sprintf("scope %q exceeds that of the current credentials", permName)}
+			}
+		}
+	}
+	if v := query.Get("ttl"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl < 0 {
+			return "", nil, time.Time{}, &affinity.Error{Code: affinity.CodeBadRequest,
+				Message: fmt.Sprintf("invalid ttl parameter: %q", v)}
+		}
+		if ttl != 0 {
+			expires = time.Now().Add(ttl)
+		}
+	}
+	if !limitExpires.IsZero() {
+		if !limitExpires.After(time.Now()) {
+			return "", nil, time.Time{}, affinity.ErrUnauthorized
+		}
+		if expires.IsZero() || expires.After(limitExpires) {
+			expires = limitExpires
+		}
+	}
+	return name, scope, expires, nil
+}
@@ -0,0 +1,457 @@
+/*
+   Affinity - Private groups as a service
+   Copyright (C) 2014  Canonical, Ltd.
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Library General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Library General Public License for more details.
+
+   You should have received a copy of the GNU Library General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package server_test
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "launchpad.net/gocheck"
+
+	. "github.com/juju/affinity"
+	"github.com/juju/affinity/group"
+	"github.com/juju/affinity/providers/apitoken"
+	"github.com/juju/affinity/rbac"
+	"github.com/juju/affinity/rbac/storage/mem"
+	server "github.com/juju/affinity/server/group"
+)
+
+func TestGroupServerSuite(t *testing.T) { TestingT(t) }
+
+type GroupServerSuite struct {
+	*httptest.Server
+	store rbac.FactStore
+}
+
+var _ = Suite(&GroupServerSuite{})
+
+// MockScheme authenticates tokens which carry the hex-encoded principal, and
+// optionally a scope of permission names separated by "+".
+type MockScheme struct{}
+
+func (s *MockScheme) Name() string { return "mock" }
+
+func (s *MockScheme) Authenticate(r *http.Request) (user Principal, err error) {
+	return AuthRequestToken(s, r)
+}
+
+func (s *MockScheme) Authorize(user Principal) (token *TokenInfo, err error) {
+	token = NewTokenInfo(s.Name())
+	token.Values.Set("data", hex.EncodeToString([]byte(user.String())))
+	return token, nil
+}
+
+func (s *MockScheme) Validate(token *TokenInfo) (user Principal, err error) {
+	data, err := hex.DecodeString(token.Values.Get("data"))
+	if err != nil {
+		return user, err
+	}
+	return ParsePrincipal(string(data))
+}
+
+func (s *MockScheme) Scope(r *http.Request) ([]string, error) {
+	token, err := ParseTokenInfo(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+	if scope := token.Values.Get("scope"); scope != "" {
+		return strings.Split(scope, "+"), nil
+	}
+	return nil, nil
+}
+
+var (
+	serviceAdmin = MustParsePrincipal("mock:admin")
+	fry          = MustParsePrincipal("mock:fry")
+	leela        = MustParsePrincipal("mock:leela")
+	bender       = MustParsePrincipal("mock:bender")
+)
+
+func (s *GroupServerSuite) SetUpTest(c *C) {
+	s.store = mem.NewFactStore()
+	err := rbac.NewAdmin(s.store, group.GroupRoles).Grant(serviceAdmin, group.ServiceRole, group.ServiceResource)
+	c.Assert(err, IsNil)
+	srv := server.NewGroupServer(s.store)
+	srv.Schemes.Register(&MockScheme{})
+	srv.Schemes.Register(apitoken.NewScheme(s.store))
+	s.Server = httptest.NewServer(srv)
+}
+
+func (s *GroupServerSuite) TearDownTest(c *C) {
+	s.Server.Close()
+}
+
+// request makes a request as a user, with credentials limited to a scope of
+// permissions if any are given. It returns the HTTP status and the decoded
+// response envelope.
+func (s *GroupServerSuite) request(c *C, method, path string, query url.Values, user Principal, scope ...string) (int, *Response) {
+	token, err := (&MockScheme{}).Authorize(user)
+	c.Assert(err, IsNil)
+	if len(scope) > 0 {
+		token.Values.Set("scope", strings.Join(scope, "+"))
+	}
+	return s.requestAuth(c, method, path, query, token.Serialize())
+}
+
+// requestAuth makes a request with an authorization header.
+func (s *GroupServerSuite) requestAuth(c *C, method, path string, query url.Values, authorization string) (int, *Response) {
+	u := s.URL + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", authorization)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	var envelope Response
+	c.Assert(json.NewDecoder(res.Body).Decode(&envelope), IsNil)
+	c.Check(envelope.Version, Equals, ResponseVersion)
+	return res.StatusCode, &envelope
+}
+
+// result makes a request which must succeed, and decodes its result.
+func (s *GroupServerSuite) result(c *C, method, path string, query url.Values, user Principal, result interface{}) {
+	status, envelope := s.request(c, method, path, query, user)
+	c.Assert(envelope.Error, IsNil, Commentf("%s %s", method, path))
+	c.Assert(status, Equals, http.StatusOK)
+	if result != nil {
+		c.Assert(json.Unmarshal(envelope.Result, result), IsNil)
+	}
+}
+
+// checkError checks that a request fails with an error code.
+func (s *GroupServerSuite) checkError(c *C, method, path string, query url.Values, user Principal, code ErrorCode) {
+	status, envelope := s.request(c, method, path, query, user)
+	comment := Commentf("%s %s?%s as %s", method, path, query.Encode(), user.String())
+	c.Check(status, Equals, code.StatusCode(), comment)
+	if c.Check(envelope.Error, NotNil, comment) {
+		c.Check(envelope.Error.Code, Equals, code, comment)
+	}
+}
+
+// addGroup adds a group owned by the service admin, with the given members.
+func (s *GroupServerSuite) addGroup(c *C, name string, members ...string) {
+	s.result(c, "PUT", fmt.Sprintf("/%s/", name), nil, serviceAdmin, nil)
+	for _, member := range members {
+		s.result(c, "PUT", fmt.Sprintf("/%s/%s/", name, member), nil, serviceAdmin, nil)
+	}
+}
+
+func (s *GroupServerSuite) TestWhy(c *C) {
+	s.addGroup(c, "crew", "affinity-group:delivery")
+	s.addGroup(c, "delivery", fry.String())
+	s.result(c, "PUT", "/crew/_/roles/observer/affinity-group:delivery", nil, serviceAdmin, nil)
+
+	query := url.Values{"perm": []string{"check-member"}}
+	var explanation rbac.Explanation
+	s.result(c, "GET", "/crew/mock:fry/why", query, fry, &explanation)
+	c.Check(explanation.Allowed, Equals, true)
+	c.Check(explanation.Supported, Equals, true)
+	c.Assert(explanation.Grant, NotNil)
+	c.Check(explanation.Grant.Role, Equals, "observer")
+	c.Check(explanation.Grant.Subject, Equals, "affinity-group:delivery")
+	c.Check(explanation.Grant.Groups, DeepEquals, []string{"affinity-group:delivery"})
+	c.Check(explanation.Grant.Resource, Equals, "affinity-group:crew")
+
+	// Leela may explain her own lack of access, but not Fry's.
+	s.result(c, "GET", "/crew/mock:leela/why", query, leela, &explanation)
+	c.Check(explanation.Allowed, Equals, false)
+	c.Check(explanation.Grant, IsNil)
+	s.checkError(c, "GET", "/crew/mock:fry/why", query, leela, CodeForbidden)
+
+	s.checkError(c, "GET", "/nowhere/mock:fry/why", query, fry, CodeNotFound)
+	s.checkError(c, "GET", "/crew/fry/why", query, fry, CodeInvalidPrincipal)
+	s.checkError(c, "GET", "/crew/mock:fry/why", url.Values{"perm": []string{"fly"}}, fry, CodeBadRequest)
+}
+
+func (s *GroupServerSuite) TestCheckMemberTransitive(c *C) {
+	s.addGroup(c, "crew", "affinity-group:delivery")
+	s.addGroup(c, "delivery", "affinity-group:pilots")
+	s.addGroup(c, "pilots", leela.String())
+
+	s.result(c, "GET", "/pilots/mock:leela/", nil, serviceAdmin, nil)
+	s.checkError(c, "GET", "/crew/mock:leela/", nil, serviceAdmin, CodeNotFound)
+	s.result(c, "GET", "/crew/mock:leela/", url.Values{"transitive": []string{"true"}}, serviceAdmin, nil)
+
+	// Membership is only followed to the depth given.
+	s.checkError(c, "GET", "/crew/mock:leela/",
+		url.Values{"transitive": []string{"true"}, "depth": []string{"2"}}, serviceAdmin, CodeNotFound)
+	s.result(c, "GET", "/crew/mock:leela/",
+		url.Values{"transitive": []string{"true"}, "depth": []string{"3"}}, serviceAdmin, nil)
+
+	// Cycles do not prevent a negative answer.
+	s.result(c, "PUT", "/pilots/affinity-group:crew/", nil, serviceAdmin, nil)
+	s.checkError(c, "GET", "/crew/mock:fry/", url.Values{"transitive": []string{"true"}}, serviceAdmin, CodeNotFound)
+
+	s.checkError(c, "GET", "/crew/mock:leela/", url.Values{"transitive": []string{"maybe"}}, serviceAdmin, CodeBadRequest)
+	s.checkError(c, "GET", "/crew/mock:leela/",
+		url.Values{"transitive": []string{"true"}, "depth": []string{"-1"}}, serviceAdmin, CodeBadRequest)
+	s.checkError(c, "GET", "/crew/mock:leela/", nil, fry, CodeForbidden)
+	s.checkError(c, "GET", "/nowhere/mock:leela/", nil, serviceAdmin, CodeNotFound)
+}
+
+func (s *GroupServerSuite) TestListMembers(c *C) {
+	s.addGroup(c, "crew", "affinity-group:pilots", fry.String())
+	s.addGroup(c, "pilots", leela.String())
+
+	var list group.MemberList
+	s.result(c, "GET", "/crew/", nil, serviceAdmin, &list)
+	c.Check(list.Group, Equals, MustParsePrincipal("affinity-group:crew"))
+	c.Check(list.Members, DeepEquals, []Principal{MustParsePrincipal("affinity-group:pilots"), fry})
+	c.Check(list.Offset, Equals, 0)
+	c.Check(list.Total, Equals, 2)
+
+	s.result(c, "GET", "/crew/", url.Values{"recursive": []string{"true"}}, serviceAdmin, &list)
+	c.Check(list.Members, DeepEquals, []Principal{fry, leela})
+
+	s.checkError(c, "GET", "/crew/", nil, bender, CodeForbidden)
+	s.checkError(c, "GET", "/nowhere/", nil, serviceAdmin, CodeNotFound)
+}
+
+func (s *GroupServerSuite) TestListMembersPaging(c *C) {
+	s.addGroup(c, "crowd")
+	for i := 0; i < 1005; i++ {
+		err := rbac.NewGroupFacts(s.store).AddMember("affinity-group:crowd", fmt.Sprintf("mock:user%04d", i))
+		c.Assert(err, IsNil)
+	}
+
+	var list group.MemberList
+	s.result(c, "GET", "/crowd/", nil, serviceAdmin, &list)
+	c.Check(list.Total, Equals, 1005)
+	c.Check(list.Members, HasLen, 100)
+	c.Check(list.Members[0].String(), Equals, "mock:user0000")
+
+	s.result(c, "GET", "/crowd/", url.Values{"offset": []string{"10"}, "limit": []string{"5"}}, serviceAdmin, &list)
+	c.Check(list.Offset, Equals, 10)
+	c.Assert(list.Members, HasLen, 5)
+	c.Check(list.Members[0].String(), Equals, "mock:user0010")
+
+	// The page size is limited.
+	s.result(c, "GET", "/crowd/", url.Values{"limit": []string{"5000"}}, serviceAdmin, &list)
+	c.Check(list.Members, HasLen, 1000)
+
+	// Pages past the end are empty.
+	s.result(c, "GET", "/crowd/", url.Values{"offset": []string{"2000"}}, serviceAdmin, &list)
+	c.Check(list.Members, HasLen, 0)
+	c.Check(list.Total, Equals, 1005)
+
+	for _, query := range []url.Values{
+		{"offset": []string{"-1"}},
+		{"offset": []string{"first"}},
+		{"limit": []string{"0"}},
+		{"limit": []string{"many"}},
+		{"recursive": []string{"maybe"}},
+	} {
+		s.checkError(c, "GET", "/crowd/", query, serviceAdmin, CodeBadRequest)
+	}
+}
+
+func (s *GroupServerSuite) TestWhoami(c *C) {
+	var user Principal
+	s.result(c, "GET", "/_/whoami", nil, fry, &user)
+	c.Check(user, Equals, fry)
+
+	res, err := http.Get(s.URL + "/_/whoami")
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Check(res.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+func (s *GroupServerSuite) TestGroupsOf(c *C) {
+	s.addGroup(c, "crew", "affinity-group:delivery")
+	s.addGroup(c, "delivery", fry.String())
+	s.addGroup(c, "secret", fry.String())
+	s.result(c, "PUT", "/crew/_/roles/observer/mock:leela", nil, serviceAdmin, nil)
+	s.result(c, "PUT", "/delivery/_/roles/observer/mock:leela", nil, serviceAdmin, nil)
+
+	crew := MustParsePrincipal("affinity-group:crew")
+	delivery := MustParsePrincipal("affinity-group:delivery")
+	secret := MustParsePrincipal("affinity-group:secret")
+
+	// Fry may list all his groups, direct and inherited.
+	var groups []Principal
+	s.result(c, "GET", "/_/groups/mock:fry", nil, fry, &groups)
+	c.Check(groups, DeepEquals, []Principal{crew, delivery, secret})
+
+	// Leela only sees the groups she may observe.
+	s.result(c, "GET", "/_/groups/mock:fry", nil, leela, &groups)
+	c.Check(groups, DeepEquals, []Principal{crew, delivery})
+
+	// Nor those outside the scope of her credentials.
+	status, envelope := s.request(c, "GET", "/_/groups/mock:fry", nil, leela, "add-member")
+	c.Check(status, Equals, http.StatusOK)
+	c.Check(string(envelope.Result), Equals, "null")
+
+	s.checkError(c, "GET", "/_/groups/fry", nil, leela, CodeInvalidPrincipal)
+}
+
+func (s *GroupServerSuite) TestManaged(c *C) {
+	s.addGroup(c, "crew")
+	s.addGroup(c, "delivery")
+	s.addGroup(c, "pilots")
+	s.result(c, "PUT", "/crew/_/roles/admin/mock:leela", nil, serviceAdmin, nil)
+	s.result(c, "PUT", "/pilots/_/roles/observer/mock:leela", nil, serviceAdmin, nil)
+
+	var groups []Principal
+	s.result(c, "GET", "/_/managed", nil, serviceAdmin, &groups)
+	c.Check(groups, HasLen, 3)
+	s.result(c, "GET", "/_/managed", nil, leela, &groups)
+	c.Check(groups, DeepEquals, []Principal{MustParsePrincipal("affinity-group:crew")})
+	s.result(c, "GET", "/_/managed", nil, fry, &groups)
+	c.Check(groups, HasLen, 0)
+}
+
+func (s *GroupServerSuite) TestGroupRoles(c *C) {
+	s.addGroup(c, "crew")
+
+	s.result(c, "PUT", "/crew/_/roles/admin/mock:leela", nil, serviceAdmin, nil)
+	var grants []group.RoleGrant
+	s.result(c, "GET", "/crew/_/roles", nil, serviceAdmin, &grants)
+	c.Assert(grants, HasLen, 2)
+	c.Check(grants[0].Role, Equals, "admin")
+	c.Check(grants[0].Principal, Equals, leela)
+	c.Check(grants[1].Role, Equals, "owner")
+	c.Check(grants[1].Principal, Equals, serviceAdmin)
+
+	// Leela may now add members, and observe roles, but not grant them.
+	s.result(c, "PUT", "/crew/mock:fry/", nil, leela, nil)
+	s.result(c, "GET", "/crew/_/roles", nil, leela, &grants)
+	s.checkError(c, "PUT", "/crew/_/roles/admin/mock:bender", nil, leela, CodeForbidden)
+	s.checkError(c, "GET", "/crew/_/roles", nil, bender, CodeForbidden)
+
+	s.result(c, "DELETE", "/crew/_/roles/admin/mock:leela", nil, serviceAdmin, nil)
+	s.checkError(c, "PUT", "/crew/mock:bender/", nil, leela, CodeForbidden)
+
+	s.checkError(c, "PUT", "/crew/_/roles/captain/mock:leela", nil, serviceAdmin, CodeBadRequest)
+	s.checkError(c, "PUT", "/crew/_/roles/admin/leela", nil, serviceAdmin, CodeInvalidPrincipal)
+	s.checkError(c, "GET", "/nowhere/_/roles", nil, serviceAdmin, CodeNotFound)
+}
+
+func (s *GroupServerSuite) TestServiceRoles(c *C) {
+	s.checkError(c, "PUT", "/crew/", nil, leela, CodeForbidden)
+	s.result(c, "PUT", "/_/roles/creator/mock:leela", nil, serviceAdmin, nil)
+	s.result(c, "PUT", "/crew/", nil, leela, nil)
+
+	var grants []group.RoleGrant
+	s.result(c, "GET", "/_/roles", nil, serviceAdmin, &grants)
+	c.Assert(grants, HasLen, 2)
+	c.Check(grants[0].Role, Equals, "creator")
+	c.Check(grants[0].Principal, Equals, leela)
+	c.Check(grants[1].Role, Equals, "service")
+	c.Check(grants[1].Principal, Equals, serviceAdmin)
+
+	// Only service managers may list or change service roles, and only
+	// within the scope of their credentials.
+	s.checkError(c, "GET", "/_/roles", nil, leela, CodeForbidden)
+	s.checkError(c, "PUT", "/_/roles/creator/mock:fry", nil, leela, CodeForbidden)
+	status, _ := s.request(c, "PUT", "/_/roles/creator/mock:fry", nil, serviceAdmin, "check-member")
+	c.Check(status, Equals, http.StatusForbidden)
+
+	s.result(c, "DELETE", "/_/roles/creator/mock:leela", nil, serviceAdmin, nil)
+	s.checkError(c, "PUT", "/delivery/", nil, leela, CodeForbidden)
+}
+
+func (s *GroupServerSuite) TestMintExpiresWithCredentials(c *C) {
+	var parent apitoken.MintedToken
+	s.result(c, "POST", "/_/tokens", url.Values{"ttl": []string{"1h"}}, fry, &parent)
+	c.Assert(parent.Expires.IsZero(), Equals, false)
+
+	// Tokens minted with an expiring token expire no later than it does.
+	for _, ttl := range []string{"", "1000h"} {
+		query := url.Values{}
+		if ttl != "" {
+			query.Set("ttl", ttl)
+		}
+		status, envelope := s.requestAuth(c, "POST", "/_/tokens", query, parent.Authorization)
+		c.Assert(status, Equals, http.StatusOK)
+		var child apitoken.MintedToken
+		c.Assert(json.Unmarshal(envelope.Result, &child), IsNil)
+		c.Check(child.Expires.IsZero(), Equals, false, Commentf("ttl %q", ttl))
+		c.Check(child.Expires.After(parent.Expires), Equals, false, Commentf("ttl %q", ttl))
+	}
+
+	// A shorter lifetime is kept.
+	status, envelope := s.requestAuth(c, "POST", "/_/tokens", url.Values{"ttl": []string{"1m"}}, parent.Authorization)
+	c.Assert(status, Equals, http.StatusOK)
+	var child apitoken.MintedToken
+	c.Assert(json.Unmarshal(envelope.Result, &child), IsNil)
+	c.Check(child.Expires.Before(parent.Expires.Add(-time.Minute)), Equals, true)
+}
+
+func (s *GroupServerSuite) TestTokensRequireScope(c *C) {
+	var minted apitoken.MintedToken
+	s.result(c, "POST", "/_/tokens", nil, fry, &minted)
+
+	for _, t := range []struct{ method, path string }{
+		{"GET", "/_/tokens"},
+		{"POST", "/_/tokens"},
+		{"DELETE", "/_/tokens/" + minted.Id},
+	} {
+		status, envelope := s.request(c, t.method, t.path, nil, fry, "check-member")
+		c.Check(status, Equals, http.StatusForbidden, Commentf("%s %s", t.method, t.path))
+		c.Check(ErrorCodeOf(envelope.Error), Equals, CodeForbidden)
+	}
+
+	var tokens []*apitoken.Token
+	status, envelope := s.request(c, "GET", "/_/tokens", nil, fry, "manage-tokens")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(envelope.Result, &tokens), IsNil)
+	c.Check(tokens, HasLen, 1)
+
+	// A token minted with scoped credentials is limited to their scope.
+	status, envelope = s.request(c, "POST", "/_/tokens", nil, fry, "manage-tokens")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(envelope.Result, &minted), IsNil)
+	c.Check(minted.Scope, DeepEquals, []string{"manage-tokens"})
+	status, _ = s.request(c, "DELETE", "/_/tokens/"+minted.Id, nil, fry, "manage-tokens")
+	c.Check(status, Equals, http.StatusOK)
+}
+
+// failingStore is a fact store which cannot be read.
+type failingStore struct {
+	rbac.FactStore
+}
+
+func (s failingStore) Exists(facts ...rbac.Fact) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func (s failingStore) Match(pattern rbac.Fact) ([]rbac.Fact, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func (s *GroupServerSuite) TestStoreErrors(c *C) {
+	// Permissions which cannot be checked are a failure of the service, not
+	// a denial of access.
+	srv := server.NewGroupServer(failingStore{s.store})
+	srv.Schemes.Register(&MockScheme{})
+	s.Server.Close()
+	s.Server = httptest.NewServer(srv)
+	s.checkError(c, "PUT", "/crew/", nil, leela, CodeInternal)
+	s.checkError(c, "GET", "/_/roles", nil, serviceAdmin, CodeInternal)
+}
@@ -18,7 +18,7 @@
 package server
 
 import (
-	"bytes"
+	"encoding/json"
 	"log"
 	"net/http"
 
@@ -28,62 +28,141 @@ import (
 	"github.com/juju/affinity/rbac"
 )
 
+// Response is a result or error to be sent in an affinity.Response envelope.
 type Response struct {
-	bytes.Buffer
+	// StatusCode is the HTTP status of the response. If zero, the status is
+	// 200 OK on success, or determined by the error code on failure.
 	StatusCode int
-	Error      error
+	// Error is the failure to respond with. Errors are classified by
+	// affinity.ErrorCodeOf, or by StatusCode if unclassified. Unclassified
+	// errors without a StatusCode are internal errors.
+	Error error
+	// Result is the value to respond with on success, encoded as JSON.
+	Result interface{}
+	// Challenges are sent as WWW-Authenticate headers, to tell the client
+	// how it may authenticate.
+	Challenges []*affinity.TokenInfo
 }
 
 func (r *Response) Send(w http.ResponseWriter) {
+	envelope := &affinity.Response{Version: affinity.ResponseVersion}
+	status := r.StatusCode
 	if r.Error != nil {
 		log.Println(r.Error)
-		if r.StatusCode == 0 {
-			r.StatusCode = 400
+		code := affinity.ErrorCodeOf(r.Error)
+		if code == "" {
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			code = affinity.StatusErrorCode(status)
+		} else if status == 0 {
+			status = code.StatusCode()
+		}
+		envelope.Error = &affinity.Error{Code: code, Message: r.Error.Error()}
+	} else if r.Result != nil {
+		result, err := json.Marshal(r.Result)
+		if err != nil {
+			log.Println(err)
+			status = http.StatusInternalServerError
+			envelope.Error = &affinity.Error{Code: affinity.CodeInternal, Message: err.Error()}
+		} else {
+			envelope.Result = result
 		}
 	}
-	if r.StatusCode != 0 {
-		w.WriteHeader(r.StatusCode)
+
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	for _, challenge := range r.Challenges {
+		w.Header().Add("WWW-Authenticate", challenge.Challenge())
 	}
-	w.Write(r.Bytes())
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	w.Write(body)
 }
 
 type AuthServer struct {
 	*mux.Router
 	Store   rbac.FactStore
 	Schemes *affinity.SchemeMap
+	// Realm is the protection space of the server, given in authentication
+	// challenges. If empty, the host of the request is used.
+	Realm string
+	// Authenticators are tried in order to authenticate a request, until
+	// one succeeds.
+	Authenticators []Authenticator
 }
 
 func NewAuthServer(store rbac.FactStore) *AuthServer {
-	return &AuthServer{mux.NewRouter(), store, affinity.NewSchemeMap()}
+	return &AuthServer{
+		Router:         mux.NewRouter(),
+		Store:          store,
+		Schemes:        affinity.NewSchemeMap(),
+		Authenticators: DefaultAuthenticators(),
+	}
 }
 
-func (s *AuthServer) Authenticate(r *http.Request) (user affinity.Principal, err error) {
-	auths, has := r.Header[http.CanonicalHeaderKey("Authorization")]
-	if !has {
-		// If the request does not have an authorization header,
-		// fallback on the handshake method.
-		for _, scheme := range s.Schemes.HandshakeAll() {
-			user, err := scheme.Authenticate(r)
-			if err != nil {
-				return user, err
-			}
+// Challenges returns the RFC 7235 challenges for the schemes a client may
+// use to authenticate a request: every registered token and handshake
+// scheme, and HTTP Basic if a registered scheme accepts it. Token schemes
+// whose credentials were sent with the request, but not accepted, are
+// challenged with an "invalid_token" error, so that the client does not
+// send them again.
+func (s *AuthServer) Challenges(r *http.Request) []*affinity.TokenInfo {
+	return s.challenges(r, Required)
+}
+
+// challenges returns the challenges for the schemes allowed by a policy.
+func (s *AuthServer) challenges(r *http.Request, policy Policy) []*affinity.TokenInfo {
+	realm := s.Realm
+	if realm == "" {
+		realm = r.Host
+	}
+	sent := make(map[string]bool)
+	for _, auth := range r.Header[http.CanonicalHeaderKey("Authorization")] {
+		if token, err := affinity.ParseTokenInfo(auth); err == nil {
+			sent[token.Scheme] = true
 		}
-		return affinity.Principal{}, affinity.ErrUnauthorized
 	}
-	for _, auth := range auths {
-		token, err := affinity.ParseTokenInfo(auth)
-		if err != nil {
-			continue
+
+	var names []string
+	basic := false
+	for _, scheme := range s.schemes(policy) {
+		switch scheme.(type) {
+		case affinity.TokenScheme, affinity.HandshakeScheme:
+			names = append(names, scheme.Name())
 		}
-		scheme := s.Schemes.Token(token.Scheme)
-		if scheme == nil {
-			continue
+		if _, ok := scheme.(affinity.BasicScheme); ok {
+			basic = true
 		}
-		user, err := scheme.Authenticate(r)
-		if err != nil {
-			continue
+	}
+	if basic {
+		names = append(names, "Basic")
+	}
+
+	var challenges []*affinity.TokenInfo
+	for _, name := range names {
+		challenge := affinity.NewTokenInfo(name)
+		challenge.Values.Set("realm", realm)
+		if sent[name] && s.Schemes.Token(name) != nil {
+			challenge.Values.Set("error", "invalid_token")
 		}
-		return user, nil
+		challenges = append(challenges, challenge)
+	}
+	return challenges
+}
+
+// Unauthorized returns a response to a request which failed to authenticate,
+// challenging the client to authenticate.
+func (s *AuthServer) Unauthorized(r *http.Request, err error) *Response {
+	return &Response{
+		Error:      err,
+		StatusCode: http.StatusUnauthorized,
+		Challenges: s.Challenges(r),
 	}
-	return affinity.Principal{}, affinity.ErrUnauthorized
 }
@@ -19,6 +19,8 @@ package server_test
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -81,7 +83,7 @@ func (ss *ServerSuite) SetUpTest(c *C) {
 		var err error
 		ss.currentUser, err = s.Authenticate(r)
 		if err == ErrUnauthorized {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			s.Unauthorized(r, err).Send(w)
 			return
 		} else if err != nil {
 			http.Error(w, "Server error", http.StatusInternalServerError)
@@ -121,8 +123,60 @@ func (ss *ServerSuite) TestBadAuth(c *C) {
 	c.Check(res.StatusCode, Equals, 200)
 }
 
+func (ss *ServerSuite) TestChallenges(c *C) {
+	res, err := http.Get(ss.URL + "/whoami")
+	c.Assert(err, IsNil)
+	c.Check(res.StatusCode, Equals, 401)
+	c.Check(res.Header[http.CanonicalHeaderKey("WWW-Authenticate")], DeepEquals,
+		[]string{fmt.Sprintf(`mock realm="%s"`, res.Request.Host)})
+
+	// Rejected credentials are challenged with an error.
+	req, err := http.NewRequest("GET", ss.URL+"/whoami", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Authorization", "mock data=bogus")
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Check(res.StatusCode, Equals, 401)
+	c.Check(res.Header[http.CanonicalHeaderKey("WWW-Authenticate")], DeepEquals,
+		[]string{fmt.Sprintf(`mock error="invalid_token", realm="%s"`, res.Request.Host)})
+}
+
 func (ss *ServerSuite) TestNotFound(c *C) {
 	res, err := http.Get(ss.URL + "/whaaaagarbl")
 	c.Check(err, IsNil)
 	c.Check(res.StatusCode, Equals, 404)
 }
+
+func (ss *ServerSuite) TestResponseEnvelope(c *C) {
+	for _, test := range []struct {
+		resp   *server.Response
+		status int
+		code   ErrorCode
+		result string
+	}{
+		{&server.Response{Result: []string{"fry"}}, 200, "", `["fry"]`},
+		{&server.Response{}, 200, "", ""},
+		{&server.Response{Error: &Error{Code: CodeForbidden, Message: "no"}}, 403, CodeForbidden, ""},
+		{&server.Response{Error: &Error{Code: CodeConflict, Message: "no"}}, 409, CodeConflict, ""},
+		{&server.Response{Error: ErrUnauthorized}, 401, CodeUnauthorized, ""},
+		{&server.Response{Error: errors.New("no")}, 500, CodeInternal, ""},
+		{&server.Response{Error: errors.New("no"), StatusCode: 400}, 400, CodeBadRequest, ""},
+		{&server.Response{Error: errors.New("no"), StatusCode: 404}, 404, CodeNotFound, ""},
+	} {
+		rec := httptest.NewRecorder()
+		test.resp.Send(rec)
+		c.Check(rec.Code, Equals, test.status)
+		c.Check(rec.Header().Get("Content-Type"), Equals, "application/json")
+		var envelope Response
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &envelope), IsNil)
+		c.Check(envelope.Version, Equals, ResponseVersion)
+		c.Check(string(envelope.Result), Equals, test.result)
+		if test.code == "" {
+			c.Check(envelope.Error, IsNil)
+		} else {
+			c.Assert(envelope.Error, NotNil)
+			c.Check(envelope.Error.Code, Equals, test.code)
+			c.Check(ErrorCodeOf(envelope.Error), Equals, test.code)
+		}
+	}
+}
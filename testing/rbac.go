@@ -18,6 +18,9 @@
 package testing
 
 import (
+	"sort"
+	"time"
+
 	. "launchpad.net/gocheck"
 
 	. "github.com/juju/affinity"
@@ -261,3 +264,320 @@ func (s *RbacSuite) TestResourceParentGrant(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(can, Equals, true)
 }
+
+func (s *RbacSuite) TestDenyGroupMember(c *C) {
+	crew := MustParsePrincipal("test:crew")
+	for _, member := range []string{"test:fry", "test:leela", "test:bender"} {
+		err := s.Facts.AddMember(crew.String(), member)
+		c.Assert(err, IsNil)
+	}
+	ship := spacecraftResource("spacecraft:planet-express-ship")
+	err := s.Admin.Grant(crew, PilotRole, ship)
+	c.Assert(err, IsNil)
+	// Bender is not to be trusted at the helm.
+	bender := MustParsePrincipal("test:bender")
+	err = s.Admin.Deny(bender, PilotRole, ship)
+	c.Assert(err, IsNil)
+
+	can, err := s.Access.Can(MustParsePrincipal("test:fry"), ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, true)
+	can, err = s.Access.Can(bender, ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, false)
+	has, err := s.Access.HasGrant(bender, PilotRole, ship)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+
+	// Denying the pilot role withholds its permissions, even if granted by another role.
+	err = s.Admin.Grant(bender, PassengerRole, ship)
+	c.Assert(err, IsNil)
+	can, err = s.Access.Can(bender, BoardShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, false)
+
+	err = s.Admin.RevokeDeny(bender, PilotRole, ship)
+	c.Assert(err, IsNil)
+	can, err = s.Access.Can(bender, ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, true)
+}
+
+func (s *RbacSuite) TestDenyResourceParent(c *C) {
+	building := facilitiesResource{name: "planet-express-hq"}
+	vendingMachine := facilitiesResource{name: "vending-machine", parent: &building}
+	staff := MustParsePrincipal("test:staff")
+	err := s.Facts.AddMember(staff.String(), "test:bender")
+	c.Assert(err, IsNil)
+	bender := MustParsePrincipal("test:bender")
+	err = s.Admin.Grant(bender, UserRole, vendingMachine)
+	c.Assert(err, IsNil)
+	// A denial to the group on the building covers everything in it.
+	err = s.Admin.Deny(staff, UserRole, building)
+	c.Assert(err, IsNil)
+
+	can, err := s.Access.Can(bender, UseThingPerm{}, vendingMachine)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, false)
+	has, err := s.Access.HasGrant(bender, UserRole, vendingMachine)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+}
+
+func (s *RbacSuite) TestGrantUntil(c *C) {
+	amy := MustParsePrincipal("test:amy")
+	ship := spacecraftResource("spacecraft:ship")
+	err := s.Admin.GrantUntil(amy, PilotRole, ship, time.Now().Add(time.Hour))
+	c.Assert(err, IsNil)
+	can, err := s.Access.Can(amy, ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, true)
+	// A shorter grant is redundant, a longer one extends it.
+	err = s.Admin.GrantUntil(amy, PilotRole, ship, time.Now().Add(time.Minute))
+	c.Check(err, NotNil)
+	err = s.Admin.GrantUntil(amy, PilotRole, ship, time.Now().Add(2*time.Hour))
+	c.Check(err, IsNil)
+
+	// Expired grants are ignored.
+	err = s.Admin.Revoke(amy, PilotRole, ship)
+	c.Assert(err, IsNil)
+	err = s.Admin.GrantUntil(amy, PilotRole, ship, time.Now().Add(-time.Hour))
+	c.Assert(err, IsNil)
+	can, err = s.Access.Can(amy, ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, false)
+	has, err := s.Access.HasGrant(amy, PilotRole, ship)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+	// Passenger role was granted permanently, and is unaffected.
+	can, err = s.Access.Can(amy, BoardShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, true)
+
+	err = s.Admin.Sweep()
+	c.Assert(err, IsNil)
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "pilot", Object: "spacecraft:ship"})
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+}
+
+func (s *RbacSuite) TestPathResourceParentGrant(c *C) {
+	fleet := rbac.NewPathResource("spacecraft:/planet-express", ControlShipPerm{}, BoardShipPerm{})
+	ship := rbac.NewPathResource("spacecraft:/planet-express/ship/", ControlShipPerm{}, BoardShipPerm{})
+	c.Check(ship.URI(), Equals, "spacecraft:/planet-express/ship")
+	c.Assert(ship.Parent(), NotNil)
+	c.Check(ship.Parent().URI(), Equals, "spacecraft:/planet-express")
+	c.Check(ship.Parent().Parent(), IsNil)
+
+	leela := MustParsePrincipal("test:leela")
+	err := s.Admin.Grant(leela, PilotRole, fleet)
+	c.Assert(err, IsNil)
+	can, err := s.Access.Can(leela, ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, true)
+	has, err := s.Access.HasGrant(leela, PilotRole, ship)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, true)
+
+	// Authority is not part of the path hierarchy.
+	hangar := rbac.NewPathResource("spacecraft://new-new-york/hangar/1", ControlShipPerm{})
+	c.Check(hangar.Parent().URI(), Equals, "spacecraft://new-new-york/hangar")
+	c.Check(hangar.Parent().Parent(), IsNil)
+	c.Check(rbac.NewPathResource("spacecraft:ship").Parent(), IsNil)
+}
+
+type cyclicRole struct {
+	*characterRole
+	parents []rbac.Role
+}
+
+func (r *cyclicRole) Parents() []rbac.Role { return r.parents }
+
+func (s *RbacSuite) TestCompositeRole(c *C) {
+	captainRole := rbac.NewCompositeRole("captain", []rbac.Role{PilotRole, BureaucratRole})
+	c.Check(captainRole.Can(ControlShipPerm{}), Equals, true)
+	c.Check(captainRole.Can(BoardShipPerm{}), Equals, true)
+	c.Check(captainRole.Can(FilePaperworkPerm{}), Equals, true)
+	c.Check(captainRole.Can(PerformSurgeryPerm{}), Equals, false)
+	c.Check(captainRole.Capabilities(), HasLen, 3)
+
+	roles, err := rbac.BuildRoleMap(captainRole, PilotRole, PassengerRole)
+	c.Assert(err, IsNil)
+	admin := rbac.NewAdmin(s.Facts, roles)
+	ship := spacecraftResource("spacecraft:nimbus")
+	zapp := MustParsePrincipal("test:zapp")
+	err = admin.Grant(zapp, captainRole, ship)
+	c.Assert(err, IsNil)
+	can, err := admin.Can(zapp, ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(can, Equals, true)
+
+	// Inheritance cycles are rejected when building a role map.
+	first := &cyclicRole{characterRole: &characterRole{"first", nil}}
+	second := &cyclicRole{characterRole: &characterRole{"second", nil}, parents: []rbac.Role{first}}
+	first.parents = []rbac.Role{second}
+	_, err = rbac.BuildRoleMap(PilotRole, first)
+	c.Check(err, ErrorMatches, "role inheritance cycle: first -> second -> first")
+	c.Check(func() { rbac.NewRoleMap(second) }, PanicMatches, "role inheritance cycle: second -> first -> second")
+}
+
+func (s *RbacSuite) TestGrants(c *C) {
+	crew := MustParsePrincipal("test:crew")
+	delivery := MustParsePrincipal("test:delivery-team")
+	c.Assert(s.Facts.AddMember(delivery.String(), "test:fry"), IsNil)
+	c.Assert(s.Facts.AddMember(crew.String(), delivery.String()), IsNil)
+	building := facilitiesResource{name: "planet-express-hq"}
+	c.Assert(s.Admin.Grant(crew, UserRole, building), IsNil)
+
+	grants, err := s.Access.Grants(MustParsePrincipal("test:fry"))
+	c.Assert(err, IsNil)
+	c.Assert(grants, HasLen, 2)
+	for _, grant := range grants {
+		switch grant.Role {
+		case PassengerRole:
+			c.Check(grant.Resource, Equals, "spacecraft:ship")
+			c.Check(grant.Subject, Equals, "test:fry")
+			c.Check(grant.Groups, HasLen, 0)
+		case UserRole:
+			c.Check(grant.Resource, Equals, "planet-express-hq")
+			c.Check(grant.Subject, Equals, "test:crew")
+			c.Check(grant.Groups, DeepEquals, []string{"test:delivery-team", "test:crew"})
+		default:
+			c.Fatalf("unexpected grant: %v", grant)
+		}
+	}
+
+	// Denied grants are not effective.
+	c.Assert(s.Admin.Deny(MustParsePrincipal("test:fry"), UserRole, building), IsNil)
+	grants, err = s.Access.Grants(MustParsePrincipal("test:fry"))
+	c.Assert(err, IsNil)
+	c.Assert(grants, HasLen, 1)
+	c.Check(grants[0].Role, Equals, rbac.Role(PassengerRole))
+}
+
+func (s *RbacSuite) TestGrantsDeniedOnContainer(c *C) {
+	fry := MustParsePrincipal("test:fry")
+	ship := rbac.NewPathResource("spacecraft:/planet-express/ship", ControlShipPerm{}, BoardShipPerm{})
+	fleet := rbac.NewPathResource("spacecraft:/planet-express", ControlShipPerm{}, BoardShipPerm{})
+	c.Assert(s.Admin.Grant(fry, PilotRole, ship), IsNil)
+	c.Assert(s.Admin.Deny(fry, PilotRole, fleet), IsNil)
+
+	has, err := s.Access.HasGrant(fry, PilotRole, ship)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+	grants, err := s.Access.Grants(fry)
+	c.Assert(err, IsNil)
+	for _, grant := range grants {
+		c.Check(grant.Role, Not(Equals), rbac.Role(PilotRole))
+	}
+}
+
+func (s *RbacSuite) TestGrantsMultiplePaths(c *C) {
+	// Fry is a member of the crew both directly and through the delivery team.
+	fry := MustParsePrincipal("test:fry")
+	crew := MustParsePrincipal("test:crew")
+	c.Assert(s.Facts.AddMember("test:delivery-team", fry.String()), IsNil)
+	c.Assert(s.Facts.AddMember(crew.String(), "test:delivery-team"), IsNil)
+	c.Assert(s.Facts.AddMember(crew.String(), fry.String()), IsNil)
+	building := facilitiesResource{name: "planet-express-hq"}
+	c.Assert(s.Admin.Grant(crew, UserRole, building), IsNil)
+
+	grants, err := s.Access.Grants(fry)
+	c.Assert(err, IsNil)
+	var crewGrants []rbac.EffectiveGrant
+	for _, grant := range grants {
+		if grant.Subject == crew.String() {
+			crewGrants = append(crewGrants, grant)
+		}
+	}
+	c.Assert(crewGrants, HasLen, 1)
+	c.Check(crewGrants[0].Groups, DeepEquals, []string{crew.String()})
+}
+
+func (s *RbacSuite) TestGrantsOn(c *C) {
+	ship := spacecraftResource("spacecraft:ship")
+	c.Assert(s.Admin.Deny(MustParsePrincipal("test:bender"), PassengerRole, ship), IsNil)
+
+	grants, err := s.Access.GrantsOn(ship)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, grant := range grants {
+		c.Check(grant.Resource, Equals, "spacecraft:ship")
+		c.Check(grant.Groups, HasLen, 0)
+		names = append(names, grant.Role.Role()+" "+grant.Subject)
+	}
+	c.Check(names, DeepEquals, []string{
+		"passenger test:amy",
+		"passenger test:fry",
+		"passenger test:hermes",
+		"passenger test:professor",
+		"passenger test:zoidberg",
+		"pilot test:leela",
+	})
+
+	grants, err = s.Access.GrantsOn(spacecraftResource("spacecraft:shuttle"))
+	c.Assert(err, IsNil)
+	c.Check(grants, HasLen, 0)
+}
+
+func (s *RbacSuite) TestWho(c *C) {
+	crew := MustParsePrincipal("test:crew")
+	c.Assert(s.Facts.AddMember(crew.String(), "test:leela"), IsNil)
+	c.Assert(s.Facts.AddMember(crew.String(), "test:bender"), IsNil)
+	c.Assert(s.Facts.AddMember(crew.String(), "test:fry"), IsNil)
+	// Malformed members are skipped.
+	c.Assert(s.Facts.AddMember(crew.String(), "zoidberg"), IsNil)
+	ship := spacecraftResource("spacecraft:ship")
+	c.Assert(s.Admin.Grant(crew, PilotRole, ship), IsNil)
+	c.Assert(s.Admin.Deny(MustParsePrincipal("test:bender"), PilotRole, ship), IsNil)
+
+	who, err := s.Access.Who(ControlShipPerm{}, ship)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, pr := range who {
+		names = append(names, pr.String())
+	}
+	sort.Strings(names)
+	c.Check(names, DeepEquals, []string{"test:crew", "test:fry", "test:leela"})
+
+	who, err = s.Access.Who(PerformSurgeryPerm{}, ship)
+	c.Assert(err, IsNil)
+	c.Check(who, HasLen, 0)
+}
+
+func (s *RbacSuite) TestExplain(c *C) {
+	crew := MustParsePrincipal("test:crew")
+	c.Assert(s.Facts.AddMember(crew.String(), "test:fry"), IsNil)
+	building := facilitiesResource{name: "planet-express-hq"}
+	vendingMachine := facilitiesResource{name: "vending-machine", parent: &building}
+	c.Assert(s.Admin.Grant(crew, UserRole, building), IsNil)
+
+	fry := MustParsePrincipal("test:fry")
+	explanation, err := s.Access.Explain(fry, UseThingPerm{}, vendingMachine)
+	c.Assert(err, IsNil)
+	c.Check(explanation.Allowed, Equals, true)
+	c.Check(explanation.Supported, Equals, true)
+	c.Check(explanation.Denial, IsNil)
+	c.Check(explanation.Grant, DeepEquals, &rbac.Derivation{
+		Role:     "user",
+		Resource: "planet-express-hq",
+		Subject:  "test:crew",
+		Groups:   []string{"test:crew"},
+	})
+
+	c.Assert(s.Admin.Deny(fry, UserRole, vendingMachine), IsNil)
+	explanation, err = s.Access.Explain(fry, UseThingPerm{}, vendingMachine)
+	c.Assert(err, IsNil)
+	c.Check(explanation.Allowed, Equals, false)
+	c.Check(explanation.Grant, IsNil)
+	c.Check(explanation.Denial, DeepEquals, &rbac.Derivation{
+		Role:     "user",
+		Resource: "vending-machine",
+		Subject:  "test:fry",
+	})
+
+	explanation, err = s.Access.Explain(fry, BoardShipPerm{}, vendingMachine)
+	c.Assert(err, IsNil)
+	c.Check(explanation.Allowed, Equals, false)
+	c.Check(explanation.Supported, Equals, false)
+}
@@ -18,6 +18,10 @@
 package testing
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	. "launchpad.net/gocheck"
 
 	"github.com/juju/affinity/rbac"
@@ -29,7 +33,7 @@ type StoreTests struct {
 
 func (s *StoreTests) SetUp(c *C) {
 	for _, grant := range futuramaGrants {
-		err := s.Facts.Assert(rbac.Fact{"affinity:rbac", grant.principal, grant.role, grant.resource})
+		err := s.Facts.Assert(rbac.Fact{Topic: "affinity:rbac", Subject: grant.principal, Predicate: grant.role, Object: grant.resource})
 		c.Assert(err, IsNil)
 	}
 }
@@ -63,19 +67,19 @@ var futuramaGrants []grantData = []grantData{
 func (s *StoreTests) TestFlatGrantStore(c *C) {
 	var has bool
 	var err error
-	has, err = s.Facts.Exists(rbac.Fact{"affinity:rbac", "test:bender", "passenger", "spacecraft:ship"})
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:bender", Predicate: "passenger", Object: "spacecraft:ship"})
 	c.Assert(has, Equals, true)
 	c.Assert(err, IsNil)
 
-	has, err = s.Facts.Exists(rbac.Fact{"affinity:rbac", "test:bender", "pilot", "spacecraft:ship"})
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:bender", Predicate: "pilot", Object: "spacecraft:ship"})
 	c.Assert(has, Equals, false)
 	c.Assert(err, IsNil)
 
-	has, err = s.Facts.Exists(rbac.Fact{"affinity:rbac", "test:bender", "janitor", "facilities:bucket"})
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:bender", Predicate: "janitor", Object: "facilities:bucket"})
 	c.Assert(has, Equals, false)
 	c.Assert(err, IsNil)
 
-	has, err = s.Facts.Exists(rbac.Fact{"affinity:rbac", "test:santa_claus", "pilot", "spacecraft:ship"})
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:santa_claus", Predicate: "pilot", Object: "spacecraft:ship"})
 	c.Assert(has, Equals, false)
 	c.Assert(err, IsNil)
 }
@@ -95,15 +99,220 @@ func (s *StoreTests) TestGroupGrants(c *C) {
 	c.Assert(groups, HasLen, 1)
 	c.Assert(groups[0], Equals, "delivery-team")
 	// Let's grant a role to the group
-	err = s.Facts.Assert(rbac.Fact{"affinity:rbac", "delivery-team", "pickup-delivery", "planet-express:postbox"})
+	err = s.Facts.Assert(rbac.Fact{Topic: "affinity:rbac", Subject: "delivery-team", Predicate: "pickup-delivery", Object: "planet-express:postbox"})
 	c.Assert(err, IsNil)
 	// Fry should be able to pick up a delivery from a post box, if we look up all containing groups.
-	matched, err := s.Facts.MatchAll(rbac.Fact{"affinity:rbac", "test:fry", "pickup-delivery", "planet-express:postbox"})
+	matched, err := s.Facts.MatchAll(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "pickup-delivery", Object: "planet-express:postbox"})
 	c.Assert(err, IsNil)
 	c.Assert(matched, HasLen, 1)
 	// MatchAll returns the matching fact, which applies to the group.
 	c.Check(matched[0].Subject, Equals, "delivery-team")
 	// However this grant was to a team of which he is a member, not directly to Fry.
-	has, err = s.Facts.Exists(rbac.Fact{"affinity:rbac", "test:fry", "pickup-delivery", "planet-express:postbox"})
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "pickup-delivery", Object: "planet-express:postbox"})
 	c.Assert(has, Equals, false)
 }
+
+func (s *StoreTests) TestFactExpires(c *C) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	err := s.Facts.Assert(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "janitor", Object: "facilities:bucket", Expires: expires})
+	c.Assert(err, IsNil)
+	matched, err := s.Facts.Match(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "janitor"})
+	c.Assert(err, IsNil)
+	c.Assert(matched, HasLen, 1)
+	c.Check(matched[0].Expires.Equal(expires), Equals, true)
+	// Expiration is not part of a fact's identity.
+	has, err := s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "janitor", Object: "facilities:bucket"})
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, true)
+
+	// Asserting again replaces the expiration.
+	err = s.Facts.Assert(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "janitor", Object: "facilities:bucket"})
+	c.Assert(err, IsNil)
+	matched, err = s.Facts.Match(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "janitor"})
+	c.Assert(err, IsNil)
+	c.Assert(matched, HasLen, 1)
+	c.Check(matched[0].Expires.IsZero(), Equals, true)
+
+	// Expired facts are not matched, and are removed by a sweep.
+	err = s.Facts.Assert(rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "janitor", Object: "facilities:bucket", Expires: time.Now().Add(-time.Hour)})
+	c.Assert(err, IsNil)
+	matched, err = s.Facts.Match(rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "janitor"})
+	c.Assert(err, IsNil)
+	c.Check(matched, HasLen, 0)
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "janitor", Object: "facilities:bucket"})
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, true)
+	err = s.Facts.Sweep("affinity:rbac")
+	c.Assert(err, IsNil)
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "janitor", Object: "facilities:bucket"})
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+	has, err = s.Facts.Exists(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "janitor", Object: "facilities:bucket"})
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, true)
+}
+
+func (s *StoreTests) TestApply(c *C) {
+	fry := rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "passenger", Object: "spacecraft:ship"}
+	bender := rbac.Fact{Topic: "affinity:rbac", Subject: "test:bender", Predicate: "pilot", Object: "spacecraft:ship"}
+	err := s.Facts.Apply(rbac.Change{Fact: fry, Deny: true}, rbac.Change{Fact: bender})
+	c.Assert(err, IsNil)
+	has, err := s.Facts.Exists(fry)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+	has, err = s.Facts.Exists(bender)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, true)
+
+	// Changes are made in order.
+	err = s.Facts.Apply(rbac.Change{Fact: fry, Deny: true}, rbac.Change{Fact: fry}, rbac.Change{Fact: bender}, rbac.Change{Fact: bender, Deny: true})
+	c.Assert(err, IsNil)
+	has, err = s.Facts.Exists(fry)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, true)
+	has, err = s.Facts.Exists(bender)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+
+	// Denying facts which do not exist is not an error.
+	err = s.Facts.Deny(bender, bender)
+	c.Assert(err, IsNil)
+}
+
+func (s *StoreTests) TestInsert(c *C) {
+	nonce := rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "nonce", Object: "abc123",
+		Expires: time.Now().Add(time.Hour)}
+	inserted, err := s.Facts.Insert(nonce)
+	c.Assert(err, IsNil)
+	c.Check(inserted, Equals, true)
+	// Facts which have not expired are not replaced.
+	inserted, err = s.Facts.Insert(rbac.Fact{Topic: nonce.Topic, Subject: nonce.Subject,
+		Predicate: nonce.Predicate, Object: nonce.Object})
+	c.Assert(err, IsNil)
+	c.Check(inserted, Equals, false)
+	matched, err := s.Facts.Match(rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry", Predicate: "nonce"})
+	c.Assert(err, IsNil)
+	c.Assert(matched, HasLen, 1)
+	c.Check(matched[0].Expires.IsZero(), Equals, false)
+
+	// Facts which never expire are never replaced.
+	inserted, err = s.Facts.Insert(rbac.Fact{Topic: "affinity:rbac", Subject: "test:leela", Predicate: "pilot", Object: "spacecraft:ship"})
+	c.Assert(err, IsNil)
+	c.Check(inserted, Equals, false)
+
+	// Expired facts are replaced.
+	expired := rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "nonce", Object: "abc123",
+		Expires: time.Now().Add(-time.Hour)}
+	c.Assert(s.Facts.Assert(expired), IsNil)
+	expired.Expires = time.Now().Add(time.Hour)
+	inserted, err = s.Facts.Insert(expired)
+	c.Assert(err, IsNil)
+	c.Check(inserted, Equals, true)
+	matched, err = s.Facts.Match(rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "nonce"})
+	c.Assert(err, IsNil)
+	c.Check(matched, HasLen, 1)
+
+	// Only one of concurrent insertions of a fact succeeds.
+	results := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			inserted, err := s.Facts.Insert(rbac.Fact{Topic: "affinity:rbac", Subject: "test:bender",
+				Predicate: "nonce", Object: "abc123", Expires: time.Now().Add(time.Hour)})
+			results <- err == nil && inserted
+		}()
+	}
+	n := 0
+	for i := 0; i < 8; i++ {
+		if <-results {
+			n++
+		}
+	}
+	c.Check(n, Equals, 1)
+}
+
+func (s *StoreTests) TestLongValues(c *C) {
+	long := rbac.Fact{Topic: "affinity:rbac", Subject: "test:fry/" + strings.Repeat("s", 300),
+		Predicate: "state", Object: `{"return":"https://example.com/` + strings.Repeat("x", 1000) + `"}`}
+	c.Assert(s.Facts.Assert(long), IsNil)
+	matched, err := s.Facts.Match(rbac.Fact{Topic: "affinity:rbac", Subject: long.Subject})
+	c.Assert(err, IsNil)
+	c.Assert(matched, HasLen, 1)
+	c.Check(matched[0].Object, Equals, long.Object)
+}
+
+func (s *StoreTests) TestBatch(c *C) {
+	leela := rbac.Fact{Topic: "affinity:rbac", Subject: "test:leela", Predicate: "pilot", Object: "spacecraft:ship"}
+	amy := rbac.Fact{Topic: "affinity:rbac", Subject: "test:amy", Predicate: "pilot", Object: "spacecraft:ship"}
+	err := rbac.Batch(s.Facts, func(store rbac.FactStore) error {
+		if err := store.Deny(leela); err != nil {
+			return err
+		}
+		if err := store.Assert(amy); err != nil {
+			return err
+		}
+		// Changes are deferred until the batch is complete.
+		has, err := store.Exists(leela)
+		c.Check(has, Equals, true)
+		return err
+	})
+	c.Assert(err, IsNil)
+	has, err := s.Facts.Exists(leela)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+	has, err = s.Facts.Exists(amy)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, true)
+
+	// Nothing is changed if the batch fails.
+	err = rbac.Batch(s.Facts, func(store rbac.FactStore) error {
+		if err := store.Assert(leela); err != nil {
+			return err
+		}
+		return fmt.Errorf("leela is unavailable")
+	})
+	c.Assert(err, ErrorMatches, "leela is unavailable")
+	has, err = s.Facts.Exists(leela)
+	c.Assert(err, IsNil)
+	c.Check(has, Equals, false)
+}
+
+func (s *StoreTests) TestRemoveGroup(c *C) {
+	c.Assert(s.Facts.AddMember("delivery-team", "test:fry"), IsNil)
+	c.Assert(s.Facts.AddMember("planet-express", "delivery-team"), IsNil)
+	c.Assert(s.Facts.RemoveGroup("delivery-team"), IsNil)
+	isGroup, err := s.Facts.IsGroup("delivery-team")
+	c.Assert(err, IsNil)
+	c.Check(isGroup, Equals, false)
+	groups, err := s.Facts.Groups("test:fry")
+	c.Assert(err, IsNil)
+	c.Check(groups, HasLen, 0)
+	members, err := s.Facts.Members("planet-express")
+	c.Assert(err, IsNil)
+	c.Check(members, HasLen, 0)
+}
+
+func (s *StoreTests) TestIsMember(c *C) {
+	c.Assert(s.Facts.AddMember("delivery-team", "test:fry"), IsNil)
+	c.Assert(s.Facts.AddMember("planet-express", "delivery-team"), IsNil)
+	c.Assert(s.Facts.AddMember("earth", "planet-express"), IsNil)
+	// Cycles must not prevent a result
+	c.Assert(s.Facts.AddMember("delivery-team", "earth"), IsNil)
+
+	for _, test := range []struct {
+		group    string
+		maxDepth int
+		isMember bool
+	}{
+		{"delivery-team", 1, true},
+		{"planet-express", 1, false},
+		{"planet-express", 2, true},
+		{"earth", 2, false},
+		{"earth", 3, true},
+		{"earth", 0, true},
+		{"mom-corp", 0, false},
+	} {
+		isMember, err := s.Facts.IsMember(test.group, "test:fry", test.maxDepth)
+		c.Assert(err, IsNil)
+		c.Check(isMember, Equals, test.isMember, Commentf("%v", test))
+	}
+}
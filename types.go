@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 )
 
@@ -137,13 +138,37 @@ func ParseTokenInfo(header string) (*TokenInfo, error) {
 			return nil, fmt.Errorf("malformed authentication param: %q", part)
 		}
 		key, value := kvpair[0], kvpair[1]
-		value = strings.Trim(value, `"`)
-		value = strings.Replace(value, `\"`, `"`, -1)
+		if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+			value = unquote(value[1 : len(value)-1])
+		} else {
+			value = strings.Trim(value, `"`)
+			value = strings.Replace(value, `\"`, `"`, -1)
+		}
 		token.Values.Add(key, value)
 	}
 	return token, nil
 }
 
+// unquote replaces the quoted-pairs in the contents of an RFC 7230
+// quoted-string with the characters they escape.
+func unquote(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// quote escapes backslashes and double quotes, so that a value can be sent
+// in an RFC 7230 quoted-string.
+func quote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
+
 // Serialize renders an RFC 2617-compatible authorization string.
 func (t *TokenInfo) Serialize() string {
 	var buf bytes.Buffer
@@ -161,3 +186,27 @@ func (t *TokenInfo) Serialize() string {
 	}
 	return buf.String()
 }
+
+// Challenge renders an RFC 7235 challenge for a WWW-Authenticate header, with
+// parameters in sorted order and their values quoted.
+func (t *TokenInfo) Challenge() string {
+	var keys []string
+	for key := range t.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s", t.Scheme)
+	first := true
+	for _, key := range keys {
+		for _, value := range t.Values[key] {
+			if first {
+				first = false
+			} else {
+				fmt.Fprintf(&buf, ",")
+			}
+			fmt.Fprintf(&buf, ` %s="%s"`, key, quote(value))
+		}
+	}
+	return buf.String()
+}
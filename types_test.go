@@ -1,6 +1,8 @@
 package affinity_test
 
 import (
+	"net/url"
+
 	. "launchpad.net/gocheck"
 
 	. "github.com/juju/affinity"
@@ -90,3 +92,24 @@ func (s *AffinitySuite) TestParseToken(c *C) {
 	token2, err := ParseTokenInfo(token.Serialize())
 	c.Check(token, DeepEquals, token2)
 }
+
+func (s *AffinitySuite) TestChallenge(c *C) {
+	challenge := &TokenInfo{Scheme: "foo", Values: url.Values{
+		"realm": []string{"planet express"},
+		"error": []string{"invalid_token"},
+	}}
+	c.Check(challenge.Challenge(), Equals, `foo error="invalid_token", realm="planet express"`)
+	parsed, err := ParseTokenInfo(challenge.Challenge())
+	c.Assert(err, IsNil)
+	c.Check(parsed.Realm(), Equals, "planet express")
+	c.Check(parsed.Values.Get("error"), Equals, "invalid_token")
+
+	// Backslashes and quotes are escaped, and round-trip.
+	challenge = &TokenInfo{Scheme: "foo", Values: url.Values{
+		"realm": []string{`planet\express "delivery"`},
+	}}
+	c.Check(challenge.Challenge(), Equals, `foo realm="planet\\express \"delivery\""`)
+	parsed, err = ParseTokenInfo(challenge.Challenge())
+	c.Assert(err, IsNil)
+	c.Check(parsed.Realm(), Equals, `planet\express "delivery"`)
+}